@@ -0,0 +1,175 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const debugHelp = `commands:
+  s, step             run the next statement, stepping into functions
+  n, next             run the next statement, stepping over functions
+  f, finish           run until the current function returns
+  c, continue         run until the next breakpoint
+  b [file:]line|func  add a breakpoint, or list them with no arguments
+  d [file:]line|func  delete a breakpoint
+  p name|string       print a variable, or expand a string like "$a-$b"
+  l, list             show the current statement
+  bt, where           show the call stack
+  q, quit             stop running the program
+An empty line repeats the last command.
+`
+
+// debugger is the command-line front end for interp.Debugger, which reads
+// commands from in and writes to out.
+type debugger struct {
+	*interp.Debugger
+
+	in   *bufio.Scanner
+	out  io.Writer
+	last string
+}
+
+func newDebugger(in io.Reader, out io.Writer) *debugger {
+	d := &debugger{in: bufio.NewScanner(in), out: out}
+	d.Debugger = interp.NewDebugger(d.stop)
+	return d
+}
+
+func (d *debugger) stop(stop *interp.DebugStop) interp.DebugAction {
+	d.printStmt(stop)
+	for {
+		fmt.Fprintf(d.out, "(debug) ")
+		if !d.in.Scan() {
+			// no more commands; let the program finish
+			fmt.Fprintln(d.out)
+			return interp.DebugContinue
+		}
+		line := strings.TrimSpace(d.in.Text())
+		if line == "" {
+			line = d.last
+		}
+		d.last = line
+		if action, ok := d.command(stop, line); ok {
+			return action
+		}
+	}
+}
+
+// command runs a debugger command, and returns an action if the program
+// should resume.
+func (d *debugger) command(stop *interp.DebugStop, line string) (interp.DebugAction, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	switch fields[0] {
+	case "s", "step":
+		return interp.DebugStep, true
+	case "n", "next":
+		return interp.DebugNext, true
+	case "f", "finish":
+		return interp.DebugFinish, true
+	case "c", "continue":
+		return interp.DebugContinue, true
+	case "q", "quit":
+		return interp.DebugQuit, true
+	case "b", "break":
+		if arg == "" {
+			for _, bp := range d.Breakpoints() {
+				fmt.Fprintf(d.out, "%s\n", breakpointString(bp))
+			}
+			break
+		}
+		d.AddBreakpoint(parseBreakpoint(arg))
+	case "d", "delete":
+		if !d.RemoveBreakpoint(parseBreakpoint(arg)) {
+			fmt.Fprintf(d.out, "no breakpoint at %s\n", arg)
+		}
+	case "p", "print":
+		d.print(stop, arg)
+	case "l", "list":
+		d.printStmt(stop)
+	case "bt", "where":
+		for i, frame := range stop.Stack() {
+			fmt.Fprintf(d.out, "#%d %s at %s:%d\n", i, frame.Func, frame.Filename, frame.Line)
+		}
+	case "h", "help":
+		fmt.Fprint(d.out, debugHelp)
+	default:
+		fmt.Fprintf(d.out, "unknown command %q; try \"help\"\n", fields[0])
+	}
+	return 0, false
+}
+
+func (d *debugger) printStmt(stop *interp.DebugStop) {
+	src := stop.Source()
+	if i := strings.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i] + " ..."
+	}
+	fmt.Fprintf(d.out, "%s:%d: %s\n", stop.Filename, stop.Stmt.Pos().Line(), src)
+}
+
+func (d *debugger) print(stop *interp.DebugStop, arg string) {
+	if !syntax.ValidName(arg) {
+		s, err := stop.Expand(arg)
+		if err != nil {
+			fmt.Fprintf(d.out, "%v\n", err)
+			return
+		}
+		fmt.Fprintf(d.out, "%s\n", s)
+		return
+	}
+	vr := stop.Var(arg)
+	switch vr.Kind {
+	case expand.Unset:
+		fmt.Fprintf(d.out, "%s is unset\n", arg)
+	case expand.Indexed:
+		quoted := make([]string, len(vr.List))
+		for i, elem := range vr.List {
+			quoted[i] = syntax.Quote(elem)
+		}
+		fmt.Fprintf(d.out, "%s=(%s)\n", arg, strings.Join(quoted, " "))
+	case expand.Associative:
+		s, _ := stop.Expand("${" + arg + "[@]@A}")
+		fmt.Fprintf(d.out, "%s\n", s)
+	default:
+		fmt.Fprintf(d.out, "%s=%s\n", arg, syntax.Quote(vr.String()))
+	}
+}
+
+// parseBreakpoint parses a breakpoint such as "12", "file.sh:12" or "func".
+func parseBreakpoint(s string) interp.Breakpoint {
+	var bp interp.Breakpoint
+	file, lineStr := "", s
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		file, lineStr = s[:i], s[i+1:]
+	}
+	line, err := strconv.ParseUint(lineStr, 10, 0)
+	if err != nil {
+		bp.Func = s
+		return bp
+	}
+	bp.Filename, bp.Line = file, uint(line)
+	return bp
+}
+
+func breakpointString(bp interp.Breakpoint) string {
+	switch {
+	case bp.Func != "":
+		return bp.Func
+	case bp.Filename != "":
+		return fmt.Sprintf("%s:%d", bp.Filename, bp.Line)
+	}
+	return strconv.FormatUint(uint64(bp.Line), 10)
+}
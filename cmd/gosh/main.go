@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -17,7 +18,14 @@ import (
 	"mvdan.cc/sh/v3/syntax"
 )
 
-var command = flag.String("c", "", "command to be executed")
+var (
+	command    = flag.String("c", "", "command to be executed")
+	restricted = flag.Bool("r", false, "run in restricted mode")
+	debug      = flag.Bool("debug", false, "run under a debugger, reading its commands from the terminal or stdin")
+
+	coverProfile = flag.String("coverprofile", "", "write a coverage report to a file; .lcov/.info for LCOV, .html for HTML, or a Go cover profile otherwise")
+	cpuProfile   = flag.String("cpuprofile", "", "write a profile of where time is spent to a file; .txt for a text report, or a pprof profile otherwise")
+)
 
 func main() {
 	flag.Parse()
@@ -25,6 +33,10 @@ func main() {
 	if e, ok := interp.IsExitStatus(err); ok {
 		os.Exit(int(e))
 	}
+	if _, ok := err.(interp.UnsupportedError); ok {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -32,16 +44,60 @@ func main() {
 }
 
 func runAll() error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	interactive := *command == "" && flag.NArg() == 0 &&
+		terminal.IsTerminal(int(os.Stdin.Fd()))
+	opts := []interp.RunnerOption{
+		interp.StdIO(os.Stdin, os.Stdout, os.Stderr),
+		interp.Interactive(interactive),
+		interp.Restricted(*restricted),
+	}
+	if *debug {
+		var in io.Reader = os.Stdin
+		if tty, err := os.Open("/dev/tty"); err == nil {
+			defer tty.Close()
+			in = tty
+		}
+		opts = append(opts, interp.Debug(newDebugger(in, os.Stderr).Debugger))
+	}
+	var cover *interp.Coverage
+	if *coverProfile != "" {
+		if *command != "" || flag.NArg() == 0 {
+			// such programs have no file name to report
+			return fmt.Errorf("-coverprofile requires programs to be given as files")
+		}
+		cover = interp.NewCoverage()
+		opts = append(opts, interp.Cover(cover))
+	}
+	var prof *interp.Profiler
+	if *cpuProfile != "" {
+		prof = interp.NewProfiler()
+		opts = append(opts, interp.Profile(prof))
+	}
+	r, err := interp.New(opts...)
 	if err != nil {
 		return err
 	}
 
+	err = runMain(r, interactive)
+	if cover != nil {
+		if err2 := writeCoverage(cover, *coverProfile); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	if prof != nil {
+		if err2 := writeProfile(prof, *cpuProfile); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func runMain(r *interp.Runner, interactive bool) error {
 	if *command != "" {
 		return run(r, strings.NewReader(*command), "")
 	}
 	if flag.NArg() == 0 {
-		if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		if interactive {
 			return runInteractive(r, os.Stdin, os.Stdout, os.Stderr)
 		}
 		return run(r, os.Stdin, "")
@@ -54,6 +110,38 @@ func runAll() error {
 	return nil
 }
 
+// writeCoverage writes a coverage report, choosing the format from the file
+// extension.
+func writeCoverage(cover *interp.Coverage, path string) error {
+	switch filepath.Ext(path) {
+	case ".lcov", ".info":
+		return writeFile(path, cover.WriteLCOV)
+	case ".html", ".htm":
+		return writeFile(path, cover.WriteHTML)
+	}
+	return writeFile(path, cover.WriteProfile)
+}
+
+// writeProfile writes a profile, choosing the format from the file extension.
+func writeProfile(prof *interp.Profiler, path string) error {
+	if filepath.Ext(path) == ".txt" {
+		return writeFile(path, prof.WriteReport)
+	}
+	return writeFile(path, prof.WritePprof)
+}
+
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func run(r *interp.Runner, reader io.Reader, name string) error {
 	prog, err := syntax.NewParser().Parse(reader, name)
 	if err != nil {
@@ -75,21 +163,21 @@ func runPath(r *interp.Runner, path string) error {
 
 func runInteractive(r *interp.Runner, stdin io.Reader, stdout, stderr io.Writer) error {
 	parser := syntax.NewParser()
-	fmt.Fprintf(stdout, "$ ")
+	ctx := context.Background()
+	fmt.Fprint(stdout, r.Prompt(ctx, "PS1"))
 	var runErr error
 	fn := func(stmts []*syntax.Stmt) bool {
 		if parser.Incomplete() {
-			fmt.Fprintf(stdout, "> ")
+			fmt.Fprint(stdout, r.Prompt(ctx, "PS2"))
 			return true
 		}
-		ctx := context.Background()
 		for _, stmt := range stmts {
 			runErr = r.Run(ctx, stmt)
 			if r.Exited() {
 				return false
 			}
 		}
-		fmt.Fprintf(stdout, "$ ")
+		fmt.Fprint(stdout, r.Prompt(ctx, "PS1"))
 		return true
 	}
 	if err := parser.Interactive(stdin, fn); err != nil {
@@ -4,12 +4,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 // Each test has an even number of strings, which form input-output pairs for
@@ -164,6 +170,26 @@ var interactiveTests = []struct {
 		},
 		wantErr: "1:1: reached EOF without matching ( with )",
 	},
+	{
+		pairs: []string{
+			"PS1='x\\n> '\n",
+			"x\n> ",
+			"PS2='... '\n",
+			"x\n> ",
+			"if true\n",
+			"... ",
+			"then echo foo; fi\n",
+			"foo\nx\n> ",
+		},
+	},
+	{
+		pairs: []string{
+			"PROMPT_COMMAND='n=$((n+1))'; PS1='$n $? '; false\n",
+			"1 1 ",
+			"true\n",
+			"2 0 ",
+		},
+	},
 }
 
 func TestInteractive(t *testing.T) {
@@ -172,7 +198,10 @@ func TestInteractive(t *testing.T) {
 		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
 			inReader, inWriter := io.Pipe()
 			outReader, outWriter := io.Pipe()
-			runner, _ := interp.New(interp.StdIO(inReader, outWriter, outWriter))
+			runner, _ := interp.New(
+				interp.StdIO(inReader, outWriter, outWriter),
+				interp.Interactive(true),
+			)
 			errc := make(chan error, 1)
 			go func() {
 				errc <- runInteractive(runner, inReader, outWriter, outWriter)
@@ -219,7 +248,7 @@ func TestInteractiveExit(t *testing.T) {
 	defer inReader.Close()
 	go io.WriteString(inWriter, "exit\n")
 	w := ioutil.Discard
-	runner, _ := interp.New(interp.StdIO(inReader, w, w))
+	runner, _ := interp.New(interp.StdIO(inReader, w, w), interp.Interactive(true))
 	if err := runInteractive(runner, inReader, w, w); err != nil {
 		t.Fatal("expected a nil error")
 	}
@@ -239,3 +268,109 @@ func readString(r io.Reader, want string) error {
 	}
 	return nil
 }
+
+func TestDebugger(t *testing.T) {
+	src := `greet() {
+	local who=$1
+	echo "hello $who"
+}
+list=(a "b c")
+greet world
+echo done`
+	cmds := "n\nn\nb greet\nb\nc\nbt\np list\np who\ns\np $who!\nd greet\nq\n"
+	want := `dbg.sh:1: greet() { ...
+(debug) dbg.sh:5: list=(a "b c")
+(debug) dbg.sh:6: greet world
+(debug) (debug) greet
+(debug) dbg.sh:2: local who=$1
+(debug) #0 greet at dbg.sh:2
+#1 main at dbg.sh:6
+(debug) list=(a 'b c')
+(debug) who is unset
+(debug) dbg.sh:3: echo "hello $who"
+(debug) world!
+(debug) (debug) `
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "dbg.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := newDebugger(strings.NewReader(cmds), &out)
+	r, _ := interp.New(interp.StdIO(nil, &out, &out), interp.Debug(d.Debugger))
+	err = r.Run(context.Background(), file)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+		t.Fatalf("want exit status 1 after quitting, got: %v", err)
+	}
+	if got := out.String(); got != want {
+		t.Fatalf("wrong output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestWriteCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := syntax.NewParser().Parse(strings.NewReader("true && echo yes"), "cov.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover := interp.NewCoverage()
+	r, _ := interp.New(interp.StdIO(nil, ioutil.Discard, ioutil.Discard), interp.Cover(cover))
+	r.Run(context.Background(), file)
+	tests := []struct {
+		name, wantPrefix string
+	}{
+		{"cover.out", "mode: count\ncov.sh:1.1,1.17 1 1\n"},
+		{"cover.lcov", "TN:\nSF:cov.sh\nBRDA:1,0,0,1\n"},
+		{"cover.html", "<!DOCTYPE html>"},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(dir, tc.name)
+		if err := writeCoverage(cover, path); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); !strings.HasPrefix(got, tc.wantPrefix) {
+			t.Fatalf("%s: wrong report:\nwant prefix:\n%s\ngot:\n%s", tc.name, tc.wantPrefix, got)
+		}
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := syntax.NewParser().Parse(strings.NewReader("true"), "prof.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := interp.NewProfiler()
+	r, _ := interp.New(interp.Profile(prof))
+	r.Run(context.Background(), file)
+	tests := []struct {
+		name, wantPrefix string
+	}{
+		{"cpu.txt", "   flat"},
+		{"cpu.pprof", "\x1f\x8b"}, // gzip
+	}
+	for _, tc := range tests {
+		path := filepath.Join(dir, tc.name)
+		if err := writeProfile(prof, path); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); !strings.HasPrefix(got, tc.wantPrefix) {
+			t.Fatalf("%s: wrong profile:\nwant prefix: %q\ngot: %q", tc.name, tc.wantPrefix, got)
+		}
+	}
+}
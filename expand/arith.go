@@ -6,38 +6,65 @@ package expand
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"mvdan.cc/sh/v3/syntax"
 )
 
+// ArithmError is returned by Arithm when an arithmetic expression is invalid or
+// cannot be evaluated, such as when dividing by zero.
+type ArithmError struct {
+	Expr    string // the expression being evaluated
+	Message string
+	Token   string // the part of the expression causing the error
+}
+
+func (e ArithmError) Error() string {
+	return fmt.Sprintf("%s: %s (error token is %q)", e.Expr, e.Message, e.Token)
+}
+
+// maxArithmDepth is the maximum number of nested expressions, including those
+// from evaluating the values of variables recursively. It matches Bash.
+const maxArithmDepth = 1024
+
+// Arithm evaluates an arithmetic expression. Like in Bash, variables holding
+// expressions are evaluated recursively, and integer constants may use bases
+// other than decimal, such as "0x1f", "017" or "2#1011".
+//
+// An ArithmError is returned if the expression cannot be evaluated.
 func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
+	n, err := cfg.arithm(expr, 0)
+	if aerr, ok := err.(ArithmError); ok && aerr.Expr == "" {
+		aerr.Expr = arithmString(expr)
+		err = aerr
+	}
+	return n, err
+}
+
+func (cfg *Config) arithm(expr syntax.ArithmExpr, depth int) (int, error) {
+	if depth++; depth > maxArithmDepth {
+		return 0, ArithmError{
+			Message: "expression recursion level exceeded",
+			Token:   arithmString(expr),
+		}
+	}
 	switch x := expr.(type) {
 	case *syntax.Word:
 		str, err := Literal(cfg, x)
 		if err != nil {
 			return 0, err
 		}
-		// recursively fetch vars
-		i := 0
-		for syntax.ValidName(str) {
-			val := cfg.envGet(str)
-			if val == "" {
-				break
-			}
-			if i++; i >= maxNameRefDepth {
-				break
-			}
-			str = val
-		}
-		// default to 0
-		return atoi(str), nil
+		return cfg.arithmValue(str, depth)
 	case *syntax.ParenArithm:
-		return Arithm(cfg, x.X)
+		return cfg.arithm(x.X, depth)
 	case *syntax.UnaryArithm:
 		switch x.Op {
 		case syntax.Inc, syntax.Dec:
 			name := x.X.(*syntax.Word).Lit()
-			old := atoi(cfg.envGet(name))
+			old, err := cfg.arithmValue(cfg.envGet(name), depth)
+			if err != nil {
+				return 0, err
+			}
 			val := old
 			if x.Op == syntax.Inc {
 				val++
@@ -52,7 +79,7 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 			}
 			return val, nil
 		}
-		val, err := Arithm(cfg, x.X)
+		val, err := cfg.arithm(x.X, depth)
 		if err != nil {
 			return 0, err
 		}
@@ -72,32 +99,191 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 			syntax.MulAssgn, syntax.QuoAssgn, syntax.RemAssgn,
 			syntax.AndAssgn, syntax.OrAssgn, syntax.XorAssgn,
 			syntax.ShlAssgn, syntax.ShrAssgn:
-			return cfg.assgnArit(x)
+			return cfg.assgnArit(x, depth)
 		case syntax.TernQuest: // TernColon can't happen here
-			cond, err := Arithm(cfg, x.X)
+			cond, err := cfg.arithm(x.X, depth)
 			if err != nil {
 				return 0, err
 			}
 			b2 := x.Y.(*syntax.BinaryArithm) // must have Op==TernColon
-			if cond == 1 {
-				return Arithm(cfg, b2.X)
+			if cond != 0 {
+				return cfg.arithm(b2.X, depth)
+			}
+			return cfg.arithm(b2.Y, depth)
+		case syntax.AndArit, syntax.OrArit:
+			left, err := cfg.arithm(x.X, depth)
+			if err != nil {
+				return 0, err
+			}
+			// like in C, the right side is only evaluated if needed
+			if (left != 0) == (x.Op == syntax.OrArit) {
+				return oneIf(left != 0), nil
 			}
-			return Arithm(cfg, b2.Y)
+			right, err := cfg.arithm(x.Y, depth)
+			if err != nil {
+				return 0, err
+			}
+			return oneIf(right != 0), nil
 		}
-		left, err := Arithm(cfg, x.X)
+		left, err := cfg.arithm(x.X, depth)
 		if err != nil {
 			return 0, err
 		}
-		right, err := Arithm(cfg, x.Y)
+		right, err := cfg.arithm(x.Y, depth)
 		if err != nil {
 			return 0, err
 		}
-		return binArit(x.Op, left, right), nil
+		return binArit(x.Op, left, right, x.Y)
 	default:
 		panic(fmt.Sprintf("unexpected arithm expr: %T", x))
 	}
 }
 
+// arithmValue evaluates a string found in an arithmetic expression, such as an
+// integer constant or the name of a variable. Variable values and other
+// strings are evaluated as expressions themselves.
+func (cfg *Config) arithmValue(str string, depth int) (int, error) {
+	str = strings.TrimSpace(str)
+	switch {
+	case str == "":
+		return 0, nil
+	case isArithmInt(str):
+		return parseArithmInt(str)
+	case syntax.ValidName(str):
+		val := cfg.envGet(str)
+		if val == "" {
+			return 0, nil
+		}
+		if depth >= maxArithmDepth {
+			return 0, ArithmError{
+				Expr:    str,
+				Message: "expression recursion level exceeded",
+				Token:   str,
+			}
+		}
+		return cfg.arithmValue(val, depth+1)
+	}
+	expr, err := syntax.NewParser().Arithmetic(strings.NewReader(str))
+	if err != nil {
+		token := str
+		if perr, ok := err.(syntax.ParseError); ok {
+			if offs := int(perr.Pos.Offset()); offs < len(str) {
+				token = str[offs:]
+			}
+		}
+		return 0, ArithmError{Expr: str, Message: "syntax error in expression", Token: token}
+	}
+	if expr == nil {
+		return 0, nil
+	}
+	if w, ok := expr.(*syntax.Word); ok && w.Lit() == str {
+		// neither a variable name nor a number, like "@"
+		return 0, ArithmError{Expr: str, Message: "syntax error: operand expected", Token: str}
+	}
+	n, err := cfg.arithm(expr, depth)
+	if aerr, ok := err.(ArithmError); ok && aerr.Expr == "" {
+		aerr.Expr = str
+		err = aerr
+	}
+	return n, err
+}
+
+// isArithmInt reports whether a string is a single integer constant token,
+// which may still be invalid, like "12abc".
+func isArithmInt(str string) bool {
+	if str[0] < '0' || str[0] > '9' {
+		return false
+	}
+	for _, c := range str {
+		if c != '#' && arithmDigit(c, 64) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseArithmInt parses an integer constant like Bash, which supports octal
+// numbers with a leading "0", hexadecimal numbers with a leading "0x", and
+// other bases from 2 to 64 in the form "base#digits".
+func parseArithmInt(str string) (int, error) {
+	base, digits := 10, str
+	if i := strings.IndexByte(str, '#'); i >= 0 {
+		n, err := strconv.Atoi(str[:i])
+		switch {
+		case err != nil, n == 0:
+			return 0, ArithmError{Message: "invalid number", Token: str}
+		case n < 2, n > 64:
+			return 0, ArithmError{Message: "invalid arithmetic base", Token: str}
+		}
+		base, digits = n, str[i+1:]
+		if digits == "" {
+			return 0, ArithmError{Message: "invalid integer constant", Token: str}
+		}
+	} else if len(str) > 1 && str[0] == '0' {
+		base, digits = 8, str[1:]
+		if digits[0] == 'x' || digits[0] == 'X' {
+			base, digits = 16, digits[1:]
+		}
+	}
+	var n uint64 // overflows wrap around, like in Bash
+	for _, c := range digits {
+		d := arithmDigit(c, base)
+		if d < 0 || d >= base {
+			return 0, ArithmError{Message: "value too great for base", Token: str}
+		}
+		n = n*uint64(base) + uint64(d)
+	}
+	return int(n), nil
+}
+
+// arithmDigit returns the value of a digit in the given base, or -1 if it
+// isn't a valid digit in any base. Bases up to 36 are case insensitive.
+func arithmDigit(c rune, base int) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'Z':
+		if base <= 36 {
+			return int(c-'A') + 10
+		}
+		return int(c-'A') + 36
+	case c == '@':
+		return 62
+	case c == '_':
+		return 63
+	}
+	return -1
+}
+
+// arithmString formats an arithmetic expression for error messages.
+func arithmString(expr syntax.ArithmExpr) string {
+	switch x := expr.(type) {
+	case *syntax.Word:
+		var b strings.Builder
+		syntax.NewPrinter().Print(&b, x)
+		return b.String()
+	case *syntax.ParenArithm:
+		return "(" + arithmString(x.X) + ")"
+	case *syntax.UnaryArithm:
+		if x.Post {
+			return arithmString(x.X) + x.Op.String()
+		}
+		return x.Op.String() + arithmString(x.X)
+	case *syntax.BinaryArithm:
+		switch x.Op {
+		case syntax.Comma:
+			return arithmString(x.X) + ", " + arithmString(x.Y)
+		case syntax.TernQuest:
+			b2 := x.Y.(*syntax.BinaryArithm)
+			return arithmString(x.X) + "?" + arithmString(b2.X) + ":" + arithmString(b2.Y)
+		}
+		return arithmString(x.X) + x.Op.String() + arithmString(x.Y)
+	}
+	return ""
+}
+
 func oneIf(b bool) int {
 	if b {
 		return 1
@@ -105,43 +291,21 @@ func oneIf(b bool) int {
 	return 0
 }
 
-// atoi is just a shorthand for strconv.Atoi that ignores the error,
-// just like shells do.
-func atoi(s string) int {
-	n, _ := strconv.Atoi(s)
-	return n
-}
-
-func (cfg *Config) assgnArit(b *syntax.BinaryArithm) (int, error) {
+func (cfg *Config) assgnArit(b *syntax.BinaryArithm, depth int) (int, error) {
 	name := b.X.(*syntax.Word).Lit()
-	val := atoi(cfg.envGet(name))
-	arg, err := Arithm(cfg, b.Y)
+	arg, err := cfg.arithm(b.Y, depth)
 	if err != nil {
 		return 0, err
 	}
-	switch b.Op {
-	case syntax.Assgn:
-		val = arg
-	case syntax.AddAssgn:
-		val += arg
-	case syntax.SubAssgn:
-		val -= arg
-	case syntax.MulAssgn:
-		val *= arg
-	case syntax.QuoAssgn:
-		val /= arg
-	case syntax.RemAssgn:
-		val %= arg
-	case syntax.AndAssgn:
-		val &= arg
-	case syntax.OrAssgn:
-		val |= arg
-	case syntax.XorAssgn:
-		val ^= arg
-	case syntax.ShlAssgn:
-		val <<= uint(arg)
-	case syntax.ShrAssgn:
-		val >>= uint(arg)
+	val := arg
+	if b.Op != syntax.Assgn {
+		old, err := cfg.arithmValue(cfg.envGet(name), depth)
+		if err != nil {
+			return 0, err
+		}
+		if val, err = binArit(assgnOps[b.Op], old, arg, b.Y); err != nil {
+			return 0, err
+		}
 	}
 	if err := cfg.envSet(name, strconv.Itoa(val)); err != nil {
 		return 0, err
@@ -149,6 +313,21 @@ func (cfg *Config) assgnArit(b *syntax.BinaryArithm) (int, error) {
 	return val, nil
 }
 
+// assgnOps maps each assignment operator like "+=" to its binary operator, as
+// "x += y" is equivalent to "x = x + y".
+var assgnOps = map[syntax.BinAritOperator]syntax.BinAritOperator{
+	syntax.AddAssgn: syntax.Add,
+	syntax.SubAssgn: syntax.Sub,
+	syntax.MulAssgn: syntax.Mul,
+	syntax.QuoAssgn: syntax.Quo,
+	syntax.RemAssgn: syntax.Rem,
+	syntax.AndAssgn: syntax.And,
+	syntax.OrAssgn:  syntax.Or,
+	syntax.XorAssgn: syntax.Xor,
+	syntax.ShlAssgn: syntax.Shl,
+	syntax.ShrAssgn: syntax.Shr,
+}
+
 func intPow(a, b int) int {
 	p := 1
 	for b > 0 {
@@ -161,7 +340,23 @@ func intPow(a, b int) int {
 	return p
 }
 
-func binArit(op syntax.BinAritOperator, x, y int) int {
+// binArit applies a binary operator. The right operand's expression is used
+// for errors such as dividing by zero.
+func binArit(op syntax.BinAritOperator, x, y int, yExpr syntax.ArithmExpr) (int, error) {
+	switch op {
+	case syntax.Quo, syntax.Rem:
+		if y == 0 {
+			return 0, ArithmError{Message: "division by 0", Token: arithmString(yExpr)}
+		}
+	case syntax.Pow:
+		if y < 0 {
+			return 0, ArithmError{Message: "exponent less than 0", Token: arithmString(yExpr)}
+		}
+	}
+	return binAritInt(op, x, y), nil
+}
+
+func binAritInt(op syntax.BinAritOperator, x, y int) int {
 	switch op {
 	case syntax.Add:
 		return x + y
@@ -194,13 +389,9 @@ func binArit(op syntax.BinAritOperator, x, y int) int {
 	case syntax.Xor:
 		return x ^ y
 	case syntax.Shr:
-		return x >> uint(y)
+		return x >> (uint(y) & 63)
 	case syntax.Shl:
-		return x << uint(y)
-	case syntax.AndArit:
-		return oneIf(x != 0 && y != 0)
-	case syntax.OrArit:
-		return oneIf(x != 0 || y != 0)
+		return x << (uint(y) & 63)
 	default: // syntax.Comma
 		// x is executed but its result discarded
 		return y
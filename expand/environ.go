@@ -65,16 +65,33 @@ const (
 // If a variable is set, its Value field will be a []string if it is an indexed
 // array, a map[string]string if it's an associative array, or a string
 // otherwise.
+//
+// Indexed arrays may be sparse. If Indices is nil, List holds the elements at
+// indices 0 to len(List)-1. Otherwise, Indices holds the index of each element
+// in List, in increasing order.
 type Variable struct {
 	Local    bool
 	Exported bool
 	ReadOnly bool
 
+	// Integer, Lower and Upper transform values as they are assigned, by
+	// evaluating them as arithmetic expressions or by converting their
+	// case. Trace has no effect on variables.
+	Integer bool
+	Lower   bool
+	Upper   bool
+	Trace   bool
+
+	// Declared is set on unset variables which were declared without a
+	// value, such as with "declare x", so that they can still be printed.
+	Declared bool
+
 	Kind ValueKind
 
-	Str  string            // Used when Kind is String or NameRef.
-	List []string          // Used when Kind is Indexed.
-	Map  map[string]string // Used when Kind is Associative.
+	Str     string            // Used when Kind is String or NameRef.
+	List    []string          // Used when Kind is Indexed.
+	Indices []int             // Used when Kind is Indexed and List is sparse.
+	Map     map[string]string // Used when Kind is Associative.
 }
 
 // IsSet returns whether the variable is set. An empty variable is set, but an
@@ -83,6 +100,32 @@ func (v Variable) IsSet() bool {
 	return v.Kind != Unset
 }
 
+// Flags returns the option letters which set the variable's attributes with
+// the declare builtin, in the order used by Bash. For example, an exported
+// indexed array results in "ax".
+func (v Variable) Flags() string {
+	var b strings.Builder
+	for _, attr := range [...]struct {
+		c  byte
+		on bool
+	}{
+		{'a', v.Kind == Indexed},
+		{'A', v.Kind == Associative},
+		{'i', v.Integer},
+		{'n', v.Kind == NameRef},
+		{'r', v.ReadOnly},
+		{'t', v.Trace},
+		{'x', v.Exported},
+		{'l', v.Lower},
+		{'u', v.Upper},
+	} {
+		if attr.on {
+			b.WriteByte(attr.c)
+		}
+	}
+	return b.String()
+}
+
 // String returns the variable's value as a string. In general, this only makes
 // sense if the variable has a string value or no value at all.
 func (v Variable) String() string {
@@ -90,15 +133,59 @@ func (v Variable) String() string {
 	case String:
 		return v.Str
 	case Indexed:
-		if len(v.List) > 0 {
-			return v.List[0]
-		}
+		s, _ := v.Elem(0)
+		return s
 	case Associative:
 		// nothing to do
 	}
 	return ""
 }
 
+// ArrayIndices returns the indices of the elements of an indexed array, in
+// increasing order.
+func (v Variable) ArrayIndices() []int {
+	if v.Indices != nil {
+		return v.Indices
+	}
+	indices := make([]int, len(v.List))
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+// ArrayIndex resolves an index into an indexed array. Like in Bash, negative
+// indices count back from one past the highest index, so -1 refers to the last
+// element. The boolean is false if the index is still negative.
+func (v Variable) ArrayIndex(i int) (int, bool) {
+	if i >= 0 {
+		return i, true
+	}
+	switch {
+	case v.Kind != Indexed:
+	case len(v.Indices) > 0:
+		i += v.Indices[len(v.Indices)-1] + 1
+	default:
+		i += len(v.List)
+	}
+	return i, i >= 0
+}
+
+// Elem returns the element at a non-negative index of an indexed array, and
+// whether that element is set.
+func (v Variable) Elem(i int) (string, bool) {
+	if v.Indices == nil {
+		if i >= 0 && i < len(v.List) {
+			return v.List[i], true
+		}
+		return "", false
+	}
+	if j := sort.SearchInts(v.Indices, i); j < len(v.Indices) && v.Indices[j] == i {
+		return v.List[j], true
+	}
+	return "", false
+}
+
 // maxNameRefDepth defines the maximum number of times to follow references when
 // resolving a variable. Otherwise, simple name reference loops could crash a
 // program quite easily.
@@ -14,6 +14,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"mvdan.cc/sh/v3/pattern"
 	"mvdan.cc/sh/v3/syntax"
@@ -57,6 +59,48 @@ type Config struct {
 	// "**".
 	GlobStar bool
 
+	// NullGlob corresponds to the shell option that makes globs which match
+	// no files expand to nothing, instead of being left as-is.
+	NullGlob bool
+
+	// FailGlob corresponds to the shell option that makes globs which match
+	// no files result in a NoMatchError. It takes precedence over NullGlob.
+	FailGlob bool
+
+	// DotGlob corresponds to the shell option that allows globs to match
+	// names beginning with a dot, without the dot being explicit. It is
+	// also enabled when the GLOBIGNORE variable is set and not empty.
+	DotGlob bool
+
+	// NoCaseGlob corresponds to the shell option that makes globbing match
+	// letters regardless of their case.
+	NoCaseGlob bool
+
+	// NoCaseMatch corresponds to the shell option that makes pattern
+	// substitution, such as ${foo/pattern/string}, match letters regardless
+	// of their case.
+	NoCaseMatch bool
+
+	// ExtGlob corresponds to the shell option that enables the extended
+	// pattern matching operators, such as "@(a|b)" and "!(a)".
+	ExtGlob bool
+
+	// Now returns the current time, used by prompt escapes such as "\t".
+	// If nil, time.Now is used.
+	Now func() time.Time
+
+	// UserName and HostName return the names used by the prompt escapes
+	// "\u" and "\h". If nil, os/user.Current and os.Hostname are used.
+	// The "\$" escape uses the "UID" variable from Env, and os.Getuid if
+	// it is unset.
+	UserName func() string
+	HostName func() string
+
+	// Warn is called with the errors which Bash reports without stopping
+	// the expansion, such as a bad array subscript, which then expands to
+	// nothing. If nil, such errors stop the expansion like any other.
+	Warn func(error)
+
 	bufferAlloc bytes.Buffer
 	fieldAlloc  [4]fieldPart
 	fieldsAlloc [4][]fieldPart
@@ -77,6 +121,31 @@ func (u UnexpectedCommandError) Error() string {
 	return fmt.Sprintf("unexpected command substitution at %s", u.Node.Pos())
 }
 
+// UnsupportedError is returned when an expansion uses a feature which is not
+// implemented, such as an unknown ${var@op} operator in a syntax tree which was
+// not built by the parser.
+type UnsupportedError struct {
+	Pos     syntax.Pos
+	Feature string
+}
+
+func (e UnsupportedError) Error() string {
+	if !e.Pos.IsValid() {
+		return fmt.Sprintf("unsupported: %s", e.Feature)
+	}
+	return fmt.Sprintf("%s: unsupported: %s", e.Pos, e.Feature)
+}
+
+// NoMatchError is returned if Config.FailGlob is set and a glob pattern matches
+// no files.
+type NoMatchError struct {
+	Pattern string
+}
+
+func (e NoMatchError) Error() string {
+	return "no match: " + e.Pattern
+}
+
 var zeroConfig = &Config{}
 
 func prepareConfig(cfg *Config) *Config {
@@ -165,7 +234,23 @@ func Document(cfg *Config, word *syntax.Word) (string, error) {
 	return cfg.fieldJoin(field), nil
 }
 
-const patMode = pattern.Filenames | pattern.Braces
+// patMode returns the pattern mode used for globbing and pattern matching.
+func (cfg *Config) patMode() pattern.Mode {
+	mode := pattern.Filenames | pattern.Braces
+	if cfg.ExtGlob {
+		mode |= pattern.ExtendedOperators
+	}
+	return mode
+}
+
+// matchMode returns the pattern mode used for pattern matching on strings, such
+// as in ${foo#pattern}.
+func (cfg *Config) matchMode() pattern.Mode {
+	if cfg.ExtGlob {
+		return pattern.ExtendedOperators
+	}
+	return 0
+}
 
 // Pattern expands a single shell word as a pattern, using syntax.QuotePattern
 // on any non-quoted parts of the input word. The result can be used on
@@ -182,7 +267,7 @@ func Pattern(cfg *Config, word *syntax.Word) (string, error) {
 	buf := cfg.strBuilder()
 	for _, part := range field {
 		if part.quote > quoteNone {
-			buf.WriteString(pattern.QuoteMeta(part.val, patMode))
+			buf.WriteString(pattern.QuoteMeta(part.val, cfg.patMode()))
 		} else {
 			buf.WriteString(part.val)
 		}
@@ -194,14 +279,25 @@ func Pattern(cfg *Config, word *syntax.Word) (string, error) {
 // shell's format specifications. These include printf(1), among others.
 //
 // The resulting string is returned, along with the number of arguments used.
+// If any of the arguments isn't a valid number or is out of range, the result
+// is still returned, along with an InvalidNumberError.
 //
 // The config specifies shell expansion options; nil behaves the same as an
 // empty config.
 func Format(cfg *Config, format string, args []string) (string, int, error) {
 	cfg = prepareConfig(cfg)
 	buf := cfg.strBuilder()
-	var fmts []byte
+	var invalid []string    // arguments which aren't valid numbers
+	var outOfRange []string // valid numbers which are out of range
 	initialArgs := len(args)
+	checkNum := func(arg string, valid, inRange bool) {
+		switch {
+		case !valid:
+			invalid = append(invalid, arg)
+		case !inRange:
+			outOfRange = append(outOfRange, arg)
+		}
+	}
 
 	for i := 0; i < len(format); i++ {
 		// readDigits reads from 0 to max digits, either octal or
@@ -275,64 +371,136 @@ func Format(cfg *Config, format string, args []string) (string, int, error) {
 				buf.WriteByte('\\')
 				buf.WriteByte(c)
 			}
-		case len(fmts) > 0:
-			switch c {
-			case '%':
+		case args != nil && c == '%':
+			// if args == nil, we are not doing format
+			// arguments
+			if i+1 < len(format) && format[i+1] == '%' {
 				buf.WriteByte('%')
-				fmts = nil
-			case 'c':
-				var b byte
-				if len(args) > 0 {
-					arg := ""
-					arg, args = args[0], args[1:]
-					if len(arg) > 0 {
-						b = arg[0]
-					}
+				i++
+				break
+			}
+			spec := formatSpec{width: -1, prec: -1}
+			// nextArg returns the next argument, or the empty
+			// string if there are none left.
+			nextArg := func() string {
+				if len(args) == 0 {
+					return ""
 				}
-				buf.WriteByte(b)
-				fmts = nil
-			case '+', '-', ' ':
-				if len(fmts) > 1 {
-					return "", 0, fmt.Errorf("invalid format char: %c", c)
+				arg := args[0]
+				args = args[1:]
+				return arg
+			}
+			// intArg parses an argument for "*".
+			intArg := func() int {
+				arg := nextArg()
+				n, valid, inRange := parseInt(arg, false)
+				checkNum(arg, valid, inRange)
+				return int(int64(n))
+			}
+			i++
+			for ; i < len(format) && strings.IndexByte("-+ #0'", format[i]) >= 0; i++ {
+				spec.flags += format[i : i+1]
+			}
+			if i < len(format) && format[i] == '*' {
+				if spec.width = intArg(); spec.width < 0 {
+					spec.flags += "-"
+					spec.width = -spec.width
 				}
-				fmts = append(fmts, c)
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				fmts = append(fmts, c)
-			case 's', 'd', 'i', 'u', 'o', 'x':
-				arg := ""
-				if len(args) > 0 {
-					arg, args = args[0], args[1:]
+				i++
+			} else if j := i; readNum(format, &i) {
+				spec.width, _ = strconv.Atoi(format[j:i])
+			}
+			if i < len(format) && format[i] == '.' {
+				i++
+				spec.prec = 0
+				if i < len(format) && format[i] == '*' {
+					spec.prec = intArg() // negative as if unset
+					i++
+				} else if j := i; readNum(format, &i) {
+					spec.prec, _ = strconv.Atoi(format[j:i])
 				}
-				var farg interface{} = arg
-				if c != 's' {
-					n, _ := strconv.ParseInt(arg, 0, 0)
-					if c == 'i' || c == 'd' {
-						farg = int(n)
-					} else {
-						farg = uint(n)
-					}
-					if c == 'i' || c == 'u' {
-						c = 'd'
-					}
+			}
+			if i < len(format) && format[i] == '(' {
+				end := strings.IndexByte(format[i:], ')')
+				if end < 0 || i+end+1 >= len(format) {
+					return "", 0, fmt.Errorf("missing format char")
 				}
-				fmts = append(fmts, c)
-				fmt.Fprintf(buf, string(fmts), farg)
-				fmts = nil
+				spec.timeFormat = format[i+1 : i+end]
+				i += end + 1
+				if format[i] != 'T' {
+					return "", 0, fmt.Errorf("invalid format char: %c", format[i])
+				}
+			}
+			if i >= len(format) {
+				return "", 0, fmt.Errorf("missing format char")
+			}
+			spec.conv = format[i]
+			switch spec.conv {
+			case 'c':
+				arg := nextArg() + "\x00"
+				arg = arg[:1] // a NUL byte if empty
+				spec.prec = -1
+				fmt.Fprintf(buf, spec.goFormat('s'), arg)
+			case 's':
+				fmt.Fprintf(buf, spec.goFormat('s'), nextArg())
+			case 'q':
+				fmt.Fprintf(buf, spec.goFormat('s'), printfQuote(nextArg()))
+			case 'b':
+				arg, stop := expandEscapes(nextArg())
+				fmt.Fprintf(buf, spec.goFormat('s'), arg)
+				if stop {
+					// "\c" stops all output
+					return buf.String(), initialArgs, invalidErr(invalid, outOfRange)
+				}
+			case 'T':
+				arg := nextArg()
+				s, ok := cfg.formatTime(spec.timeFormat, arg)
+				if !ok {
+					invalid = append(invalid, arg)
+				}
+				fmt.Fprintf(buf, spec.goFormat('s'), s)
+			case 'd', 'i', 'u', 'o', 'x', 'X':
+				arg := nextArg()
+				n, valid, inRange := parseInt(arg, spec.conv != 'd' && spec.conv != 'i')
+				checkNum(arg, valid, inRange)
+				switch spec.conv {
+				case 'd', 'i':
+					fmt.Fprintf(buf, spec.goFormat('d'), int64(n))
+				case 'u':
+					fmt.Fprintf(buf, spec.goFormat('d'), n)
+				default:
+					fmt.Fprintf(buf, spec.goFormat(spec.conv), n)
+				}
+			case 'e', 'E', 'f', 'F', 'g', 'G':
+				arg := nextArg()
+				f, valid, inRange := parseFloat(arg)
+				checkNum(arg, valid, inRange)
+				buf.WriteString(formatFloat(spec, f))
 			default:
-				return "", 0, fmt.Errorf("invalid format char: %c", c)
+				return "", 0, fmt.Errorf("invalid format char: %c", spec.conv)
 			}
-		case args != nil && c == '%':
-			// if args == nil, we are not doing format
-			// arguments
-			fmts = []byte{c}
 		default:
 			buf.WriteByte(c)
 		}
 	}
-	if len(fmts) > 0 {
-		return "", 0, fmt.Errorf("missing format char")
+	return buf.String(), initialArgs - len(args), invalidErr(invalid, outOfRange)
+}
+
+// readNum advances *i past any decimal digits in s, and reports whether there
+// were any.
+func readNum(s string, i *int) bool {
+	start := *i
+	for *i < len(s) && s[*i] >= '0' && s[*i] <= '9' {
+		*i++
+	}
+	return *i > start
+}
+
+func invalidErr(args, outOfRange []string) error {
+	if len(args) == 0 && len(outOfRange) == 0 {
+		return nil
 	}
-	return buf.String(), initialArgs - len(args), nil
+	return InvalidNumberError{Args: args, OutOfRange: outOfRange}
 }
 
 func (cfg *Config) fieldJoin(parts []fieldPart) string {
@@ -353,11 +521,11 @@ func (cfg *Config) escapedGlobField(parts []fieldPart) (escaped string, glob boo
 	buf := cfg.strBuilder()
 	for _, part := range parts {
 		if part.quote > quoteNone {
-			buf.WriteString(pattern.QuoteMeta(part.val, patMode))
+			buf.WriteString(pattern.QuoteMeta(part.val, cfg.patMode()))
 			continue
 		}
 		buf.WriteString(part.val)
-		if pattern.HasMeta(part.val, patMode) {
+		if pattern.HasMeta(part.val, cfg.patMode()) {
 			glob = true
 		}
 	}
@@ -397,6 +565,15 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 						fields = append(fields, matches...)
 						continue
 					}
+					// a nil slice means the pattern wasn't valid,
+					// so it's kept as-is
+					switch {
+					case matches == nil:
+					case cfg.FailGlob:
+						return nil, NoMatchError{Pattern: cfg.fieldJoin(field)}
+					case cfg.NullGlob:
+						continue
+					}
 				}
 				fields = append(fields, cfg.fieldJoin(field))
 			}
@@ -485,6 +662,8 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 				return nil, err
 			}
 			field = append(field, fieldPart{val: path})
+		case *syntax.ExtGlob:
+			field = append(field, fieldPart{val: extGlobString(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -603,6 +782,8 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 				return nil, err
 			}
 			splitAdd(path)
+		case *syntax.ExtGlob:
+			curField = append(curField, fieldPart{val: extGlobString(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -614,11 +795,21 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 	return fields, nil
 }
 
+// extGlobString returns the pattern for an extended globbing expression, like
+// "@(a|b)". Note that the pattern list is not expanded.
+func extGlobString(eg *syntax.ExtGlob) string {
+	return eg.Op.String() + eg.Pattern.Value + ")"
+}
+
 // quotedElems checks if a parameter expansion is exactly ${@} or ${foo[@]}
 func (cfg *Config) quotedElems(pe *syntax.ParamExp) []string {
 	if pe == nil || pe.Excl || pe.Length || pe.Width {
 		return nil
 	}
+	if pe.Exp != nil && pe.Exp.Op == syntax.OtherParamOps {
+		// operators like @A transform the whole parameter
+		return nil
+	}
 	if pe.Param.Value == "@" {
 		return cfg.Env.Get("@").List
 	}
@@ -673,15 +864,47 @@ func (cfg *Config) expandUser(field string) (prefix, rest string) {
 	return u.HomeDir, rest
 }
 
-func findAllIndex(pat, name string, n int) [][]int {
-	expr, err := pattern.Regexp(pat, 0)
+func findAllIndex(pat, name string, n int, mode pattern.Mode) [][]int {
+	expr, err := pattern.Regexp(pat, mode)
 	if err != nil {
+		// "!(" can't be a regular expression, but it can be a Matcher
+		if m, err := pattern.Compile(pat, mode); err == nil {
+			return findAllMatches(m, name, n)
+		}
 		return nil
 	}
 	rx := regexp.MustCompile(expr)
 	return rx.FindAllStringIndex(name, n)
 }
 
+// findAllMatches is like findAllIndex, but for patterns which can only be
+// matched against entire strings, so it tries the longest match first at each
+// position.
+func findAllMatches(m *pattern.Matcher, name string, n int) [][]int {
+	var locs [][]int
+	for i := 0; i <= len(name) && (n < 0 || len(locs) < n); {
+		size := 1
+		if i < len(name) {
+			_, size = utf8.DecodeRuneInString(name[i:])
+		}
+		for j := len(name); j >= i; j-- {
+			if j < len(name) && !utf8.RuneStart(name[j]) || !m.MatchString(name[i:j]) {
+				continue
+			}
+			// like with regexp, ignore empty matches right after a match
+			if j > i || len(locs) == 0 || locs[len(locs)-1][1] < i {
+				locs = append(locs, []int{i, j})
+			}
+			if j > i {
+				size = j - i
+			}
+			break
+		}
+		i += size
+	}
+	return locs
+}
+
 var rxGlobStar = regexp.MustCompile(".*")
 
 // pathJoin2 is a simpler version of filepath.Join without cleaning the result,
@@ -704,6 +927,8 @@ func pathSplit(path string) []string {
 	return strings.Split(path, string(filepath.Separator))
 }
 
+// glob expands a glob pattern into the matching file paths. If the pattern is
+// not valid, glob returns a nil slice, so that it can be used as-is.
 func (cfg *Config) glob(base, pat string) ([]string, error) {
 	parts := pathSplit(pat)
 	matches := []string{""}
@@ -718,6 +943,20 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 		}
 		parts = parts[1:]
 	}
+	mode := cfg.patMode() &^ pattern.Braces
+	if cfg.NoCaseGlob {
+		mode |= pattern.NoGlobCase
+	}
+	var ignore []*pattern.Matcher
+	for _, ipat := range strings.Split(cfg.envGet("GLOBIGNORE"), ":") {
+		if ipat == "" {
+			continue
+		}
+		if m, err := pattern.Compile(ipat, mode); err == nil {
+			ignore = append(ignore, m)
+		}
+	}
+	dotGlob := cfg.DotGlob || len(ignore) > 0
 	for i, part := range parts {
 		wantDir := i < len(parts)-1
 		switch {
@@ -739,7 +978,7 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 				var newMatches []string
 				for _, dir := range latest {
 					var err error
-					newMatches, err = cfg.globDir(base, dir, rxGlobStar, wantDir, newMatches)
+					newMatches, err = cfg.globDir(base, dir, rxGlobStar, dotGlob, wantDir, newMatches)
 					if err != nil {
 						return nil, err
 					}
@@ -754,25 +993,47 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 			}
 			continue
 		}
-		expr, err := pattern.Regexp(part, pattern.Filenames)
+		m, err := pattern.Compile(part, mode)
 		if err != nil {
 			// If any glob part is not a valid pattern, don't glob.
 			return nil, nil
 		}
-		rx := regexp.MustCompile("^" + expr + "$")
+		// Names starting with a dot must be matched explicitly.
+		hidden := dotGlob || strings.HasPrefix(part, ".") || strings.HasPrefix(part, `\.`)
 		var newMatches []string
 		for _, dir := range matches {
-			newMatches, err = cfg.globDir(base, dir, rx, wantDir, newMatches)
+			newMatches, err = cfg.globDir(base, dir, m, hidden, wantDir, newMatches)
 			if err != nil {
 				return nil, err
 			}
 		}
 		matches = newMatches
 	}
+	if len(ignore) > 0 {
+		kept := matches[:0]
+	matchLoop:
+		for _, match := range matches {
+			for _, m := range ignore {
+				if m.MatchString(match) {
+					continue matchLoop
+				}
+			}
+			kept = append(kept, match)
+		}
+		matches = kept
+	}
+	if matches == nil {
+		matches = []string{}
+	}
 	return matches, nil
 }
 
-func (cfg *Config) globDir(base, dir string, rx *regexp.Regexp, wantDir bool, matches []string) ([]string, error) {
+// stringMatcher is implemented by both *regexp.Regexp and *pattern.Matcher.
+type stringMatcher interface {
+	MatchString(string) bool
+}
+
+func (cfg *Config) globDir(base, dir string, m stringMatcher, hidden, wantDir bool, matches []string) ([]string, error) {
 	fullDir := dir
 	if !filepath.IsAbs(dir) {
 		fullDir = filepath.Join(base, dir)
@@ -796,10 +1057,10 @@ func (cfg *Config) globDir(base, dir string, rx *regexp.Regexp, wantDir bool, ma
 			// definitely not a directory
 			continue
 		}
-		if !strings.HasPrefix(rx.String(), `^\.`) && name[0] == '.' {
+		if !hidden && name[0] == '.' {
 			continue
 		}
-		if rx.MatchString(name) {
+		if m.MatchString(name) {
 			matches = append(matches, pathJoin2(dir, name))
 		}
 	}
@@ -90,3 +90,14 @@ func TestFieldsIdempotency(t *testing.T) {
 		}
 	}
 }
+
+func TestUnsupportedParamOp(t *testing.T) {
+	// the parser rejects unknown operators, but not all nodes come from it
+	word := parseWord(t, "${x@Q}")
+	pe := word.Parts[0].(*syntax.ParamExp)
+	pe.Exp.Word.Parts[0].(*syntax.Lit).Value = "Z"
+	_, err := Literal(nil, word)
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Fatalf("wanted UnsupportedError, got %v", err)
+	}
+}
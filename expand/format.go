@@ -0,0 +1,454 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package expand
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// InvalidNumberError is returned by Format when any of the arguments for the
+// numeric format specifiers isn't a valid number, or is out of range. Like in
+// Bash, the formatting is still done with the valid prefix of each of those
+// arguments, or zero, and with the closest value to those out of range. So the
+// resulting string and number of used arguments are returned too.
+type InvalidNumberError struct {
+	Args []string
+
+	// OutOfRange holds the valid numbers which were out of range. Bash
+	// only warns about these, without failing.
+	OutOfRange []string
+}
+
+func (e InvalidNumberError) Error() string {
+	var lines []string
+	for _, arg := range e.OutOfRange {
+		lines = append(lines, arg+": Numerical result out of range")
+	}
+	for _, arg := range e.Args {
+		lines = append(lines, arg+": invalid number")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// startTime is used by the "%(fmt)T" format with the argument -2, which
+// stands for the time the shell was started.
+var startTime = time.Now()
+
+// formatSpec is a parsed format specification, like "%-5.2f".
+type formatSpec struct {
+	flags      string
+	width      int // -1 if not set
+	prec       int // -1 if not set
+	conv       byte
+	timeFormat string // for "%(fmt)T"
+}
+
+// goFormat returns the equivalent format for the fmt package, replacing the
+// conversion with verb.
+func (s formatSpec) goFormat(verb byte) string {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, c := range s.flags {
+		if c != '\'' { // thousands grouping isn't supported
+			b.WriteRune(c)
+		}
+	}
+	if s.width >= 0 {
+		b.WriteString(strconv.Itoa(s.width))
+	}
+	if s.prec >= 0 {
+		b.WriteByte('.')
+		b.WriteString(strconv.Itoa(s.prec))
+	}
+	b.WriteByte(verb)
+	return b.String()
+}
+
+// charCode returns the character code for an argument like "'A", and whether
+// the argument has that form.
+func charCode(arg string) (rune, bool) {
+	if len(arg) == 0 || (arg[0] != '\'' && arg[0] != '"') {
+		return 0, false
+	}
+	if len(arg) == 1 {
+		return 0, true
+	}
+	r, _ := utf8.DecodeRuneInString(arg[1:])
+	return r, true
+}
+
+// parseInt parses an integer argument like the C strtoimax function, as used
+// by printf in Bash. Leading whitespace and a sign are allowed, and the base
+// may be hexadecimal with a "0x" prefix or octal with a "0" prefix. The
+// first boolean is false if the whole string isn't a valid number, in which
+// case the value of the valid prefix is returned. Values out of range are
+// clamped, and the second boolean is false.
+func parseInt(arg string, unsigned bool) (n uint64, valid, inRange bool) {
+	if r, ok := charCode(arg); ok {
+		return uint64(r), true, true
+	}
+	s := strings.TrimLeft(arg, " \t\n\r\v\f")
+	if s == "" {
+		return 0, arg == "", true
+	}
+	neg := false
+	switch s[0] {
+	case '-':
+		neg = true
+		fallthrough
+	case '+':
+		s = s[1:]
+	}
+	base := uint64(10)
+	switch {
+	case len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X'):
+		base = 16
+		s = s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base = 8
+	}
+	overflow := false
+	i := 0
+	for ; i < len(s); i++ {
+		d, ok := digitVal(s[i])
+		if !ok || d >= base {
+			break
+		}
+		if n > (math.MaxUint64-d)/base {
+			overflow = true
+		}
+		n = n*base + d
+	}
+	valid = i == len(s) && i > 0
+	inRange = true
+	switch {
+	case unsigned && overflow:
+		// like strtoumax, which doesn't negate the clamped value
+		return math.MaxUint64, valid, false
+	case unsigned:
+	case neg && (overflow || n > 1<<63):
+		n, inRange = 1<<63, false
+	case !neg && (overflow || n > math.MaxInt64):
+		n, inRange = math.MaxInt64, false
+	}
+	if neg {
+		n = -n
+	}
+	return n, valid, inRange
+}
+
+// parseFloat parses a floating point argument like the C strtold function. The
+// first boolean is false if the whole string isn't a valid number, in which
+// case the value of the longest valid prefix is returned. The second boolean
+// is false if the value is out of range.
+func parseFloat(arg string) (f float64, valid, inRange bool) {
+	if r, ok := charCode(arg); ok {
+		return float64(r), true, true
+	}
+	s := strings.TrimLeft(arg, " \t\n\r\v\f")
+	if s == "" {
+		return 0, arg == "", true
+	}
+	for i := len(s); i > 0; i-- {
+		f, err := strconv.ParseFloat(s[:i], 64)
+		if err == nil {
+			return f, i == len(s), true
+		}
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return f, i == len(s), false
+		}
+	}
+	return 0, false, true
+}
+
+// formatFloat formats a floating point number like C's printf, which differs
+// from the fmt package for infinities and NaNs.
+func formatFloat(spec formatSpec, f float64) string {
+	if !math.IsInf(f, 0) && !math.IsNaN(f) {
+		if spec.conv == 'g' || spec.conv == 'G' {
+			if spec.prec < 0 {
+				spec.prec = 6 // like C, unlike the fmt package
+			} else if spec.prec == 0 {
+				spec.prec = 1
+			}
+		}
+		return fmt.Sprintf(spec.goFormat(spec.conv), f)
+	}
+	s := "inf"
+	switch {
+	case math.IsNaN(f):
+		s = "nan"
+	case f < 0:
+		s = "-inf"
+	case strings.Contains(spec.flags, "+"):
+		s = "+inf"
+	case strings.Contains(spec.flags, " "):
+		s = " inf"
+	}
+	if spec.conv >= 'A' && spec.conv <= 'Z' {
+		s = strings.ToUpper(s)
+	}
+	spec.flags = strings.Replace(spec.flags, "0", "", -1)
+	spec.prec = -1
+	return fmt.Sprintf(spec.goFormat('s'), s)
+}
+
+// expandEscapes expands the backslash escape sequences in an argument for
+// "%b", like "echo -e" does. The boolean is true if "\c" was found, meaning
+// that no further output should be produced.
+func expandEscapes(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		// readDigits reads up to max digits in the given base.
+		readDigits := func(max int, base uint64) (uint64, int) {
+			var n uint64
+			j := 0
+			for ; j < max && i+j < len(s); j++ {
+				d, ok := digitVal(s[i+j])
+				if !ok || d >= base {
+					break
+				}
+				n = n*base + d
+			}
+			i += j - 1
+			return n, j
+		}
+		switch c = s[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'c':
+			return b.String(), true
+		case 'e', 'E':
+			b.WriteByte('\x1b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\':
+			b.WriteByte('\\')
+		case '0':
+			i++
+			n, _ := readDigits(3, 8)
+			b.WriteByte(byte(n))
+		case '1', '2', '3', '4', '5', '6', '7':
+			n, _ := readDigits(3, 8)
+			b.WriteByte(byte(n))
+		case 'x', 'u', 'U':
+			i++
+			max := 2
+			if c == 'u' {
+				max = 4
+			} else if c == 'U' {
+				max = 8
+			}
+			n, digits := readDigits(max, 16)
+			switch {
+			case digits == 0:
+				i-- // undo the i++ above
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c == 'x':
+				b.WriteByte(byte(n))
+			default:
+				b.WriteRune(rune(n))
+			}
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), false
+}
+
+func digitVal(c byte) (uint64, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return uint64(c - '0'), true
+	case 'a' <= c && c <= 'f':
+		return uint64(c-'a') + 10, true
+	case 'A' <= c && c <= 'F':
+		return uint64(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+// formatTime formats an argument for "%(fmt)T". The argument is a number of
+// seconds since the Unix epoch, where -1 or the empty string stand for the
+// current time, and -2 stands for the time the shell was started. The
+// boolean is false if the argument isn't a valid number.
+func (cfg *Config) formatTime(layout, arg string) (string, bool) {
+	n, valid, _ := parseInt(arg, false)
+	var t time.Time
+	switch {
+	case arg == "" || int64(n) == -1:
+		t = time.Now()
+	case int64(n) == -2:
+		t = startTime
+	default:
+		t = time.Unix(int64(n), 0)
+	}
+	if tz := cfg.envGet("TZ"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			t = t.In(loc)
+		}
+	}
+	if layout == "" {
+		layout = "%X"
+	}
+	return strftime(layout, t), valid
+}
+
+// strftime formats a time like the C strftime function, including the GNU
+// flags "-", "_", "0" and "^" to change the padding and case.
+func strftime(layout string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		if c != '%' || i+1 == len(layout) {
+			b.WriteByte(c)
+			continue
+		}
+		start := i
+		i++
+		var flag byte
+		switch layout[i] {
+		case '-', '_', '0', '^':
+			if i+1 < len(layout) {
+				flag = layout[i]
+				i++
+			}
+		}
+		if (layout[i] == 'E' || layout[i] == 'O') && i+1 < len(layout) {
+			i++ // locale modifiers make no difference
+		}
+		// num formats a number padded to width digits.
+		num := func(n, width int, pad byte) string {
+			switch flag {
+			case '-':
+				return strconv.Itoa(n)
+			case '_':
+				pad = ' '
+			case '0':
+				pad = '0'
+			}
+			s := strconv.Itoa(n)
+			if len(s) < width {
+				s = strings.Repeat(string(pad), width-len(s)) + s
+			}
+			return s
+		}
+		hour12 := t.Hour() % 12
+		if hour12 == 0 {
+			hour12 = 12
+		}
+		isoYear, isoWeek := t.ISOWeek()
+		yday := t.YearDay() - 1
+		wday := int(t.Weekday())
+		var s string
+		switch c = layout[i]; c {
+		case 'a':
+			s = t.Format("Mon")
+		case 'A':
+			s = t.Format("Monday")
+		case 'b', 'h':
+			s = t.Format("Jan")
+		case 'B':
+			s = t.Format("January")
+		case 'c':
+			s = t.Format("Mon Jan _2 15:04:05 2006")
+		case 'C':
+			s = num(t.Year()/100, 2, '0')
+		case 'd':
+			s = num(t.Day(), 2, '0')
+		case 'D', 'x':
+			s = t.Format("01/02/06")
+		case 'e':
+			s = num(t.Day(), 2, ' ')
+		case 'F':
+			s = t.Format("2006-01-02")
+		case 'g':
+			s = num(isoYear%100, 2, '0')
+		case 'G':
+			s = num(isoYear, 4, '0')
+		case 'H':
+			s = num(t.Hour(), 2, '0')
+		case 'I':
+			s = num(hour12, 2, '0')
+		case 'j':
+			s = num(yday+1, 3, '0')
+		case 'k':
+			s = num(t.Hour(), 2, ' ')
+		case 'l':
+			s = num(hour12, 2, ' ')
+		case 'm':
+			s = num(int(t.Month()), 2, '0')
+		case 'M':
+			s = num(t.Minute(), 2, '0')
+		case 'n':
+			s = "\n"
+		case 'p':
+			s = t.Format("PM")
+		case 'P':
+			s = t.Format("pm")
+		case 'r':
+			s = t.Format("03:04:05 PM")
+		case 'R':
+			s = t.Format("15:04")
+		case 's':
+			s = strconv.FormatInt(t.Unix(), 10)
+		case 'S':
+			s = num(t.Second(), 2, '0')
+		case 't':
+			s = "\t"
+		case 'T', 'X':
+			s = t.Format("15:04:05")
+		case 'u':
+			s = strconv.Itoa((wday+6)%7 + 1)
+		case 'U':
+			s = num((yday+7-wday)/7, 2, '0')
+		case 'V':
+			s = num(isoWeek, 2, '0')
+		case 'w':
+			s = strconv.Itoa(wday)
+		case 'W':
+			s = num((yday+7-(wday+6)%7)/7, 2, '0')
+		case 'y':
+			s = num(t.Year()%100, 2, '0')
+		case 'Y':
+			s = num(t.Year(), 1, '0')
+		case 'z':
+			s = t.Format("-0700")
+		case 'Z':
+			s = t.Format("MST")
+		case '%':
+			s = "%"
+		default:
+			s = layout[start : i+1]
+		}
+		if flag == '^' {
+			s = strings.ToUpper(s)
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
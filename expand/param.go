@@ -56,8 +56,11 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		vr = cfg.Env.Get(name)
 	}
 	orig := vr
-	_, vr = vr.Resolve(cfg.Env)
-	str, err := cfg.varInd(vr, index)
+	refName, vr := vr.Resolve(cfg.Env)
+	if refName != "" {
+		name = refName
+	}
+	str, set, err := cfg.varInd(vr, index)
 	if err != nil {
 		return "", err
 	}
@@ -79,7 +82,14 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		case Unset:
 			elems = nil
 		case Indexed:
-			elems = vr.List
+			// copied, as elements may be modified below
+			elems = append([]string(nil), vr.List...)
+		case Associative:
+			elems = make([]string, 0, len(vr.Map))
+			for _, val := range vr.Map {
+				elems = append(elems, val)
+			}
+			sort.Strings(elems)
 		}
 	}
 	switch {
@@ -96,25 +106,24 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		switch {
 		case pe.Names != 0:
 			strs = cfg.namesByPrefix(pe.Param.Value)
+			sort.Strings(strs)
 		case orig.Kind == NameRef:
 			strs = append(strs, orig.Str)
 		case vr.Kind == Indexed:
-			for i, e := range vr.List {
-				if e != "" {
-					strs = append(strs, strconv.Itoa(i))
-				}
+			for _, i := range vr.ArrayIndices() {
+				strs = append(strs, strconv.Itoa(i))
 			}
 		case vr.Kind == Associative:
 			for k := range vr.Map {
 				strs = append(strs, k)
 			}
+			sort.Strings(strs)
 		case !syntax.ValidName(str):
 			return "", fmt.Errorf("invalid indirect expansion")
 		default:
 			vr = cfg.Env.Get(str)
 			strs = append(strs, vr.String())
 		}
-		sort.Strings(strs)
 		str = strings.Join(strs, " ")
 	case pe.Slice != nil:
 		if pe.Slice.Offset != nil {
@@ -144,7 +153,11 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		if pe.Repl.All {
 			n = -1
 		}
-		locs := findAllIndex(orig, str, n)
+		mode := cfg.matchMode()
+		if cfg.NoCaseMatch {
+			mode |= pattern.NoGlobCase
+		}
+		locs := findAllIndex(orig, str, n, mode)
 		buf := cfg.strBuilder()
 		last := 0
 		for _, loc := range locs {
@@ -166,11 +179,11 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			}
 			fallthrough
 		case syntax.AlternateUnset:
-			if vr.IsSet() {
+			if set {
 				str = arg
 			}
 		case syntax.DefaultUnset:
-			if vr.IsSet() {
+			if set {
 				break
 			}
 			fallthrough
@@ -179,7 +192,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 				str = arg
 			}
 		case syntax.ErrorUnset:
-			if vr.IsSet() {
+			if set {
 				break
 			}
 			fallthrough
@@ -191,7 +204,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 				}
 			}
 		case syntax.AssignUnset:
-			if vr.IsSet() {
+			if set {
 				break
 			}
 			fallthrough
@@ -207,7 +220,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			suffix := op == syntax.RemSmallSuffix || op == syntax.RemLargeSuffix
 			small := op == syntax.RemSmallPrefix || op == syntax.RemSmallSuffix
 			for i, elem := range elems {
-				elems[i] = removePattern(elem, arg, suffix, small)
+				elems[i] = removePattern(elem, arg, suffix, small, cfg.matchMode())
 			}
 			str = strings.Join(elems, " ")
 		case syntax.UpperFirst, syntax.UpperAll,
@@ -219,17 +232,18 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			}
 			all := op == syntax.UpperAll || op == syntax.LowerAll
 
-			// empty string means '?'; nothing to do there
-			expr, err := pattern.Regexp(arg, 0)
+			if arg == "" {
+				arg = "?"
+			}
+			m, err := pattern.Compile(arg, cfg.matchMode())
 			if err != nil {
 				return str, nil
 			}
-			rx := regexp.MustCompile(expr)
 
 			for i, elem := range elems {
 				rs := []rune(elem)
 				for ri, r := range rs {
-					if rx.MatchString(string(r)) {
+					if m.MatchString(string(r)) {
 						rs[ri] = caseFunc(r)
 						if !all {
 							break
@@ -242,7 +256,13 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		case syntax.OtherParamOps:
 			switch arg {
 			case "Q":
-				str = strconv.Quote(str)
+				if !vr.IsSet() {
+					break // nothing to quote
+				}
+				for i, elem := range elems {
+					elems[i] = paramQuote(elem)
+				}
+				str = strings.Join(elems, " ")
 			case "E":
 				tail := str
 				var rns []rune
@@ -252,23 +272,120 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 					rns = append(rns, rn)
 				}
 				str = string(rns)
-			case "P", "A", "a":
-				panic(fmt.Sprintf("unhandled @%s param expansion", arg))
+			case "P":
+				prompts := make([]string, len(elems))
+				for i, elem := range elems {
+					if prompts[i], err = Prompt(cfg, elem); err != nil {
+						return "", err
+					}
+				}
+				str = strings.Join(prompts, " ")
+			case "A":
+				switch nodeLit(index) {
+				case "@", "*":
+					str = assignString(name, vr.Flags(), vr)
+				default:
+					// a single value, keeping the flags of its
+					// array, if any
+					elem := Variable{Kind: String, Str: str}
+					if !vr.IsSet() || (vr.Kind != String && str == "") {
+						elem.Kind = Unset
+					}
+					str = assignString(name, vr.Flags(), elem)
+				}
+			case "a":
+				flags := make([]string, len(elems))
+				for i := range elems {
+					flags[i] = vr.Flags()
+				}
+				str = strings.Join(flags, " ")
 			default:
-				panic(fmt.Sprintf("unexpected @%s param expansion", arg))
+				return "", UnsupportedError{
+					Pos:     pe.Pos(),
+					Feature: fmt.Sprintf("@%s param expansion", arg),
+				}
 			}
 		}
 	}
 	return str, nil
 }
 
-func removePattern(str, pat string, fromEnd, shortest bool) string {
-	var mode pattern.Mode
+// assignString formats a variable as the command which would recreate it with
+// the given attribute flags, like ${var@A}. Arrays are given in the format used
+// by "declare -p", and string values in single quotes.
+func assignString(name, flags string, vr Variable) string {
+	var b strings.Builder
+	if flags != "" {
+		b.WriteString("declare -" + flags + " ")
+	}
+	b.WriteString(name)
+	switch vr.Kind {
+	case Unset:
+		if flags == "" {
+			return ""
+		}
+	case Indexed:
+		if len(vr.List) == 0 {
+			break
+		}
+		b.WriteString("=(")
+		for i, index := range vr.ArrayIndices() {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString("[" + strconv.Itoa(index) + "]=" + dblQuote(vr.List[i]))
+		}
+		b.WriteString(")")
+	case Associative:
+		if len(vr.Map) == 0 {
+			break
+		}
+		keys := make([]string, 0, len(vr.Map))
+		for k := range vr.Map {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("=(")
+		for _, k := range keys {
+			b.WriteString("[" + k + "]=" + dblQuote(vr.Map[k]) + " ")
+		}
+		b.WriteString(")")
+	default:
+		b.WriteString("=")
+		b.WriteString(paramQuote(vr.Str))
+	}
+	return b.String()
+}
+
+// dblQuote quotes a string in double quotes, unless it contains non-printable
+// characters.
+func dblQuote(s string) string {
+	if !printable(s) {
+		return syntax.QuoteANSI(s)
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '$', '`':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func removePattern(str, pat string, fromEnd, shortest bool, mode pattern.Mode) string {
 	if shortest {
 		mode |= pattern.Shortest
 	}
 	expr, err := pattern.Regexp(pat, mode)
 	if err != nil {
+		// "!(" can't be a regular expression, but it can be a Matcher
+		if m, err := pattern.Compile(pat, mode); err == nil {
+			return removeMatch(str, m, fromEnd, shortest)
+		}
 		return str
 	}
 	switch {
@@ -291,33 +408,89 @@ func removePattern(str, pat string, fromEnd, shortest bool) string {
 	return str
 }
 
-func (cfg *Config) varInd(vr Variable, idx syntax.ArithmExpr) (string, error) {
+// removeMatch is like removePattern, but for patterns which can only be matched
+// against entire strings, so it tries each prefix or suffix in turn.
+func removeMatch(str string, m *pattern.Matcher, fromEnd, shortest bool) string {
+	for n := 0; n <= len(str); n++ {
+		i := n // length of the prefix or suffix
+		if !shortest {
+			i = len(str) - n
+		}
+		if fromEnd {
+			i = len(str) - i // start of the suffix
+		}
+		if i < len(str) && !utf8.RuneStart(str[i]) {
+			continue
+		}
+		if fromEnd && m.MatchString(str[i:]) {
+			return str[:i]
+		}
+		if !fromEnd && m.MatchString(str[:i]) {
+			return str[i:]
+		}
+	}
+	return str
+}
+
+// badSubscript reports a bad array subscript, which is an error only if there is
+// no Warn func.
+func (cfg *Config) badSubscript() error {
+	err := fmt.Errorf("%s: bad array subscript", cfg.curParam.Param.Value)
+	if cfg.Warn != nil {
+		cfg.Warn(err)
+		return nil
+	}
+	return err
+}
+
+// varInd expands a variable or one of its elements, and reports whether it is
+// set, for operators like ${a-b}. An array is only set if its element is, such
+// as the first element when there is no index.
+func (cfg *Config) varInd(vr Variable, idx syntax.ArithmExpr) (string, bool, error) {
 	if idx == nil {
-		return vr.String(), nil
+		switch vr.Kind {
+		case Indexed:
+			s, ok := vr.Elem(0)
+			return s, ok, nil
+		case Associative:
+			s, ok := vr.Map["0"]
+			return s, ok, nil
+		}
+		return vr.String(), vr.IsSet(), nil
 	}
 	switch vr.Kind {
 	case String:
+		switch nodeLit(idx) {
+		case "@", "*":
+			return vr.Str, true, nil
+		}
 		n, err := Arithm(cfg, idx)
 		if err != nil {
-			return "", err
+			return "", false, err
+		}
+		if n < 0 {
+			return "", false, cfg.badSubscript()
 		}
 		if n == 0 {
-			return vr.Str, nil
+			return vr.Str, true, nil
 		}
 	case Indexed:
 		switch nodeLit(idx) {
 		case "@":
-			return strings.Join(vr.List, " "), nil
+			return strings.Join(vr.List, " "), len(vr.List) > 0, nil
 		case "*":
-			return cfg.ifsJoin(vr.List), nil
+			return cfg.ifsJoin(vr.List), len(vr.List) > 0, nil
 		}
 		i, err := Arithm(cfg, idx)
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
-		if len(vr.List) > 0 {
-			return vr.List[i], nil
+		i, ok := vr.ArrayIndex(i)
+		if !ok {
+			return "", false, cfg.badSubscript()
 		}
+		s, ok := vr.Elem(i)
+		return s, ok, nil
 	case Associative:
 		switch lit := nodeLit(idx); lit {
 		case "@", "*":
@@ -327,17 +500,18 @@ func (cfg *Config) varInd(vr Variable, idx syntax.ArithmExpr) (string, error) {
 			}
 			sort.Strings(strs)
 			if lit == "*" {
-				return cfg.ifsJoin(strs), nil
+				return cfg.ifsJoin(strs), len(strs) > 0, nil
 			}
-			return strings.Join(strs, " "), nil
+			return strings.Join(strs, " "), len(strs) > 0, nil
 		}
 		val, err := Literal(cfg, idx.(*syntax.Word))
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
-		return vr.Map[val], nil
+		s, ok := vr.Map[val]
+		return s, ok, nil
 	}
-	return "", nil
+	return "", false, nil
 }
 
 func (cfg *Config) namesByPrefix(prefix string) []string {
@@ -0,0 +1,168 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package expand
+
+import (
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Prompt expands a prompt string such as $PS1, like interactive shells do
+// before printing it, and like ${var@P}.
+//
+// First, backslash escapes such as "\u" for the user name and "\w" for the
+// current directory are decoded. Then, the result goes through parameter
+// expansion, command substitution and arithmetic expansion. Unknown escapes are
+// kept as-is.
+//
+// The config specifies shell expansion options; nil behaves the same as an
+// empty config.
+func Prompt(cfg *Config, ps string) (string, error) {
+	cfg = prepareConfig(cfg)
+	word, err := syntax.NewParser().Document(strings.NewReader(cfg.promptEscapes(ps)))
+	if err != nil {
+		return "", err
+	}
+	return Document(cfg, word)
+}
+
+// promptEscapes decodes the backslash escapes in a prompt string. The decoded
+// text is escaped so that it's not expanded further.
+func (cfg *Config) promptEscapes(ps string) string {
+	var b strings.Builder
+	// quoted writes text which must be kept as-is when expanded as a
+	// document, such as the current directory.
+	quoted := func(s string) {
+		for _, r := range s {
+			switch r {
+			case '\\', '$', '`':
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+	}
+	var now time.Time
+	clock := func() time.Time {
+		if now.IsZero() {
+			if cfg.Now != nil {
+				now = cfg.Now()
+			} else {
+				now = time.Now()
+			}
+		}
+		return now
+	}
+	for i := 0; i < len(ps); i++ {
+		if ps[i] != '\\' || i+1 == len(ps) {
+			b.WriteByte(ps[i])
+			continue
+		}
+		i++
+		switch c := ps[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'e':
+			b.WriteByte('\x1b')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			quoted(`\`)
+		case '[', ']':
+			// markers for non-printing characters, which are
+			// only useful to line editors
+		case '$':
+			if cfg.envGet("UID") == "0" || (cfg.envGet("UID") == "" && os.Getuid() == 0) {
+				b.WriteByte('#')
+			} else {
+				quoted("$")
+			}
+		case 'u':
+			quoted(cfg.promptUser())
+		case 'h', 'H':
+			host := cfg.promptHost()
+			if c == 'h' {
+				host = strings.SplitN(host, ".", 2)[0]
+			}
+			quoted(host)
+		case 'w', 'W':
+			dir := cfg.envGet("PWD")
+			home := cfg.envGet("HOME")
+			switch {
+			case home != "" && dir == home:
+				dir = "~"
+			case c == 'W' && dir != "/":
+				dir = path.Base(dir)
+			case home != "" && strings.HasPrefix(dir, strings.TrimSuffix(home, "/")+"/"):
+				dir = "~" + dir[len(strings.TrimSuffix(home, "/")):]
+			}
+			quoted(dir)
+		case 's':
+			quoted(path.Base(cfg.envGet("0")))
+		case 'd':
+			quoted(strftime("%a %b %d", clock()))
+		case 't':
+			quoted(strftime("%H:%M:%S", clock()))
+		case 'T':
+			quoted(strftime("%I:%M:%S", clock()))
+		case '@':
+			quoted(strftime("%I:%M %p", clock()))
+		case 'A':
+			quoted(strftime("%H:%M", clock()))
+		case 'D':
+			end := strings.IndexByte(ps[i:], '}')
+			if i+1 >= len(ps) || ps[i+1] != '{' || end < 0 {
+				b.WriteString(`\\D`)
+				break
+			}
+			layout := ps[i+2 : i+end]
+			if layout == "" {
+				layout = "%X"
+			}
+			quoted(strftime(layout, clock()))
+			i += end
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(ps) && j < i+3 && ps[j] >= '0' && ps[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(ps[i:j], 8, 8)
+			quoted(string([]byte{byte(n)}))
+			i = j - 1
+		default:
+			// unknown escapes are kept, but the backslash must be
+			// escaped too
+			b.WriteString(`\\`)
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// promptUser returns the name of the current user, for "\u".
+func (cfg *Config) promptUser() string {
+	if cfg.UserName != nil {
+		return cfg.UserName()
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return cfg.envGet("USER")
+}
+
+// promptHost returns the host name, for "\h" and "\H".
+func (cfg *Config) promptHost() string {
+	if cfg.HostName != nil {
+		return cfg.HostName()
+	}
+	host, _ := os.Hostname()
+	return host
+}
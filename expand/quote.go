@@ -0,0 +1,68 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package expand
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// printable reports whether a string is valid UTF-8 with only printable
+// characters. Bash quotes all other strings with the $'...' form.
+func printable(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// paramQuote quotes a string like Bash's ${var@Q}, which always uses single
+// quotes unless the string isn't printable.
+func paramQuote(s string) string {
+	if !printable(s) {
+		return syntax.QuoteANSI(s)
+	}
+	if q := syntax.Quote(s); q != s {
+		return q
+	}
+	return "'" + s + "'"
+}
+
+// printfQuote quotes a string like Bash's "printf %q", which escapes the
+// characters special to the shell with backslashes, unless the string isn't
+// printable.
+func printfQuote(s string) string {
+	switch {
+	case s == "":
+		return "''"
+	case !printable(s):
+		return syntax.QuoteANSI(s)
+	}
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case ' ', '\'', '"', '\\', '|', '&', ';', '(', ')', '<', '>',
+			'!', '{', '}', '*', '[', '?', ']', '^', '$', '`', ',':
+			b.WriteByte('\\')
+		case '~':
+			// tilde expansion only happens at the start of a word, or
+			// after = and : in assignments
+			if i == 0 || s[i-1] == '=' || s[i-1] == ':' {
+				b.WriteByte('\\')
+			}
+		case '#':
+			// comments start at the beginning of a word
+			if i == 0 {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -6,10 +6,9 @@ package interp
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -25,7 +24,8 @@ func isBuiltin(name string) bool {
 		"wait", "builtin", "trap", "type", "source", ".", "command",
 		"dirs", "pushd", "popd", "umask", "alias", "unalias",
 		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "shopt":
+		"return", "read", "shopt", "jobs", "kill", "disown", "print",
+		"times", "mapfile", "readarray", "caller":
 		return true
 	}
 	return false
@@ -46,6 +46,9 @@ func atoi(s string) int {
 }
 
 func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, args []string) int {
+	if r.restrictedBuiltin(name, args) {
+		return 1
+	}
 	switch name {
 	case "true", ":":
 	case "false":
@@ -92,30 +95,44 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.Params = r.Params[n:]
 		}
 	case "unset":
-		vars := true
-		funcs := true
-	unsetOpts:
-		for i, arg := range args {
-			switch arg {
-			case "-v":
+		vars, funcs := true, true
+		args, exit := r.optionArgs(name, "fv", args, func(opt rune, optarg string) int {
+			if opt == 'v' {
 				funcs = false
-			case "-f":
+			} else {
 				vars = false
-			default:
-				args = args[i:]
-				break unsetOpts
 			}
+			return 0
+		})
+		if exit != 0 {
+			return exit
 		}
-
 		for _, arg := range args {
-			if vr := r.lookupVar(arg); vr.IsSet() && vars {
+			if vars && strings.HasSuffix(arg, "]") {
+				if name, index, ok := r.splitIndex(arg); ok && index != nil {
+					if code := r.delElem(name, index); code != 0 {
+						exit = code
+					}
+					continue
+				}
+			}
+			if vr := r.lookupVar(arg); vars && (vr.IsSet() || hasAttrs(vr)) {
+				if vr.ReadOnly {
+					r.errf("unset: %s: cannot unset: readonly variable\n", arg)
+					exit = 1
+					continue
+				}
 				r.delVar(arg)
 				continue
 			}
 			if _, ok := r.Funcs[arg]; ok && funcs {
 				delete(r.Funcs, arg)
+				delete(r.tracedFuncs, arg)
+				delete(r.funcSources, arg)
+				delete(r.funcCovers, arg)
 			}
 		}
+		return exit
 	case "echo":
 		newline, doExpand := true, false
 	echoOpts:
@@ -143,24 +160,130 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if newline {
 			r.out("\n")
 		}
+	case "print":
+		// mksh's print, which like "echo -e" expands escapes by default
+		newline, doExpand := true, true
+		w := r.stdout
+	printOpts:
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			opt := args[0]
+			args = args[1:]
+			if opt == "--" || opt == "-" {
+				break
+			}
+			for i, c := range opt[1:] {
+				switch c {
+				case 'n':
+					newline = false
+				case 'r':
+					doExpand = false
+				case 'R':
+					// BSD echo; only -n is an option after it
+					doExpand = false
+					if len(args) > 0 && args[0] == "-n" {
+						newline = false
+						args = args[1:]
+					}
+					break printOpts
+				case 'e':
+					doExpand = true
+				case 'p':
+					if r.coproc == nil {
+						r.errf("print: -p: no coprocess\n")
+						return 1
+					}
+					w = r.coproc.in
+				case 'u':
+					fd := opt[2+i:]
+					if fd == "" && len(args) > 0 {
+						fd, args = args[0], args[1:]
+					}
+					if w = r.fdWriter(atoi(fd)); w == nil {
+						r.errf("print: -u%s: bad file descriptor\n", fd)
+						return 1
+					}
+					continue printOpts
+				case 's':
+					// no history to add to
+				default:
+					r.errf("print: -%c: unknown option\n", c)
+					return 1
+				}
+			}
+		}
+		var buf strings.Builder
+		for i, arg := range args {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			if doExpand {
+				arg, _, _ = expand.Format(r.ecfg, arg, nil)
+			}
+			buf.WriteString(arg)
+		}
+		if newline {
+			buf.WriteString("\n")
+		}
+		if _, err := io.WriteString(w, buf.String()); err != nil {
+			r.errf("print: %v\n", err)
+			return 1
+		}
 	case "printf":
+		varName := ""
+		if len(args) > 0 && args[0] == "-v" {
+			if len(args) < 2 {
+				r.errf("printf: -v: option requires an argument\n")
+				r.errf("usage: printf [-v var] format [arguments]\n")
+				return 2
+			}
+			varName, args = args[1], args[2:]
+			if _, _, ok := r.splitIndex(varName); !ok {
+				r.errf("printf: `%s': not a valid identifier\n", varName)
+				return 2
+			}
+		}
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
 		if len(args) == 0 {
 			r.errf("usage: printf format [arguments]\n")
 			return 2
 		}
 		format, args := args[0], args[1:]
+		var buf strings.Builder
+		exit := 0
 		for {
 			s, n, err := expand.Format(r.ecfg, format, args)
-			if err != nil {
+			if nerr, ok := err.(expand.InvalidNumberError); ok {
+				for _, arg := range nerr.OutOfRange {
+					r.errf("printf: warning: %s: Numerical result out of range\n", arg)
+				}
+				for _, arg := range nerr.Args {
+					r.errf("printf: %s: invalid number\n", arg)
+				}
+				if len(nerr.Args) > 0 {
+					exit = 1
+				}
+			} else if err != nil {
 				r.errf("%v\n", err)
 				return 1
 			}
-			r.out(s)
+			buf.WriteString(s)
 			args = args[n:]
 			if n == 0 || len(args) == 0 {
 				break
 			}
 		}
+		if varName == "" {
+			r.out(buf.String())
+			return exit
+		}
+		name, index, _ := r.splitIndex(varName)
+		r.setVar(name, index, expand.Variable{Kind: expand.String, Str: buf.String()})
+		if r.exit != 0 {
+			return r.exit // e.g. a readonly variable
+		}
+		return exit
 	case "break", "continue":
 		if !r.inLoop {
 			r.errf("%s is only useful in a loop", name)
@@ -198,13 +321,205 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		return r.changeDir(path)
 	case "wait":
-		if len(args) > 0 {
-			panic("wait with args not handled yet")
+		anyJob := false
+		pidVar := ""
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			switch args[0] {
+			case "-n":
+				anyJob = true
+			case "-p":
+				if len(args) < 2 {
+					r.errf("wait: -p: option requires an argument\n")
+					return 2
+				}
+				pidVar = args[1]
+				args = args[1:]
+			case "--":
+			default:
+				r.errf("wait: invalid option %q\n", args[0])
+				return 2
+			}
+			args = args[1:]
+		}
+		jobs := make([]*job, 0, len(r.jobs))
+		exit := 0
+		for _, arg := range args {
+			j, err := r.findJob(arg)
+			if r.waitableJob(j) {
+				jobs = append(jobs, j)
+				continue
+			}
+			if status, ok := r.doneJobs[atoi(arg)]; ok && !strings.HasPrefix(arg, "%") {
+				exit = status
+				continue
+			}
+			exit = 127
+			switch {
+			case err != nil:
+				r.errf("wait: %v\n", err)
+			case strings.HasPrefix(arg, "%"):
+				r.errf("wait: %s: no such job\n", arg)
+			case atoi(arg) > 0:
+				r.errf("wait: pid %s is not a child of this shell\n", arg)
+			default:
+				r.errf("wait: `%s': not a pid or valid job spec\n", arg)
+				exit = 1
+			}
+		}
+		if len(args) == 0 {
+			for _, j := range r.jobs {
+				if r.waitableJob(j) {
+					jobs = append(jobs, j)
+				}
+			}
+		}
+		if anyJob {
+			if len(jobs) == 0 {
+				return 127
+			}
+			j := r.waitAnyJob(ctx, jobs)
+			if j == nil {
+				r.setErr(ctx.Err())
+				return 1
+			}
+			jobs = []*job{j}
+		}
+		for _, j := range jobs {
+			status := r.waitJob(ctx, j)
+			if pidVar != "" {
+				r.setVarString(pidVar, strconv.Itoa(j.pid))
+			}
+			if len(args) > 0 || anyJob {
+				exit = status
+			}
+		}
+		return exit
+	case "jobs":
+		pidsOnly, withPids, runningOnly := false, false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'p':
+					pidsOnly = true
+				case 'l':
+					withPids = true
+				case 'r':
+					runningOnly = true
+				case 's', 'n':
+					// no jobs are ever stopped, and we don't
+					// keep track of notifications
+				default:
+					r.errf("jobs: -%c: invalid option\n", c)
+					return 2
+				}
+			}
+			args = args[1:]
 		}
-		err := r.bgShells.Wait()
-		if _, ok := IsExitStatus(err); err != nil && !ok {
-			r.setErr(err)
+		jobs := make([]*job, 0, len(r.jobs))
+		exit := 0
+		for _, arg := range args {
+			j, err := r.findJob(arg)
+			if j != nil {
+				jobs = append(jobs, j)
+				continue
+			}
+			if err != nil {
+				r.errf("jobs: %v\n", err)
+			}
+			r.errf("jobs: %s: no such job\n", arg)
+			exit = 1
 		}
+		if len(args) == 0 {
+			jobs = append(jobs, r.jobs...)
+		}
+		if runningOnly {
+			running := jobs[:0]
+			for _, j := range jobs {
+				if !j.finished() {
+					running = append(running, j)
+				}
+			}
+			jobs = running
+		}
+		r.printJobs(jobs, pidsOnly, withPids)
+		return exit
+	case "fg", "bg":
+		spec := "%+"
+		switch len(args) {
+		case 0:
+		case 1:
+			spec = args[0]
+		default:
+			r.errf("usage: %s [job_spec]\n", name)
+			return 2
+		}
+		j, err := r.findJob(spec)
+		if err != nil {
+			r.errf("%s: %v\n", name, err)
+		}
+		if !r.waitableJob(j) || !strings.HasPrefix(spec, "%") {
+			if spec == "%+" {
+				spec = "current"
+			}
+			r.errf("%s: %s: no such job\n", name, spec)
+			return 1
+		}
+		if name == "bg" {
+			// jobs can't be stopped, so they are always running
+			r.errf("bg: job %d already in background\n", j.id)
+			return 0
+		}
+		r.outf("%s\n", j.src)
+		return r.waitJob(ctx, j)
+	case "disown":
+		all, runningOnly := false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'a':
+					all = true
+				case 'r':
+					runningOnly = true
+				case 'h':
+					// jobs never get SIGHUP from the shell
+				default:
+					r.errf("disown: -%c: invalid option\n", c)
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		var jobs []*job
+		exit := 0
+		for _, arg := range args {
+			j, err := r.findJob(arg)
+			if j != nil {
+				jobs = append(jobs, j)
+				continue
+			}
+			if err != nil {
+				r.errf("disown: %v\n", err)
+			}
+			r.errf("disown: %s: no such job\n", arg)
+			exit = 1
+		}
+		switch {
+		case len(args) > 0:
+		case all || runningOnly:
+			jobs = append(jobs, r.jobs...)
+		default:
+			if cur, _ := r.currentJobs(); cur != nil {
+				jobs = append(jobs, cur)
+			}
+		}
+		for _, j := range jobs {
+			if !runningOnly || !j.finished() {
+				r.removeJob(j)
+			}
+		}
+		return exit
+	case "kill":
+		return r.kill(ctx, args)
 	case "builtin":
 		if len(args) < 1 {
 			break
@@ -212,6 +527,13 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if !isBuiltin(args[0]) {
 			return 1
 		}
+		args, ok := r.callHook(ctx, pos, args, CallBuiltin)
+		if !ok {
+			return r.exit
+		}
+		if !isBuiltin(args[0]) {
+			return 1
+		}
 		return r.builtinCode(ctx, pos, args[0], args[1:])
 	case "type":
 		anyNotFound := false
@@ -224,7 +546,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				r.outf("%s is a shell builtin\n", arg)
 				continue
 			}
-			if path, err := exec.LookPath(arg); err == nil {
+			if path, err := lookPath(r.fs, expandEnv{r}, arg); err == nil {
 				r.outf("%s is %s\n", arg, path)
 				continue
 			}
@@ -255,24 +577,41 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			return 1
 		}
 		defer f.Close()
+		var src []byte
+		var rd io.Reader = f
+		if r.coverage != nil {
+			// keep the source for the coverage report
+			if src, err = ioutil.ReadAll(f); err != nil {
+				r.errf("source: %v\n", err)
+				return 1
+			}
+			rd = bytes.NewReader(src)
+		}
 		p := syntax.NewParser()
-		file, err := p.Parse(f, args[0])
+		file, err := p.Parse(rd, args[0])
 		if err != nil {
 			r.errf("source: %v\n", err)
 			return 1
 		}
+		var cover *coverAST
+		if r.coverage != nil {
+			cover = r.coverage.addFile(file, src)
+		}
 		oldParams := r.Params
 		r.Params = args[1:]
 		oldInSource := r.inSource
 		r.inSource = true
+		r.pushFrame("source", args[0], pos.Line(), cover)
 		r.stmts(ctx, file.Stmts)
-
-		r.Params = oldParams
-		r.inSource = oldInSource
 		if code, ok := r.err.(returnStatus); ok {
 			r.err = nil
-			return int(code)
+			r.exit = int(code)
 		}
+		r.trap(ctx, "RETURN")
+		r.popFrame()
+
+		r.Params = oldParams
+		r.inSource = oldInSource
 		return r.exit
 	case "[":
 		if len(args) == 0 || args[len(args)-1] != "]" {
@@ -305,6 +644,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.keepRedirs = true
 			break
 		}
+		args, ok := r.callHook(ctx, pos, args, CallExternal)
+		if !ok {
+			return r.exit
+		}
 		r.exec(ctx, args)
 		r.exitShell = true
 		return r.exit
@@ -324,6 +667,14 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			break
 		}
 		if !show {
+			kind := CallExternal
+			if isBuiltin(args[0]) {
+				kind = CallBuiltin
+			}
+			args, ok := r.callHook(ctx, pos, args, kind)
+			if !ok {
+				return r.exit
+			}
 			if isBuiltin(args[0]) {
 				return r.builtinCode(ctx, pos, args[0], args[1:])
 			}
@@ -335,7 +686,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			last = 0
 			if r.Funcs[arg] != nil || isBuiltin(arg) {
 				r.outf("%s\n", arg)
-			} else if path, err := exec.LookPath(arg); err == nil {
+			} else if path, err := lookPath(r.fs, expandEnv{r}, arg); err == nil {
 				r.outf("%s\n", path)
 			} else {
 				last = 1
@@ -435,43 +786,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		r.setErr(returnStatus(code))
 	case "read":
-		raw := false
-		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
-			switch args[0] {
-			case "-r":
-				raw = true
-			default:
-				r.errf("read: invalid option %q\n", args[0])
-				return 2
-			}
-			args = args[1:]
-		}
-
-		for _, name := range args {
-			if !syntax.ValidName(name) {
-				r.errf("read: invalid identifier %q\n", name)
-				return 2
-			}
-		}
-
-		line, err := r.readLine(raw)
-		if err != nil {
-			return 1
-		}
-		if len(args) == 0 {
-			args = append(args, "REPLY")
-		}
-
-		values := expand.ReadFields(r.ecfg, string(line), len(args), raw)
-		for i, name := range args {
-			val := ""
-			if i < len(values) {
-				val = values[i]
-			}
-			r.setVar(name, nil, expand.Variable{Kind: expand.String, Str: val})
-		}
-
-		return 0
+		return r.readCmd(ctx, args)
+	case "mapfile", "readarray":
+		return r.mapfile(ctx, name, args)
 
 	case "getopts":
 		if len(args) < 2 {
@@ -519,33 +836,65 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 
 	case "shopt":
 		mode := ""
-		posixOpts := false
+		posixOpts, reusable, quiet := false, false, false
 		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
-			switch args[0] {
-			case "-s", "-u":
-				mode = args[0]
-			case "-o":
-				posixOpts = true
-			case "-p", "-q":
-				panic(fmt.Sprintf("unhandled shopt flag: %s", args[0]))
-			default:
-				r.errf("shopt: invalid option %q\n", args[0])
-				return 2
+			for _, c := range args[0][1:] {
+				switch c {
+				case 's', 'u':
+					mode = "-" + string(c)
+				case 'o':
+					posixOpts = true
+				case 'p':
+					reusable = true
+				case 'q':
+					quiet = true
+				default:
+					r.errf("shopt: invalid option %q\n", args[0])
+					return 2
+				}
 			}
 			args = args[1:]
 		}
+		show := func(name string, enabled bool) {
+			switch {
+			case quiet:
+			case reusable && posixOpts:
+				flag := "+o"
+				if enabled {
+					flag = "-o"
+				}
+				r.outf("set %s %s\n", flag, name)
+			case reusable:
+				flag := "-u"
+				if enabled {
+					flag = "-s"
+				}
+				r.outf("shopt %s %s\n", flag, name)
+			default:
+				r.printOptLine(name, enabled)
+			}
+		}
 		if len(args) == 0 {
+			// with -s or -u, only list the options set or unset
+			listed := func(enabled bool) bool {
+				return mode == "" || enabled == (mode == "-s")
+			}
 			if !posixOpts {
 				for i, name := range bashOptsTable {
-					r.printOptLine(name, r.opts[len(shellOptsTable)+i])
+					if enabled := r.opts[len(shellOptsTable)+i]; listed(enabled) {
+						show(name, enabled)
+					}
 				}
 				break
 			}
 			for i, opt := range &shellOptsTable {
-				r.printOptLine(opt.name, r.opts[i])
+				if enabled := r.opts[i]; listed(enabled) {
+					show(opt.name, enabled)
+				}
 			}
 			break
 		}
+		exit := 0
 		for _, arg := range args {
 			opt := r.optByName(arg, !posixOpts)
 			if opt == nil {
@@ -556,10 +905,14 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			case "-s", "-u":
 				*opt = mode == "-s"
 			default: // ""
-				r.printOptLine(arg, *opt)
+				show(arg, *opt)
+				if !*opt {
+					exit = 1
+				}
 			}
 		}
 		r.updateExpandOpts()
+		return exit
 
 	case "alias":
 		show := func(name string, als alias) {
@@ -619,9 +972,76 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			delete(r.alias, name)
 		}
 
+	case "trap":
+		print := false
+	trapOpts:
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+			switch args[0] {
+			case "-p":
+				print = true
+			case "-l":
+				r.printSignals()
+				return 0
+			case "--":
+				args = args[1:]
+				break trapOpts
+			default:
+				r.errf("trap: invalid option %q\n", args[0])
+				return 2
+			}
+			args = args[1:]
+		}
+		if print || len(args) == 0 {
+			for i, arg := range args {
+				name := trapName(arg)
+				if name == "" {
+					r.errf("trap: %s: invalid signal specification\n", arg)
+					return 1
+				}
+				args[i] = name
+			}
+			r.printTraps(args)
+			break
+		}
+		handler, specs := args[0], args[1:]
+		if _, err := strconv.Atoi(handler); err == nil || len(args) == 1 {
+			// "trap INT" or "trap 2 15" reset the signals.
+			handler, specs = "-", args
+		}
+		var t *trap
+		if handler != "-" {
+			t = &trap{src: handler}
+			file, err := syntax.NewParser().Parse(strings.NewReader(handler), "")
+			if err != nil {
+				r.errf("trap: %v\n", err)
+				return 1
+			}
+			t.stmts = file.Stmts
+		}
+		code := 0
+		for _, spec := range specs {
+			name := trapName(spec)
+			if name == "" {
+				r.errf("trap: %s: invalid signal specification\n", spec)
+				code = 1
+				continue
+			}
+			r.setTrap(name, t)
+		}
+		return code
+	case "umask":
+		return r.umaskCmd(args)
+	case "caller":
+		return r.callerCmd(args)
+	case "times":
+		// see ReportUsage for why the shell's own time isn't measured
+		r.outf("%s %s\n", timeString(0, 3, true), timeString(0, 3, true))
+		user, sys := r.usage.get()
+		r.outf("%s %s\n", timeString(user, 3, true), timeString(sys, 3, true))
+
 	default:
-		// "trap", "umask", "fg", "bg",
-		panic(fmt.Sprintf("unhandled builtin: %s", name))
+		r.unsupported(pos, "builtin %s", name)
+		return 2
 	}
 	return 0
 }
@@ -631,40 +1051,16 @@ func (r *Runner) printOptLine(name string, enabled bool) {
 	if enabled {
 		status = "on"
 	}
-	r.outf("%s\t%s\n", name, status)
+	r.outf("%-15s\t%s\n", name, status)
 }
 
-func (r *Runner) readLine(raw bool) ([]byte, error) {
-	var line []byte
-	esc := false
-
-	for {
-		var buf [1]byte
-		n, err := r.stdin.Read(buf[:])
-		if n > 0 {
-			b := buf[0]
-			switch {
-			case !raw && b == '\\':
-				line = append(line, b)
-				esc = !esc
-			case !raw && b == '\n' && esc:
-				// line continuation
-				line = line[len(line)-1:]
-				esc = false
-			case b == '\n':
-				return line, nil
-			default:
-				line = append(line, b)
-				esc = false
-			}
-		}
-		if err == io.EOF && len(line) > 0 {
-			return line, nil
-		}
-		if err != nil {
-			return nil, err
-		}
+// singleQuote quotes a string like syntax.Quote, but always quoting it, like
+// Bash does when printing traps.
+func singleQuote(s string) string {
+	if q := syntax.Quote(s); q != s {
+		return q
 	}
+	return "'" + s + "'"
 }
 
 func (r *Runner) changeDir(path string) int {
@@ -719,6 +1115,13 @@ func (g *getopts) Next(optstr string, args []string) (opt rune, optarg string, d
 	}
 
 	if i+1 < len(optstr) && optstr[i+1] == ':' {
+		if g.runeidx > 0 {
+			// the argument is attached, like "-ofile"
+			optarg = string(opts[g.runeidx:])
+			g.argidx++
+			g.runeidx = 0
+			return opt, optarg, false
+		}
 		if g.argidx >= len(args) {
 			// missing argument
 			return ':', string(opt), false
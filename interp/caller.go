@@ -0,0 +1,118 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// callFrame is an entry in the stack of function calls and sourced files.
+type callFrame struct {
+	funcName string    // "source" for sourced files
+	source   string    // the file the function was defined in, or the sourced file
+	line     uint      // the line the call was made from, in the caller's source
+	cover    *coverAST // the coverage of source, if any
+}
+
+// pushFrame adds an entry to the call stack. It must be followed by a call to
+// popFrame once the function or sourced file is done.
+func (r *Runner) pushFrame(funcName, source string, line uint, cover *coverAST) {
+	r.callStack = append(r.callStack, callFrame{
+		funcName: funcName,
+		source:   source,
+		line:     line,
+		cover:    cover,
+	})
+}
+
+func (r *Runner) popFrame() {
+	r.callStack = r.callStack[:len(r.callStack)-1]
+}
+
+// curSource returns the name of the file being run, which is the main file
+// unless a function or sourced file is being run.
+func (r *Runner) curSource() string {
+	if n := len(r.callStack); n > 0 {
+		return r.callStack[n-1].source
+	}
+	return r.filename
+}
+
+// stackVar returns the elements of FUNCNAME, BASH_SOURCE or BASH_LINENO, from
+// the innermost call to the main file. Like in Bash, FUNCNAME is only set
+// while running a function.
+func (r *Runner) stackVar(name string) []string {
+	if name == "FUNCNAME" && !r.inFunc {
+		return nil
+	}
+	if len(r.callStack) == 0 && r.filename == "" {
+		return nil
+	}
+	list := make([]string, 0, len(r.callStack)+1)
+	for i := len(r.callStack) - 1; i >= 0; i-- {
+		frame := r.callStack[i]
+		switch name {
+		case "FUNCNAME":
+			list = append(list, frame.funcName)
+		case "BASH_SOURCE":
+			list = append(list, frame.source)
+		case "BASH_LINENO":
+			list = append(list, strconv.FormatUint(uint64(frame.line), 10))
+		}
+	}
+	switch name {
+	case "FUNCNAME":
+		list = append(list, "main")
+	case "BASH_SOURCE":
+		list = append(list, r.filename)
+	case "BASH_LINENO":
+		list = append(list, "0")
+	}
+	return list
+}
+
+// callerCmd implements the caller builtin.
+func (r *Runner) callerCmd(args []string) int {
+	usage := func() int {
+		r.errf("caller: usage: caller [expr]\n")
+		return 2
+	}
+	switch {
+	case len(args) > 1:
+		return usage()
+	case len(args) == 1 && strings.HasPrefix(args[0], "-"):
+		r.errf("caller: %s: invalid option\n", args[0])
+		return usage()
+	}
+	n := len(r.callStack)
+	if len(args) == 0 {
+		if n == 0 {
+			return 1
+		}
+		frame := r.callStack[n-1]
+		source := r.filename
+		if n > 1 {
+			source = r.callStack[n-2].source
+		}
+		r.outf("%d %s\n", frame.line, source)
+		return 0
+	}
+	depth, err := strconv.Atoi(args[0])
+	if err != nil {
+		r.errf("caller: %s: invalid number\n", args[0])
+		return usage()
+	}
+	if depth >= n {
+		return 1
+	}
+	// the frame for the call which is depth levels up, and its caller
+	frame := r.callStack[n-1-depth]
+	funcName, source := "main", r.filename
+	if i := n - 2 - depth; i >= 0 {
+		funcName, source = r.callStack[i].funcName, r.callStack[i].source
+	}
+	r.outf("%d %s %s\n", frame.line, funcName, source)
+	return 0
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// coproc holds the shell's ends of the pipes to a coprocess.
+type coproc struct {
+	name string // the array variable for Bash; empty for mksh
+
+	in  *os.File // written to by the shell, read by the coprocess
+	out *os.File // written to by the coprocess, read by the shell
+
+	// inFd and outFd are the file descriptor numbers for Bash, as found
+	// in the array variable.
+	inFd, outFd int
+}
+
+// startCoproc runs a statement in the background as a coprocess, wiring its
+// standard input and output to pipes. With a name, it's a Bash coprocess, and
+// the pipes are available via file descriptors listed in the name array
+// variable. Otherwise, it's an mksh coprocess, used via "read -p", "print -p",
+// ">&p" and "<&p".
+func (r *Runner) startCoproc(ctx context.Context, name string, st *syntax.Stmt) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		r.errf("coproc: %v\n", err)
+		r.exit = 1
+		return
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		r.errf("coproc: %v\n", err)
+		r.exit = 1
+		return
+	}
+	r2 := r.sub()
+	r2.stdin = inR
+	r2.stdout = outW
+
+	var buf strings.Builder
+	if name != "" {
+		buf.WriteString("coproc " + name + " ")
+	}
+	syntax.NewPrinter().Print(&buf, st)
+	j := r.runJob(ctx, r2, st, buf.String(), inR, outW)
+
+	cp := &coproc{name: name, in: inW, out: outR}
+	if name == "" {
+		// a new mksh coprocess replaces the previous one
+		if r.coproc != nil {
+			r.closeCoproc(r.coproc)
+		}
+		r.coproc = cp
+		r.exit = 0
+		return
+	}
+	j.coproc = cp
+	cp.outFd = r.newFd(fdFile{r: outR, c: outR})
+	cp.inFd = r.newFd(fdFile{w: inW, c: inW})
+	r.setVar(name, nil, expand.Variable{
+		Kind: expand.Indexed,
+		List: []string{strconv.Itoa(cp.outFd), strconv.Itoa(cp.inFd)},
+	})
+	r.setVarString(name+"_PID", strconv.Itoa(j.pid))
+	r.exit = 0
+}
+
+// closeCoproc closes the shell's ends of the pipes to a coprocess, and removes
+// its variables and file descriptors.
+func (r *Runner) closeCoproc(cp *coproc) {
+	cp.in.Close()
+	cp.out.Close()
+	if cp == r.coproc {
+		r.coproc = nil
+	}
+	if cp.name == "" {
+		return
+	}
+	for _, fd := range [...]int{cp.inFd, cp.outFd} {
+		if f, ok := r.fds[fd]; ok && (f.c == cp.in || f.c == cp.out) {
+			r.closeFd(fd)
+		}
+	}
+	r.delVar(cp.name)
+	r.delVar(cp.name + "_PID")
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"sync"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Coverage records which statements a Runner runs, and which branches it takes
+// in if and case clauses and in && and || lists. It is set up via the Cover
+// option, and can then write reports in a number of formats.
+//
+// Only programs run as a *syntax.File and the files they source are covered,
+// keyed by their file names. Programs without a file name are not covered, nor
+// is code run from strings such as via eval or trap. Statements which never run
+// are reported too. A Coverage is safe for concurrent use, and may be shared by
+// many Runners to merge their results.
+type Coverage struct {
+	mu     sync.Mutex
+	files  []*coverFile // in the order they were first run
+	byName map[string]*coverFile
+}
+
+type coverFile struct {
+	name     string
+	src      []byte // nil if it couldn't be read
+	stmts    []*coverStmt
+	branches []*coverBranch
+}
+
+// coverAST holds the counts for the nodes of a parsed file. Each run of a file
+// gets its own, which a Runner keeps for as long as its statements may run,
+// such as in the functions it defines. This way, sourcing a file many times
+// doesn't keep each of its syntax trees around.
+type coverAST struct {
+	c        *Coverage
+	stmts    map[*syntax.Stmt]*coverStmt
+	branches map[syntax.Node]*coverBranch
+}
+
+type coverStmt struct {
+	start, end syntax.Pos
+	count      uint64
+}
+
+// coverBranch counts how many times each arm of a branch was taken. An if or
+// elif has two arms, for its "then" and for the rest. A case clause has an arm
+// per item, plus one for no match. && and || lists have two arms, for when the
+// second statement runs and for when it doesn't.
+type coverBranch struct {
+	pos    syntax.Pos
+	counts []uint64
+}
+
+// NewCoverage creates an empty Coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{byName: make(map[string]*coverFile)}
+}
+
+// Cover sets the coverage collector used by a Runner. See Coverage for more
+// info.
+func Cover(c *Coverage) RunnerOption {
+	return func(r *Runner) error {
+		r.coverage = c
+		return nil
+	}
+}
+
+// addFile starts covering a file which is about to run, and returns nil if it
+// can't be covered. src is its source code, if known. Running a file with the
+// same name again, such as when sourcing it twice, adds to the existing counts.
+func (c *Coverage) addFile(file *syntax.File, src []byte) *coverAST {
+	if file.Name == "" {
+		return nil
+	}
+	var stmts []*syntax.Stmt
+	var branches []syntax.Node
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.Stmt:
+			stmts = append(stmts, x)
+		case *syntax.IfClause:
+			if x.ThenPos.IsValid() { // not an "else"
+				branches = append(branches, x)
+			}
+		case *syntax.CaseClause:
+			branches = append(branches, x)
+		case *syntax.BinaryCmd:
+			if x.Op == syntax.AndStmt || x.Op == syntax.OrStmt {
+				branches = append(branches, x)
+			}
+		}
+		return true
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf := c.byName[file.Name]
+	if cf != nil && (len(cf.stmts) != len(stmts) || len(cf.branches) != len(branches)) {
+		// The file changed since it last ran; start over.
+		cf.stmts, cf.branches = nil, nil
+	}
+	if cf == nil {
+		cf = &coverFile{name: file.Name}
+		c.byName[file.Name] = cf
+		c.files = append(c.files, cf)
+	}
+	if src != nil {
+		cf.src = src
+	}
+	ca := &coverAST{
+		c:        c,
+		stmts:    make(map[*syntax.Stmt]*coverStmt, len(stmts)),
+		branches: make(map[syntax.Node]*coverBranch, len(branches)),
+	}
+	fresh := cf.stmts == nil && cf.branches == nil
+	for i, st := range stmts {
+		if fresh {
+			cf.stmts = append(cf.stmts, &coverStmt{start: st.Pos(), end: st.End()})
+		}
+		ca.stmts[st] = cf.stmts[i]
+	}
+	for i, node := range branches {
+		if fresh {
+			arms := 2
+			if cc, ok := node.(*syntax.CaseClause); ok {
+				arms = len(cc.Items) + 1
+			}
+			cf.branches = append(cf.branches, &coverBranch{
+				pos:    node.Pos(),
+				counts: make([]uint64, arms),
+			})
+		}
+		ca.branches[node] = cf.branches[i]
+	}
+	return ca
+}
+
+// stmt records that a statement ran, if it's part of the file.
+func (ca *coverAST) stmt(st *syntax.Stmt) {
+	if cs := ca.stmts[st]; cs != nil {
+		ca.c.mu.Lock()
+		cs.count++
+		ca.c.mu.Unlock()
+	}
+}
+
+// branch records that an arm of a branch was taken, if it's part of the file.
+func (ca *coverAST) branch(node syntax.Node, arm int) {
+	if cb := ca.branches[node]; cb != nil {
+		ca.c.mu.Lock()
+		cb.counts[arm]++
+		ca.c.mu.Unlock()
+	}
+}
+
+// curCover returns the coverage of the file being run, like curSource. It is
+// nil if the file isn't covered.
+func (r *Runner) curCover() *coverAST {
+	if n := len(r.callStack); n > 0 {
+		return r.callStack[n-1].cover
+	}
+	return r.mainCover
+}
+
+// coverStmt is a shorthand to record a statement if it's part of a covered
+// file.
+func (r *Runner) coverStmt(st *syntax.Stmt) {
+	if ca := r.curCover(); ca != nil {
+		ca.stmt(st)
+	}
+}
+
+// coverBranch is a shorthand to record a branch if it's part of a covered file
+// and the program is still running.
+func (r *Runner) coverBranch(ctx context.Context, node syntax.Node, arm int) {
+	if ca := r.curCover(); ca != nil && !r.stop(ctx) {
+		ca.branch(node, arm)
+	}
+}
+
+// coverLine is the coverage of a single line in a file, counting the
+// statements starting on it.
+type coverLine struct {
+	line  uint
+	count uint64 // the highest count of its statements
+}
+
+// lines returns the lines with statements in a file, in order. The mutex must
+// be held.
+func (cf *coverFile) lines() []coverLine {
+	var lines []coverLine
+	byLine := make(map[uint]int)
+	for _, cs := range cf.stmts {
+		line := cs.start.Line()
+		i, ok := byLine[line]
+		if !ok {
+			byLine[line] = len(lines)
+			lines = append(lines, coverLine{line: line, count: cs.count})
+		} else if cs.count > lines[i].count {
+			lines[i].count = cs.count
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].line < lines[j].line })
+	return lines
+}
+
+// Percent returns the percentage of statements which ran at least once, or 0
+// if there are none.
+func (c *Coverage) Percent() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total, hit := 0, 0
+	for _, cf := range c.files {
+		for _, cs := range cf.stmts {
+			total++
+			if cs.count > 0 {
+				hit++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(hit) / float64(total)
+}
+
+// WriteLCOV writes a report in the LCOV tracefile format, as understood by
+// tools like genhtml. Like with gcov, a line's count is the highest count of
+// the statements starting on it, so that a line like "case $x in a) f;; esac"
+// is hit even if some of its statements didn't run.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, cf := range c.files {
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", cf.name)
+		brFound, brHit := 0, 0
+		for i, cb := range cf.branches {
+			total := uint64(0)
+			for _, n := range cb.counts {
+				total += n
+			}
+			for arm, n := range cb.counts {
+				taken := "-" // the branch itself never ran
+				if total > 0 {
+					taken = fmt.Sprint(n)
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,%d,%s\n", cb.pos.Line(), i, arm, taken)
+				brFound++
+				if n > 0 {
+					brHit++
+				}
+			}
+		}
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", brFound, brHit)
+		lines := cf.lines()
+		linesHit := 0
+		for _, cl := range lines {
+			fmt.Fprintf(bw, "DA:%d,%d\n", cl.line, cl.count)
+			if cl.count > 0 {
+				linesHit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), linesHit)
+	}
+	return bw.Flush()
+}
+
+// WriteProfile writes a report in the format of Go's cover profiles with the
+// "count" mode, as understood by "go tool cover" and many coverage services.
+// Each statement is a block, so blocks for compound commands like if clauses
+// contain the blocks for their inner statements.
+func (c *Coverage) WriteProfile(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: count\n")
+	for _, cf := range c.files {
+		stmts := append([]*coverStmt(nil), cf.stmts...)
+		sort.SliceStable(stmts, func(i, j int) bool {
+			return stmts[i].start.Offset() < stmts[j].start.Offset()
+		})
+		for _, cs := range stmts {
+			fmt.Fprintf(bw, "%s:%d.%d,%d.%d 1 %d\n", cf.name,
+				cs.start.Line(), cs.start.Col(), cs.end.Line(), cs.end.Col(), cs.count)
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteHTML writes an HTML page showing the source code of each covered file,
+// with the lines which ran highlighted in green and those which didn't in red.
+//
+// The source of each file is kept as it starts running, opening it via the
+// Runner's OpenHandler. Files whose source couldn't be read are omitted.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	type htmlLine struct {
+		Num   int
+		Class string
+		Count string
+		Text  string
+	}
+	type htmlFile struct {
+		Name    string
+		Percent string
+		Lines   []htmlLine
+	}
+	var files []htmlFile
+	for _, cf := range c.files {
+		src := cf.src
+		if src == nil {
+			continue
+		}
+		byLine := make(map[int]uint64)
+		for _, cl := range cf.lines() {
+			byLine[int(cl.line)] = cl.count
+		}
+		hit := 0
+		for _, cs := range cf.stmts {
+			if cs.count > 0 {
+				hit++
+			}
+		}
+		hf := htmlFile{Name: cf.name, Percent: "0.0"}
+		if len(cf.stmts) > 0 {
+			hf.Percent = fmt.Sprintf("%.1f", 100*float64(hit)/float64(len(cf.stmts)))
+		}
+		for i, text := range bytes.Split(bytes.TrimSuffix(src, []byte("\n")), []byte("\n")) {
+			hl := htmlLine{Num: i + 1, Text: string(text)}
+			if count, ok := byLine[hl.Num]; ok {
+				hl.Count = fmt.Sprint(count)
+				hl.Class = "cov"
+				if count == 0 {
+					hl.Class = "nocov"
+				}
+			}
+			hf.Lines = append(hf.Lines, hl)
+		}
+		files = append(files, hf)
+	}
+	return htmlTemplate.Execute(w, files)
+}
+
+var htmlTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>shell coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); font-family: monospace; }
+select { margin: 1em 0; }
+pre { margin: 0; }
+.num, .count { display: inline-block; text-align: right; padding-right: 1em; }
+.num { width: 4em; }
+.count { width: 5em; }
+.cov { color: rgb(44, 212, 149); }
+.nocov { color: rgb(192, 0, 0); }
+</style>
+</head>
+<body>
+<select id="files" onchange="show(this.value)">
+{{- range $i, $f := .}}
+<option value="file{{$i}}">{{$f.Name}} ({{$f.Percent}}%)</option>
+{{- end}}
+</select>
+{{- range $i, $f := .}}
+<pre id="file{{$i}}" style="display: none">
+{{- range $f.Lines}}
+<span{{with .Class}} class="{{.}}"{{end}}><span class="num">{{.Num}}</span><span class="count">{{.Count}}</span>{{.Text}}</span>
+{{- end}}
+</pre>
+{{- end}}
+<script>
+var current;
+function show(id) {
+	if (current) current.style.display = "none";
+	current = document.getElementById(id);
+	if (current) current.style.display = "block";
+}
+show("file0");
+</script>
+</body>
+</html>
+`))
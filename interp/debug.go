@@ -0,0 +1,256 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// DebugAction tells a Debugger how to continue after stopping.
+type DebugAction uint8
+
+const (
+	DebugStep     DebugAction = iota // stop at the next statement
+	DebugNext                        // like DebugStep, but step over function calls
+	DebugFinish                      // stop once the current function returns
+	DebugContinue                    // stop at the next breakpoint
+	DebugQuit                        // stop running the program, with exit status 1
+)
+
+// Breakpoint is a place where a Debugger stops. Either Func is set to stop when
+// calling a function, or Line is set to stop at statements starting on that
+// line. Filename may be empty to match any file, and otherwise it can be just
+// the base name of a file.
+type Breakpoint struct {
+	Filename string
+	Line     uint
+	Func     string
+}
+
+func (bp Breakpoint) matchesFile(name string) bool {
+	return bp.Filename == "" || bp.Filename == name ||
+		(!strings.ContainsRune(bp.Filename, filepath.Separator) &&
+			bp.Filename == filepath.Base(name))
+}
+
+// DebugHandlerFunc is called when a Debugger stops before running a statement.
+// The returned action decides when to stop next.
+type DebugHandlerFunc func(stop *DebugStop) DebugAction
+
+// Debugger can stop a Runner before running statements, like a debugger for
+// compiled programs. It is set up via the Debug option.
+//
+// It starts by stepping, so the handler is called at the first statement. A
+// Debugger is safe for concurrent use, and statements run in the background
+// may stop too. The action returned by the handler only applies to the Runner
+// which stopped, and to the subshells it starts afterwards, except for
+// DebugQuit which stops all of them.
+type Debugger struct {
+	handler DebugHandlerFunc
+
+	mu          sync.Mutex
+	breakpoints []Breakpoint
+	quit        bool
+}
+
+// NewDebugger creates a Debugger which calls handler each time it stops.
+func NewDebugger(handler DebugHandlerFunc) *Debugger {
+	return &Debugger{handler: handler}
+}
+
+// Debug sets the debugger used by a Runner. See Debugger for more info.
+func Debug(d *Debugger) RunnerOption {
+	return func(r *Runner) error {
+		r.debugger = d
+		return nil
+	}
+}
+
+// AddBreakpoint adds a breakpoint, if it wasn't added before.
+func (d *Debugger) AddBreakpoint(bp Breakpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp2 := range d.breakpoints {
+		if bp2 == bp {
+			return
+		}
+	}
+	d.breakpoints = append(d.breakpoints, bp)
+}
+
+// RemoveBreakpoint removes a breakpoint, and reports whether it was found.
+func (d *Debugger) RemoveBreakpoint(bp Breakpoint) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, bp2 := range d.breakpoints {
+		if bp2 == bp {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Breakpoints returns the current breakpoints, in the order they were added.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Breakpoint(nil), d.breakpoints...)
+}
+
+// enterFunc is called when a Runner calls a function, so that it stops at its
+// first statement if there is a breakpoint for it.
+func (d *Debugger) enterFunc(r *Runner, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.Func == name {
+			r.debugFunc = name
+			return
+		}
+	}
+}
+
+// shouldStop reports whether to stop at a statement, and why.
+func (d *Debugger) shouldStop(r *Runner, st *syntax.Stmt) (string, bool) {
+	if name := r.debugFunc; name != "" {
+		r.debugFunc = ""
+		return "function " + name, true
+	}
+	depth := len(r.callStack)
+	switch r.debugAction {
+	case DebugStep:
+		return "step", true
+	case DebugNext:
+		if depth <= r.debugDepth {
+			return "step", true
+		}
+	case DebugFinish:
+		if depth < r.debugDepth {
+			return "step", true
+		}
+	}
+	line := st.Pos().Line()
+	source := r.curSource()
+	for _, bp := range d.breakpoints {
+		if bp.Func == "" && bp.Line == line && bp.matchesFile(source) {
+			return "breakpoint", true
+		}
+	}
+	return "", false
+}
+
+// debugStmt is called before running each statement, and returns false if the
+// program should stop running.
+func (r *Runner) debugStmt(st *syntax.Stmt) bool {
+	d := r.debugger
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.quit {
+		return false
+	}
+	if r.debugStopped {
+		return true
+	}
+	reason, ok := d.shouldStop(r, st)
+	if !ok {
+		return true
+	}
+	stop := &DebugStop{
+		Stmt:     st,
+		Filename: r.curSource(),
+		Reason:   reason,
+		runner:   r,
+	}
+	// The handler may use the debugger's methods, such as to add
+	// breakpoints.
+	r.debugStopped = true
+	d.mu.Unlock()
+	action := d.handler(stop)
+	d.mu.Lock()
+	r.debugStopped = false
+	if action == DebugQuit {
+		d.quit = true
+		return false
+	}
+	r.debugAction = action
+	r.debugDepth = len(r.callStack)
+	return true
+}
+
+// DebugStop describes where a Debugger stopped, and allows inspecting the state
+// of the program. It is only valid until its DebugHandlerFunc returns.
+type DebugStop struct {
+	// Stmt is the statement about to run, and Filename the name of the file
+	// it is in.
+	Stmt     *syntax.Stmt
+	Filename string
+
+	// Reason describes why the debugger stopped, such as "breakpoint",
+	// "step", or "function name".
+	Reason string
+
+	runner *Runner
+}
+
+// DebugFrame is an entry in the call stack, as returned by DebugStop.Stack.
+type DebugFrame struct {
+	// Func is the name of the function being run, "source" for sourced
+	// files, or "main" for the main program.
+	Func string
+
+	// Filename and Line give the position of the current statement in the
+	// frame.
+	Filename string
+	Line     uint
+}
+
+// Stack returns the call stack, starting with the innermost frame.
+func (s *DebugStop) Stack() []DebugFrame {
+	r := s.runner
+	line := s.Stmt.Pos().Line()
+	var frames []DebugFrame
+	for i := len(r.callStack) - 1; i >= 0; i-- {
+		frame := r.callStack[i]
+		frames = append(frames, DebugFrame{
+			Func:     frame.funcName,
+			Filename: frame.source,
+			Line:     line,
+		})
+		line = frame.line
+	}
+	return append(frames, DebugFrame{Func: "main", Filename: r.filename, Line: line})
+}
+
+// Var returns a variable as seen by the program.
+func (s *DebugStop) Var(name string) expand.Variable {
+	return s.runner.lookupVar(name)
+}
+
+// Expand expands a string like the body of a here-document, so that it may
+// contain parameter expansions like "$foo" or "${list[@]}". Note that command
+// substitutions are run as part of the program.
+func (s *DebugStop) Expand(src string) (string, error) {
+	word, err := syntax.NewParser().Document(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	r := s.runner
+	oldOpts := r.opts
+	r.opts[optNoUnset] = false
+	defer func() { r.opts = oldOpts }()
+	return expand.Document(r.ecfg, word)
+}
+
+// Source returns the statement about to run, formatted via syntax.Printer.
+func (s *DebugStop) Source() string {
+	var b strings.Builder
+	syntax.NewPrinter().Print(&b, s.Stmt)
+	return strings.TrimSuffix(b.String(), "\n")
+}
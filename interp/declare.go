@@ -0,0 +1,400 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// declClause runs one of the declaration builtins, such as declare, local,
+// export and readonly. Besides assigning values, they can set and clear
+// variable attributes, and print variables and functions.
+func (r *Runner) declClause(x *syntax.DeclClause) {
+	variant := x.Variant.Value
+	local, global := false, false
+	// set and clear hold attribute letters, like "x" for "-x" and "+x"
+	set, clear := "", ""
+	valType := ""
+	print, funcs, funcNames := false, false, false
+	noArray := false // "+a" and "+A", which can't turn arrays into strings
+	validOpts := "aAfFgilnprtux"
+	switch variant {
+	case "declare", "typeset":
+		// When used in a function, "declare" acts as "local"
+		// unless the "-g" option is used.
+		local = r.inFunc
+	case "local":
+		if !r.inFunc {
+			r.errf("local: can only be used in a function\n")
+			r.exit = 1
+			return
+		}
+		local = true
+	case "export":
+		set = "x"
+		validOpts = "fnp"
+	case "readonly":
+		set = "r"
+		validOpts = "aAfp"
+	case "nameref":
+		valType = "-n"
+	}
+	var traced []string
+	if r.tracing() {
+		traced = append(traced, variant)
+		defer func() { r.trace(strings.Join(traced, " ")) }()
+	}
+	r.exit = 0
+	var names []*syntax.Assign
+	for _, as := range x.Args {
+		for _, as := range r.flattenAssign(as) {
+			name := as.Name.Value
+			if as.Naked && len(name) > 1 && (name[0] == '-' || name[0] == '+') {
+				if traced != nil {
+					traced = append(traced, name)
+				}
+				for _, c := range name[1:] {
+					if !strings.ContainsRune(validOpts, c) {
+						r.errf("%s: invalid option %q\n", variant, name)
+						r.exit = 2
+						return
+					}
+					if name[0] == '+' {
+						switch c {
+						case 'i', 'l', 'r', 't', 'u', 'x':
+							clear += string(c)
+							set = strings.Replace(set, string(c), "", -1)
+						case 'a', 'A':
+							noArray = true
+						case 'f', 'F', 'g', 'p':
+							// only meaningful with "-"
+						default:
+							r.errf("%s: invalid option %q\n", variant, name)
+							r.exit = 2
+							return
+						}
+						continue
+					}
+					switch c {
+					case 'a', 'A', 'n':
+						if variant == "export" {
+							// "export -n" removes the export attribute
+							clear += "x"
+							set = strings.Replace(set, "x", "", -1)
+							break
+						}
+						valType = "-" + string(c)
+					case 'g':
+						global = true
+					case 'p':
+						print = true
+					case 'F':
+						funcNames = true
+						fallthrough
+					case 'f':
+						funcs = true
+					default:
+						set += string(c)
+						clear = strings.Replace(clear, string(c), "", -1)
+					}
+				}
+				continue
+			}
+			names = append(names, as)
+		}
+	}
+	switch {
+	case funcs:
+		r.declFuncs(names, funcNames, set, clear)
+		return
+	case print || len(names) == 0:
+		r.printDecls(variant, names, valType, set)
+		return
+	}
+	for _, as := range names {
+		name := as.Name.Value
+		if !syntax.ValidName(name) {
+			r.errf("%s: invalid name %q\n", variant, name)
+			r.exit = 1
+			return
+		}
+		cur := r.lookupVar(name)
+		if noArray && (cur.Kind == expand.Indexed || cur.Kind == expand.Associative) {
+			r.errf("%s: %s: cannot destroy array variables in this way\n", variant, name)
+			r.exit = 1
+			continue
+		}
+		if cur.ReadOnly && strings.Contains(clear, "r") {
+			r.errf("%s: %s: readonly variable\n", variant, name)
+			r.exit = 1
+			continue
+		}
+		if clear != "" && hasAttrs(cur) {
+			// clear attributes before assigning, so that e.g. "+i"
+			// doesn't evaluate the new value
+			r.setVarInternal(name, setAttrs(cur, "", clear))
+		}
+		vr := r.assignVal(as, valType)
+		if as.Naked {
+			switch {
+			case valType == "-a" && vr.Kind == expand.String:
+				vr.Kind, vr.List, vr.Str = expand.Indexed, []string{vr.Str}, ""
+			case valType == "-a" && !vr.IsSet():
+				vr.Kind, vr.List = expand.Indexed, []string{}
+			case valType == "-A" && vr.Kind == expand.Indexed:
+				r.errf("%s: %s: cannot convert indexed to associative array\n", variant, name)
+				r.exit = 1
+				continue
+			case valType == "-A" && vr.Kind == expand.String:
+				vr.Kind, vr.Map, vr.Str = expand.Associative, map[string]string{"0": vr.Str}, ""
+			case valType == "-A" && !vr.IsSet():
+				vr.Kind, vr.Map = expand.Associative, map[string]string{}
+			case !vr.IsSet():
+				vr.Declared = true
+			}
+		}
+		if traced != nil {
+			traced = append(traced, traceAssign(as, vr))
+		}
+		if global {
+			vr.Local = false
+		} else if local {
+			vr.Local = true
+		}
+		vr = setAttrs(vr, set, clear)
+		if as.Naked {
+			// only the attributes change, which is allowed even for
+			// read-only variables
+			r.setVarInternal(name, vr)
+		} else {
+			r.setVar(name, as.Index, vr)
+		}
+	}
+}
+
+// setAttrs returns a variable with the attributes given by letters in set
+// added, and the ones in clear removed.
+func setAttrs(vr expand.Variable, set, clear string) expand.Variable {
+	for i, attrs := range [...]string{set, clear} {
+		on := i == 0
+		for _, c := range attrs {
+			switch c {
+			case 'x':
+				vr.Exported = on
+			case 'r':
+				vr.ReadOnly = on
+			case 'i':
+				vr.Integer = on
+			case 't':
+				vr.Trace = on
+			case 'l':
+				vr.Lower = on
+				if on {
+					vr.Upper = false
+				}
+			case 'u':
+				vr.Upper = on
+				if on {
+					vr.Lower = false
+				}
+			}
+		}
+	}
+	return vr
+}
+
+// hasAttrs reports whether a variable has any attributes, besides its kind
+// of value.
+func hasAttrs(vr expand.Variable) bool {
+	return vr.Local || vr.Exported || vr.ReadOnly ||
+		vr.Integer || vr.Lower || vr.Upper || vr.Trace
+}
+
+// printDecls prints variables as declare commands, like "declare -p". With no
+// names, all variables are printed, but only those with the attributes in set
+// and of the kind in valType.
+func (r *Runner) printDecls(variant string, names []*syntax.Assign, valType, set string) {
+	if len(names) > 0 {
+		for _, as := range names {
+			name := as.Name.Value
+			vr := r.lookupVar(name)
+			if !vr.IsSet() && !vr.Declared && !hasAttrs(vr) {
+				r.errf("%s: %s: not found\n", variant, name)
+				r.exit = 1
+				continue
+			}
+			r.outf("%s\n", declString(name, vr))
+		}
+		return
+	}
+	for _, name := range r.varNames() {
+		vr := r.lookupVar(name)
+		if !vr.IsSet() && !vr.Declared && !hasAttrs(vr) {
+			continue
+		}
+		if variant == "local" && !vr.Local {
+			continue
+		}
+		flags := vr.Flags()
+		if !strings.Contains(flags, strings.TrimPrefix(valType, "-")) {
+			continue
+		}
+		if strings.Trim(set, flags) != "" {
+			continue
+		}
+		r.outf("%s\n", declString(name, vr))
+	}
+}
+
+// varNames returns the names of all the variables in scope, sorted.
+func (r *Runner) varNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string, vr expand.Variable) bool {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return true
+	}
+	expandEnv{r}.Each(add)
+	for name, vr := range r.funcVars {
+		add(name, vr)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declString formats a variable as a declare command which recreates it, such
+// as `declare -x foo="bar"` or `declare -a list=([0]="x" [3]="y")`.
+func declString(name string, vr expand.Variable) string {
+	var b strings.Builder
+	b.WriteString("declare -")
+	if flags := vr.Flags(); flags != "" {
+		b.WriteString(flags)
+	} else {
+		b.WriteString("-")
+	}
+	b.WriteString(" ")
+	b.WriteString(name)
+	switch vr.Kind {
+	case expand.Unset:
+	case expand.Indexed:
+		b.WriteString("=(")
+		for i, index := range vr.ArrayIndices() {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString("[" + strconv.Itoa(index) + "]=" + declQuote(vr.List[i]))
+		}
+		b.WriteString(")")
+	case expand.Associative:
+		keys := make([]string, 0, len(vr.Map))
+		for k := range vr.Map {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("=(")
+		for _, k := range keys {
+			key := k
+			if syntax.Quote(k) != k {
+				key = declQuote(k)
+			}
+			b.WriteString("[" + key + "]=" + declQuote(vr.Map[k]) + " ")
+		}
+		b.WriteString(")")
+	default:
+		b.WriteString("=" + declQuote(vr.Str))
+	}
+	return b.String()
+}
+
+// declQuote quotes a value like "declare -p" does. Double quotes are used,
+// unless the value contains non-printable characters.
+func declQuote(s string) string {
+	// "printf %q" uses the $'...' form for the same values
+	if q, _, _ := expand.Format(nil, "%q", []string{s}); strings.HasPrefix(q, "$'") {
+		return q
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '$', '`':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// declFuncs implements "declare -f" and "declare -F", which print functions
+// or set their attributes.
+func (r *Runner) declFuncs(names []*syntax.Assign, onlyNames bool, set, clear string) {
+	if len(names) == 0 {
+		funcNames := make([]string, 0, len(r.Funcs))
+		for name := range r.Funcs {
+			funcNames = append(funcNames, name)
+		}
+		sort.Strings(funcNames)
+		for _, name := range funcNames {
+			if onlyNames {
+				r.outf("declare -f%s %s\n", r.funcFlags(name), name)
+			} else {
+				r.printFunc(name)
+			}
+		}
+		return
+	}
+	for _, as := range names {
+		name := as.Name.Value
+		if r.Funcs[name] == nil {
+			r.exit = 1
+			continue
+		}
+		switch {
+		case set != "" || clear != "":
+			if strings.Contains(set, "t") {
+				if r.tracedFuncs == nil {
+					r.tracedFuncs = make(map[string]bool)
+				}
+				r.tracedFuncs[name] = true
+			} else if strings.Contains(clear, "t") {
+				delete(r.tracedFuncs, name)
+			}
+		case onlyNames:
+			r.outf("%s\n", name)
+		default:
+			r.printFunc(name)
+		}
+	}
+}
+
+func (r *Runner) funcFlags(name string) string {
+	if r.tracedFuncs[name] {
+		return "t"
+	}
+	return ""
+}
+
+// printFunc prints a function definition via syntax.Printer.
+func (r *Runner) printFunc(name string) {
+	var b strings.Builder
+	body := r.Funcs[name]
+	syntax.NewPrinter().Print(&b, &syntax.Stmt{
+		Position: body.Pos(),
+		Cmd: &syntax.FuncDecl{
+			Position: body.Pos(),
+			Name:     &syntax.Lit{ValuePos: body.Pos(), Value: name},
+			Body:     body,
+		},
+	})
+	r.outf("%s\n", b.String())
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+)
+
+// fdFile is an open file descriptor, as used by redirections such as
+// "exec 3>file" and "cmd 2>&3".
+type fdFile struct {
+	r io.Reader // nil if not open for reading
+	w io.Writer // nil if not open for writing
+
+	// c is used to close the file when its last file descriptor is
+	// closed. It is nil if the Runner doesn't own the file, such as when
+	// it was inherited from a parent shell.
+	c io.Closer
+}
+
+// closedFd is used for the standard file descriptors once closed, such as
+// with "exec >&-".
+type closedFd struct{}
+
+func (closedFd) Read(p []byte) (int, error)  { return 0, syscall.EBADF }
+func (closedFd) Write(p []byte) (int, error) { return 0, syscall.EBADF }
+
+// getFd returns an open file descriptor. The boolean is false if it's not
+// open.
+func (r *Runner) getFd(fd int) (fdFile, bool) {
+	switch fd {
+	case 0:
+		return fdFile{r: r.stdin}, r.stdin != closedFd{}
+	case 1:
+		return fdFile{w: r.stdout}, r.stdout != closedFd{}
+	case 2:
+		return fdFile{w: r.stderr}, r.stderr != closedFd{}
+	}
+	f, ok := r.fds[fd]
+	return f, ok
+}
+
+// fdReader returns the reader for a file descriptor, or nil if it's not open
+// for reading.
+func (r *Runner) fdReader(fd int) io.Reader {
+	f, _ := r.getFd(fd)
+	return f.r
+}
+
+// fdWriter returns the writer for a file descriptor, or nil if it's not open
+// for writing.
+func (r *Runner) fdWriter(fd int) io.Writer {
+	f, _ := r.getFd(fd)
+	return f.w
+}
+
+// setFd opens or replaces a file descriptor. Any file previously open at the
+// same descriptor is not closed.
+//
+// The table of file descriptors is never modified in place, so that it can be
+// restored after each statement, and shared with subshells.
+func (r *Runner) setFd(fd int, f fdFile) {
+	switch fd {
+	case 0:
+		r.stdin = f.r
+	case 1:
+		r.stdout = f.w
+	case 2:
+		r.stderr = f.w
+	default:
+		fds := make(map[int]fdFile, len(r.fds)+1)
+		for fd2, f2 := range r.fds {
+			fds[fd2] = f2
+		}
+		fds[fd] = f
+		r.fds = fds
+	}
+}
+
+// closeFd closes a file descriptor. The underlying file is closed if the
+// Runner owns it, and no other file descriptor uses it.
+func (r *Runner) closeFd(fd int) {
+	if f, ok := r.getFd(fd); ok {
+		r.removeFd(fd)
+		r.closeFile(f)
+	}
+}
+
+// removeFd closes a file descriptor, without closing the underlying file.
+func (r *Runner) removeFd(fd int) {
+	switch fd {
+	case 0:
+		r.stdin = closedFd{}
+	case 1:
+		r.stdout = closedFd{}
+	case 2:
+		r.stderr = closedFd{}
+	default:
+		fds := make(map[int]fdFile, len(r.fds))
+		for fd2, f2 := range r.fds {
+			if fd2 != fd {
+				fds[fd2] = f2
+			}
+		}
+		r.fds = fds
+	}
+}
+
+// closeFile closes the file underlying a file descriptor which was closed, if
+// the Runner owns it and no other file descriptor uses it.
+func (r *Runner) closeFile(f fdFile) {
+	if f.c == nil {
+		return
+	}
+	for _, f2 := range r.fds {
+		if f2.c == f.c {
+			return
+		}
+	}
+	for _, std := range []interface{}{r.stdin, r.stdout, r.stderr} {
+		if sameValue(std, f.c) {
+			return
+		}
+	}
+	f.c.Close()
+}
+
+// sameValue reports whether two interface values are equal, without panicking
+// if their types aren't comparable.
+func sameValue(x, y interface{}) bool {
+	if x == nil || y == nil {
+		return false
+	}
+	if !reflect.TypeOf(x).Comparable() || !reflect.TypeOf(y).Comparable() {
+		return false
+	}
+	return x == y
+}
+
+// newFd opens a file at the lowest free file descriptor number starting at
+// 10, like Bash does for coprocesses and "{varname}>file" redirections.
+func (r *Runner) newFd(f fdFile) int {
+	fd := 10
+	for {
+		if _, ok := r.fds[fd]; !ok {
+			break
+		}
+		fd++
+	}
+	r.setFd(fd, f)
+	return fd
+}
+
+// extraFiles returns the open file descriptors other than the standard ones
+// which are backed by an *os.File, as used by exec.Cmd.ExtraFiles.
+func (r *Runner) extraFiles() []*os.File {
+	var files []*os.File
+	for fd, f := range r.fds {
+		var file *os.File
+		if f2, ok := f.r.(*os.File); ok {
+			file = f2
+		} else if f2, ok := f.w.(*os.File); ok {
+			file = f2
+		}
+		if file == nil {
+			continue
+		}
+		for len(files) <= fd-3 {
+			files = append(files, nil)
+		}
+		files[fd-3] = file
+	}
+	return files
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FileSystem is the interface through which the interpreter accesses files,
+// such as when globbing, changing directories, or evaluating test expressions
+// like "-d". Paths are always absolute.
+//
+// Implementing it allows running programs against a virtual tree of files,
+// such as one kept in memory or an overlay on top of the real filesystem. Note
+// that the programs run via the ExecHandler do not use it; DefaultExecHandler
+// finds them in $PATH via the FileSystem, but then runs them from the real
+// filesystem.
+type FileSystem interface {
+	// OpenFile opens a file like os.OpenFile. Files are opened via the
+	// OpenHandler, so it is only used by DefaultOpenHandler, or by a custom
+	// OpenHandler which calls it via HandlerContext.FS.
+	OpenFile(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
+
+	// Stat and Lstat return information about a file like os.Stat and
+	// os.Lstat.
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+
+	// ReadDir returns the entries in a directory sorted by name, like
+	// ioutil.ReadDir.
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// OSFileSystem returns the FileSystem used by default, which uses the real
+// filesystem via the os package.
+func OSFileSystem() FileSystem { return osFileSystem{} }
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (osFileSystem) Lstat(name string) (os.FileInfo, error)     { return os.Lstat(name) }
+func (osFileSystem) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+
+// FS sets the filesystem used by the interpreter, which defaults to
+// OSFileSystem. It is also available to handlers via HandlerContext.
+func FS(fsys FileSystem) RunnerOption {
+	return func(r *Runner) error {
+		r.fs = fsys
+		return nil
+	}
+}
+
+func (r *Runner) stat(name string) (os.FileInfo, error) {
+	return r.fs.Stat(r.absPath(name))
+}
+
+func (r *Runner) lstat(name string) (os.FileInfo, error) {
+	return r.fs.Lstat(r.absPath(name))
+}
+
+func (r *Runner) readDir(name string) ([]os.FileInfo, error) {
+	return r.fs.ReadDir(r.absPath(name))
+}
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 // HandlerCtx returns HandlerContext value stored in ctx.
@@ -47,18 +48,43 @@ type HandlerContext struct {
 	Stdout io.Writer
 	// Stderr is the interpreter's current standard error writer.
 	Stderr io.Writer
+
+	// ExtraFiles holds the interpreter's open file descriptors other than
+	// the standard ones, such as the ones from "exec 3>file", which are
+	// backed by an *os.File. Entry i is file descriptor 3+i, and it is nil
+	// if the file descriptor isn't open. It is meant to be used as
+	// exec.Cmd.ExtraFiles.
+	ExtraFiles []*os.File
+
+	// Umask is the interpreter's file mode creation mask, as set by the
+	// umask builtin. DefaultExecHandler doesn't apply it, as Go can't set
+	// the umask of a child process alone, so programs inherit the umask of
+	// the Go process. ExecHandlers may apply it themselves.
+	Umask os.FileMode
+
+	// FS is the filesystem used by the interpreter, as set via the FS
+	// option.
+	FS FileSystem
+
+	usage *childUsage // see ReportUsage
 }
 
 // ExecHandlerFunc is a handler which executes simple command. It is
 // called for all CallExpr nodes where the first argument is neither a
 // declared function nor a builtin.
 //
+// The kill builtin only signals the background jobs started by the interpreter
+// by itself. To signal other processes, it calls the handler with a command
+// like "kill -15 -- 1234", so that embedders may filter it like any other
+// program. It never signals the shell's own process, process groups, nor all
+// processes.
+//
 // Returning nil error sets commands exit status to 0. Other exit statuses
 // can be set with NewExitStatus. Any other error will halt an interpreter.
 type ExecHandlerFunc func(ctx context.Context, args []string) error
 
 // DefaultExecHandler returns an ExecHandlerFunc used by default.
-// It finds binaries in PATH and executes them.
+// It finds binaries in PATH via the interpreter's FileSystem, and executes them.
 // When context is cancelled, interrupt signal is sent to running processes.
 // KillTimeout is a duration to wait before sending kill signal.
 // A negative value means that a kill signal will be sent immediately.
@@ -68,7 +94,11 @@ type ExecHandlerFunc func(ctx context.Context, args []string) error
 func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	return func(ctx context.Context, args []string) error {
 		hc := HandlerCtx(ctx)
-		path, err := LookPath(hc.Env, args[0])
+		fsys := hc.FS
+		if fsys == nil {
+			fsys = osFileSystem{}
+		}
+		path, err := lookPath(fsys, hc.Env, args[0])
 		if err != nil {
 			fmt.Fprintln(hc.Stderr, err)
 			return NewExitStatus(127)
@@ -82,9 +112,12 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			Stdout: hc.Stdout,
 			Stderr: hc.Stderr,
 		}
+		if runtime.GOOS != "windows" {
+			// not supported on Windows
+			cmd.ExtraFiles = hc.ExtraFiles
+		}
 
-		err = cmd.Start()
-		if err == nil {
+		if err = cmd.Start(); err == nil {
 			if done := ctx.Done(); done != nil {
 				go func() {
 					<-done
@@ -106,6 +139,9 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			}
 
 			err = cmd.Wait()
+			if st := cmd.ProcessState; st != nil {
+				hc.ReportUsage(st.UserTime(), st.SystemTime())
+			}
 		}
 
 		switch x := err.(type) {
@@ -129,11 +165,11 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	}
 }
 
-func checkStat(dir, file string) (string, error) {
+func checkStat(fsys FileSystem, dir, file string) (string, error) {
 	if !filepath.IsAbs(file) {
 		file = filepath.Join(dir, file)
 	}
-	info, err := os.Stat(file)
+	info, err := fsys.Stat(file)
 	if err != nil {
 		return "", err
 	}
@@ -155,19 +191,19 @@ func winHasExt(file string) bool {
 	return strings.LastIndexAny(file, `:\/`) < i
 }
 
-func findExecutable(dir, file string, exts []string) (string, error) {
+func findExecutable(fsys FileSystem, dir, file string, exts []string) (string, error) {
 	if len(exts) == 0 {
 		// non-windows
-		return checkStat(dir, file)
+		return checkStat(fsys, dir, file)
 	}
 	if winHasExt(file) {
-		if file, err := checkStat(dir, file); err == nil {
+		if file, err := checkStat(fsys, dir, file); err == nil {
 			return file, nil
 		}
 	}
 	for _, e := range exts {
 		f := file + e
-		if f, err := checkStat(dir, f); err == nil {
+		if f, err := checkStat(fsys, dir, f); err == nil {
 			return f, nil
 		}
 	}
@@ -215,6 +251,11 @@ func splitList(path string) []string {
 //
 // If no error is returned, the returned path must be valid.
 func LookPath(env expand.Environ, file string) (string, error) {
+	return lookPath(osFileSystem{}, env, file)
+}
+
+// lookPath implements LookPath on top of a filesystem.
+func lookPath(fsys FileSystem, env expand.Environ, file string) (string, error) {
 	pathList := splitList(env.Get("PATH").String())
 	chars := `/`
 	if runtime.GOOS == "windows" {
@@ -225,7 +266,7 @@ func LookPath(env expand.Environ, file string) (string, error) {
 	exts := pathExts(env)
 	dir := env.Get("PWD").String()
 	if strings.ContainsAny(file, chars) {
-		return findExecutable(dir, file, exts)
+		return findExecutable(fsys, dir, file, exts)
 	}
 	for _, elem := range pathList {
 		var path string
@@ -236,7 +277,7 @@ func LookPath(env expand.Environ, file string) (string, error) {
 		default:
 			path = filepath.Join(elem, file)
 		}
-		if f, err := findExecutable(dir, path, exts); err == nil {
+		if f, err := findExecutable(fsys, dir, path, exts); err == nil {
 			return f, nil
 		}
 	}
@@ -264,25 +305,102 @@ func pathExts(env expand.Environ) []string {
 	return exts
 }
 
+// CallKind describes what a simple command runs.
+type CallKind uint8
+
+const (
+	CallExternal CallKind = iota // a program, run via the ExecHandler
+	CallFunction                 // a shell function
+	CallBuiltin                  // a builtin like "cd"
+)
+
+func (k CallKind) String() string {
+	switch k {
+	case CallFunction:
+		return "function"
+	case CallBuiltin:
+		return "builtin"
+	}
+	return "external"
+}
+
+// Call describes a simple command which is about to run, as passed to a
+// CallHandlerFunc.
+type Call struct {
+	// Args holds the command name and its arguments, once expanded.
+	Args []string
+
+	// Pos is the position of the command name, and Filename the name of
+	// the file it's in. Filename is empty when running nodes other than
+	// *syntax.File.
+	Pos      syntax.Pos
+	Filename string
+
+	// Kind is what the command name resolves to.
+	Kind CallKind
+}
+
+// CallHandlerFunc is a handler which is called for every simple command,
+// before it runs. Unlike ExecHandlerFunc, it is also called for functions and
+// builtins. It is called again for the commands run by the "builtin", "command"
+// and "exec" builtins, with the kind of command they will run.
+//
+// Returning a non-empty slice replaces the arguments, which may run a different
+// kind of command. Returning an error with an exit status, created via
+// NewExitStatus, skips the command and sets that exit status. Any other error
+// will halt the interpreter.
+type CallHandlerFunc func(ctx context.Context, call Call) ([]string, error)
+
 // OpenHandlerFunc is a handler which opens files. It is
 // called for all files that are opened directly by the shell, such as
 // in redirects. Files opened by executed programs are not included.
 //
+// The perm parameter already has the interpreter's umask applied, which is also
+// available via HandlerCtx.
+//
 // The path parameter may be relative to the current directory, which can be
 // fetched via HandlerCtx.
 //
+// The interpreter's FileSystem, as set via the FS option, is only used to open
+// files by DefaultOpenHandler. Other handlers should use HandlerContext.FS to
+// open files, if they want to respect it.
+//
+// When the noclobber option is set, output redirects first try to create the
+// file with os.O_EXCL, so the handler should support that flag atomically.
+//
 // Use a return error of type *os.PathError to have the error printed to
 // stderr and the exit status set to 1. If the error is of any other type, the
 // interpreter will come to a stop.
 type OpenHandlerFunc func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 
-// DefaultOpenHandler returns an OpenHandlerFunc used by default. It uses os.OpenFile to open files.
+// DefaultOpenHandler returns an OpenHandlerFunc used by default. It uses os.OpenFile to open files,
+// or the OpenFile method of the interpreter's FileSystem if one was set via the FS option.
 func DefaultOpenHandler() OpenHandlerFunc {
 	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
 		mc := HandlerCtx(ctx)
 		if !filepath.IsAbs(path) {
 			path = filepath.Join(mc.Dir, path)
 		}
-		return os.OpenFile(path, flag, perm)
+		if _, ok := mc.FS.(osFileSystem); mc.FS != nil && !ok {
+			return mc.FS.OpenFile(path, flag, perm)
+		}
+		if flag&os.O_CREATE == 0 || perm&^processUmask() == perm {
+			return os.OpenFile(path, flag, perm)
+		}
+		// The process umask removes permissions which the interpreter's
+		// umask keeps, so set them again if we create the file. O_EXCL
+		// tells us whether we did.
+		f, err := os.OpenFile(path, flag|os.O_EXCL, perm)
+		if os.IsExist(err) && flag&os.O_EXCL == 0 {
+			return os.OpenFile(path, flag, perm)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
 	}
 }
@@ -9,7 +9,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -118,6 +121,88 @@ func TestRunnerHandlers(t *testing.T) {
 	}
 }
 
+func TestRunnerCallHandler(t *testing.T) {
+	t.Parallel()
+	src := `f() { echo in f $1; }
+f a
+greet
+rm -rf /; echo $?
+true
+command rm -rf /; builtin echo $?
+command greet
+exec stop
+echo never`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "script.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cb concBuffer
+	var calls []string
+	handler := func(ctx context.Context, call Call) ([]string, error) {
+		calls = append(calls, fmt.Sprintf("%s:%s %s %q",
+			call.Filename, call.Pos, call.Kind, call.Args))
+		switch call.Args[0] {
+		case "greet":
+			return []string{"echo", "rewritten"}, nil
+		case "rm":
+			return nil, NewExitStatus(3)
+		case "stop":
+			return nil, fmt.Errorf("stopped by policy")
+		}
+		return nil, nil
+	}
+	r, err := New(StdIO(nil, &cb, &cb), CallHandler(handler), ExecHandler(testExecHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Run(context.Background(), file)
+	if want := "stopped by policy"; fmt.Sprint(err) != want {
+		t.Fatalf("want error %q, got: %v", want, err)
+	}
+	if got, want := cb.String(), "in f a\nrewritten\n3\n3\nrewritten\n"; got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+	wantCalls := []string{
+		`script.sh:2:1 function ["f" "a"]`,
+		`script.sh:1:7 builtin ["echo" "in" "f" "a"]`,
+		`script.sh:3:1 external ["greet"]`,
+		`script.sh:4:1 external ["rm" "-rf" "/"]`,
+		`script.sh:4:11 builtin ["echo" "3"]`,
+		`script.sh:5:1 builtin ["true"]`,
+		`script.sh:6:1 builtin ["command" "rm" "-rf" "/"]`,
+		`script.sh:6:1 external ["rm" "-rf" "/"]`,
+		`script.sh:6:19 builtin ["builtin" "echo" "3"]`,
+		`script.sh:6:19 builtin ["echo" "3"]`,
+		`script.sh:7:1 builtin ["command" "greet"]`,
+		`script.sh:7:1 external ["greet"]`,
+		`script.sh:8:1 builtin ["exec" "stop"]`,
+		`script.sh:8:1 external ["stop"]`,
+	}
+	if got, want := strings.Join(calls, "\n"), strings.Join(wantCalls, "\n"); got != want {
+		t.Fatalf("wrong calls:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestKillExecHandler(t *testing.T) {
+	t.Parallel()
+	var calls [][]string
+	exec := func(ctx context.Context, args []string) error {
+		calls = append(calls, args)
+		return NewExitStatus(1)
+	}
+	file := parse(t, nil, ": & kill -HUP %1 12345 12346 0; echo $?")
+	var cb concBuffer
+	r, _ := New(StdIO(nil, &cb, &cb), ExecHandler(exec))
+	r.Run(context.Background(), file)
+	if got, want := cb.String(), "kill: (0) - Operation not permitted\n1\n"; got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+	want := `[[kill -1 -- 12345 12346]]`
+	if got := fmt.Sprint(calls); got != want {
+		t.Fatalf("wrong exec calls:\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
 type readyBuffer struct {
 	buf       bytes.Buffer
 	seenReady sync.WaitGroup
@@ -212,3 +297,109 @@ func TestKillTimeout(t *testing.T) {
 		})
 	}
 }
+
+// memFS is a minimal in-memory FileSystem. Keys are absolute paths, and
+// directories are the keys ending with a slash.
+type memFS map[string]*bytes.Buffer
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+type memFile struct{ *bytes.Buffer }
+
+func (memFile) Close() error { return nil }
+
+func (fs memFS) OpenFile(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	buf := fs[name]
+	switch {
+	case buf == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case buf == nil || flag&os.O_TRUNC != 0:
+		buf = new(bytes.Buffer)
+		fs[name] = buf
+	}
+	return memFile{buf}, nil
+}
+
+func (fs memFS) Stat(name string) (os.FileInfo, error) {
+	base := filepath.Base(name)
+	if fs[strings.TrimSuffix(name, "/")+"/"] != nil {
+		return memFileInfo{base, 0, os.ModeDir | 0755}, nil
+	}
+	if buf := fs[name]; buf != nil {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0755
+		}
+		return memFileInfo{base, int64(buf.Len()), mode}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs memFS) Lstat(name string) (os.FileInfo, error) { return fs.Stat(name) }
+
+func (fs memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	if fs[prefix] == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for path := range fs {
+		rest := strings.TrimPrefix(path, prefix)
+		if rest == path || rest == "" || strings.Contains(strings.TrimSuffix(rest, "/"), "/") {
+			continue
+		}
+		info, _ := fs.Stat(path)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func TestRunnerFS(t *testing.T) {
+	t.Parallel()
+	fs := memFS{
+		"/":                  new(bytes.Buffer),
+		"/proj/":             new(bytes.Buffer),
+		"/proj/sub/":         new(bytes.Buffer),
+		"/proj/build.sh":     bytes.NewBufferString("echo building $1\n"),
+		"/proj/notes.txt":    bytes.NewBufferString("some notes\n"),
+		"/proj/sub/other.sh": bytes.NewBufferString("\n"),
+	}
+	in := `
+echo * sub/*.sh
+[[ -d sub && -f notes.txt && -x build.sh && ! -x notes.txt && ! -e missing ]] && echo tests
+read line <notes.txt; echo $line
+echo written >sub/out; read line <sub/out; echo $line
+source build.sh foo
+cd sub && echo $PWD *
+cd /missing; echo $?
+PATH=/bin ls; echo $?
+`
+	want := "build.sh notes.txt sub sub/other.sh\ntests\nsome notes\nwritten\n" +
+		"building foo\n/proj/sub other.sh out\n1\n" +
+		"\"ls\": executable file not found in $PATH\n127\n"
+	file := parse(t, nil, in)
+	var cb concBuffer
+	r, err := New(Dir("/proj"), FS(fs), StdIO(nil, &cb, &cb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Run(context.Background(), file)
+	if got := cb.String(); got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+	if _, err := New(Dir("/proj/missing"), FS(fs)); err == nil {
+		t.Fatalf("expected an error for a missing directory")
+	}
+}
@@ -9,18 +9,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"math/rand"
 	"os"
+	"os/user"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
-	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 
 	"mvdan.cc/sh/v3/expand"
@@ -44,6 +43,9 @@ func New(opts ...RunnerOption) (*Runner, error) {
 		usedNew:     true,
 		execHandler: DefaultExecHandler(2 * time.Second),
 		openHandler: DefaultOpenHandler(),
+		fs:          osFileSystem{},
+		umask:       processUmask(),
+		now:         time.Now,
 	}
 	r.dirStack = r.dirBootstrap[:0]
 	for _, opt := range opts {
@@ -59,6 +61,15 @@ func New(opts ...RunnerOption) (*Runner, error) {
 		if err := Dir("")(r); err != nil {
 			return nil, err
 		}
+	} else {
+		// checked here, as the filesystem may be set after the directory
+		info, err := r.fs.Stat(r.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat: %v", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", r.Dir)
+		}
 	}
 	if r.stdout == nil || r.stderr == nil {
 		StdIO(r.stdin, r.stdout, r.stderr)(r)
@@ -70,6 +81,12 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 	r.ectx = ctx
 	r.ecfg = &expand.Config{
 		Env: expandEnv{r},
+		Warn: func(err error) {
+			r.errf("%v\n", err)
+		},
+		Now:      r.now,
+		UserName: func() string { return r.userName },
+		HostName: func() string { return r.hostName },
 		CmdSubst: func(w io.Writer, cs *syntax.CmdSubst) error {
 			switch len(cs.Stmts) {
 			case 0: // nothing to do
@@ -89,7 +106,10 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 			}
 			r2 := r.sub()
 			r2.stdout = w
+			r2.traceDepth++
 			r2.stmts(ctx, cs.Stmts)
+			r2.exitTrap(ctx)
+			r.profSkip()
 			return r2.err
 		},
 		ProcSubst: func(ps *syntax.ProcSubst) (string, error) {
@@ -109,6 +129,7 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 				return "", err
 			}
 			r2 := r.sub()
+			r2.traceDepth++
 			stdout := r.origStdout
 			r.wgProcSubsts.Add(1)
 			go func() {
@@ -132,6 +153,13 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 					}()
 				}
 				r2.stmts(ctx, ps.Stmts)
+				if r2.err != nil {
+					r.procSubstMu.Lock()
+					if r.procSubstErr == nil {
+						r.procSubstErr = r2.err
+					}
+					r.procSubstMu.Unlock()
+				}
 			}()
 			return path, nil
 		},
@@ -159,12 +187,25 @@ func (r *Runner) updateExpandOpts() {
 	if r.opts[optNoGlob] {
 		r.ecfg.ReadDir = nil
 	} else {
-		r.ecfg.ReadDir = ioutil.ReadDir
+		r.ecfg.ReadDir = r.readDir
 	}
 	r.ecfg.GlobStar = r.opts[optGlobStar]
+	r.ecfg.NullGlob = r.opts[optNullGlob]
+	r.ecfg.FailGlob = r.opts[optFailGlob]
+	r.ecfg.DotGlob = r.opts[optDotGlob]
+	r.ecfg.NoCaseGlob = r.opts[optNoCaseGlob]
+	r.ecfg.NoCaseMatch = r.opts[optNoCaseMatch]
+	r.ecfg.ExtGlob = r.opts[optExtGlob]
 }
 
 func (r *Runner) expandErr(err error) {
+	var unsupported UnsupportedError
+	if xerrors.As(err, &unsupported) {
+		// from an expansion or a command substitution
+		r.exit = 2
+		r.setErr(unsupported)
+		return
+	}
 	if err != nil {
 		r.errf("%v\n", err)
 		r.exit = 1
@@ -178,6 +219,23 @@ func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 	return n
 }
 
+// arithmStatus evaluates the expression of an arithmetic command like "let" or
+// "((expr))". Unlike in arithmetic expansions, errors don't exit the shell; the
+// command reports them and fails with exit status 1.
+func (r *Runner) arithmStatus(name string, expr syntax.ArithmExpr) (int, bool) {
+	if expr == nil {
+		return 0, true
+	}
+	n, err := expand.Arithm(r.ecfg, expr)
+	if _, ok := err.(expand.ArithmError); ok {
+		r.errf("%s: %v\n", name, err)
+		r.exit = 1
+		return 0, false
+	}
+	r.expandErr(err)
+	return n, err == nil
+}
+
 func (r *Runner) fields(words ...*syntax.Word) []string {
 	strs, err := expand.Fields(r.ecfg, words...)
 	r.expandErr(err)
@@ -214,7 +272,7 @@ func (e expandEnv) Get(name string) expand.Variable {
 }
 
 func (e expandEnv) Set(name string, vr expand.Variable) error {
-	e.r.setVarInternal(name, vr)
+	e.r.setVar(name, nil, vr)
 	return nil // TODO: return any errors
 }
 
@@ -255,13 +313,6 @@ func Dir(path string) RunnerOption {
 		if err != nil {
 			return fmt.Errorf("could not get absolute dir: %v", err)
 		}
-		info, err := os.Stat(path)
-		if err != nil {
-			return fmt.Errorf("could not stat: %v", err)
-		}
-		if !info.IsDir() {
-			return fmt.Errorf("%s is not a directory", path)
-		}
 		r.Dir = path
 		return nil
 	}
@@ -306,7 +357,7 @@ func Params(args ...string) RunnerOption {
 					}
 					break
 				}
-				opt = r.optByName(args[0], false)
+				opt = r.optByName(args[0], true)
 			} else {
 				opt = r.optByFlag(flag)
 			}
@@ -333,6 +384,15 @@ func ExecHandler(f ExecHandlerFunc) RunnerOption {
 	}
 }
 
+// CallHandler sets the handler called before every simple command. See
+// CallHandlerFunc for more info.
+func CallHandler(f CallHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.callHandler = f
+		return nil
+	}
+}
+
 // OpenHandler sets file open handler. See OpenHandlerFunc for more info.
 func OpenHandler(f OpenHandlerFunc) RunnerOption {
 	return func(r *Runner) error {
@@ -341,6 +401,70 @@ func OpenHandler(f OpenHandlerFunc) RunnerOption {
 	}
 }
 
+// Hermetic sets the sources of the values which would otherwise change between
+// runs of the same program, which is useful to get reproducible output in
+// tests.
+//
+// The now func is used as the clock for $SECONDS, $EPOCHSECONDS,
+// $EPOCHREALTIME, prompt escapes like "\t" and the Profiler, and src is the
+// random source for $RANDOM and $SRANDOM. A nil now or src keeps the default
+// behavior. If pid is positive, pid and ppid are used for $$, $BASHPID and
+// $PPID, and background jobs get the process IDs following pid.
+func Hermetic(now func() time.Time, src rand.Source, pid, ppid int) RunnerOption {
+	return func(r *Runner) error {
+		if now != nil {
+			r.now = now
+		}
+		r.randSource = src
+		if pid > 0 {
+			r.pid, r.ppid = pid, ppid
+		}
+		return nil
+	}
+}
+
+// Umask sets the interpreter's file mode creation mask, which defaults to the
+// umask of the current process. It applies to the files created via the
+// OpenHandler, and is passed on to the ExecHandler via HandlerContext.
+//
+// Unlike in a real shell, changing it via the umask builtin does not change the
+// process umask. The umask only applies to the files created by the interpreter
+// itself, such as via redirections; the programs run by DefaultExecHandler
+// inherit the umask of the Go process.
+func Umask(mask os.FileMode) RunnerOption {
+	return func(r *Runner) error {
+		if mask&^0777 != 0 {
+			return fmt.Errorf("invalid umask: %#o", mask)
+		}
+		r.umask = mask
+		return nil
+	}
+}
+
+// Signals sets a channel from which the interpreter receives signals, such as
+// one set up via os/signal.Notify. Each received signal runs the handler set up
+// for it via the trap builtin. Signals without a handler make the shell exit
+// with status 128+n, unless they are ignored by default, like SIGCHLD.
+//
+// Signals are handled between commands, so any running program may need to be
+// stopped separately, such as by cancelling the context.
+func Signals(ch <-chan os.Signal) RunnerOption {
+	return func(r *Runner) error {
+		r.signals = ch
+		return nil
+	}
+}
+
+// Interactive configures the runner as an interactive shell, like one reading
+// commands from a terminal. PS1 and PS2 default to "$ " and "> " when reset,
+// to be used via Runner.Prompt.
+func Interactive(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.interactive = enabled
+		return nil
+	}
+}
+
 // StdIO configures an interpreter's standard input, standard output, and
 // standard error. If out or err are nil, they default to a writer that discards
 // the output.
@@ -397,6 +521,44 @@ type Runner struct {
 	// openHandler is a function responsible for opening files. It must be non-nil.
 	openHandler OpenHandlerFunc
 
+	// callHandler is called before running each simple command. It may be
+	// nil.
+	callHandler CallHandlerFunc
+
+	// debugger may stop before running each statement. It may be nil.
+	// debugSkip skips the next statement, such as a function's body.
+	// debugAction is the action last chosen when stopping in this Runner,
+	// and debugDepth the stack depth at the time. debugFunc is a function
+	// with a breakpoint which was just called, and debugStopped is set
+	// while the handler runs, so that the statements it runs via this
+	// Runner, such as command substitutions in DebugStop.Expand, don't stop.
+	debugger     *Debugger
+	debugSkip    bool
+	debugAction  DebugAction
+	debugDepth   int
+	debugFunc    string
+	debugStopped bool
+
+	// coverage records which statements and branches run. It may be nil.
+	// mainCover is the coverage of the main file being run, if any.
+	coverage  *Coverage
+	mainCover *coverAST
+
+	// profiler measures the time spent running statements. It may be nil.
+	// profStmts are the statements being run, profExec is the external
+	// command being run if any, and profLast is when time was last counted.
+	profiler  *Profiler
+	profStmts []profStmt
+	profExec  string
+	profLast  time.Time
+
+	// fs is the filesystem used for everything but running programs. It
+	// must be non-nil.
+	fs FileSystem
+
+	// signals delivers the signals to be handled via traps. It may be nil.
+	signals <-chan os.Signal
+
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
@@ -411,12 +573,41 @@ type Runner struct {
 
 	usedNew bool
 
+	interactive bool
+	restricted  bool
+
 	// rand is used mainly to generate temporary files.
 	rand *rand.Rand
 
+	// now, randSource, pid and ppid can be set via the Hermetic option.
+	// Otherwise, now is time.Now, randSource is nil, and the process IDs
+	// are zero so that those of the current process are used.
+	now        func() time.Time
+	randSource rand.Source
+	pid, ppid  int
+
+	// random is used for $RANDOM, and is seeded by assigning to it. srandom
+	// is used for $SRANDOM, and is only set with the Hermetic option.
+	random, srandom *rand.Rand
+
+	// startTime and startSeconds give the value of $SECONDS, and are reset
+	// by assigning to it.
+	startTime    time.Time
+	startSeconds int
+
+	// userName and hostName are used by the "\u" and "\h" prompt escapes.
+	// Like $UID, they are looked up when the Runner is reset.
+	userName, hostName string
+
+	bashPid int    // $BASHPID, which differs from $$ in background jobs
+	lastArg string // $_, the last argument of the previous command
+
 	// wgProcSubsts allows waiting for any process substitution sub-shells
-	// to finish running.
+	// to finish running, and procSubstErr holds the first error any of
+	// them stopped with, guarded by procSubstMu.
 	wgProcSubsts sync.WaitGroup
+	procSubstMu  sync.Mutex
+	procSubstErr error
 
 	filename string // only if Node was a File
 
@@ -434,17 +625,65 @@ type Runner struct {
 	inSource  bool
 	noErrExit bool
 
+	// traps holds the handlers set up via the trap builtin, keyed by
+	// signal names like "INT" and pseudo-signals like "EXIT".
+	traps  map[string]*trap
+	inTrap bool
+
+	// tracedFuncs holds the functions with the trace attribute, set via
+	// "declare -ft", which inherit the DEBUG and RETURN traps.
+	tracedFuncs map[string]bool
+
+	// funcSources holds the file each function was defined in, for
+	// BASH_SOURCE. funcCovers holds the coverage of that file, if any.
+	funcSources map[string]string
+	funcCovers  map[string]*coverAST
+
+	// callStack holds the function calls and sourced files being run, with
+	// the innermost one last.
+	callStack []callFrame
+
+	// Funcs don't inherit the DEBUG and RETURN traps unless functrace is
+	// set, nor the ERR trap unless errtrace is set.
+	noDebugTraps bool
+	noErrTrap    bool
+
+	// traceDepth is the number of nested command substitutions, to
+	// repeat the first character of $PS4 with the xtrace option.
+	traceDepth int
+
 	err       error // current shell exit code or fatal error
 	exit      int   // current (last) exit status code
 	exitShell bool  // whether the shell needs to exit
 
-	bgShells errgroup.Group
+	// jobs holds the statements started in the background, in the order
+	// they were started. lastBgPid is the process ID of the last one, as
+	// given by "$!". doneJobs holds the exit statuses of the finished jobs
+	// which were removed from the table, by process ID.
+	jobs      []*job
+	lastBgPid int
+	doneJobs  map[int]int
+
+	// fds holds the open file descriptors other than the standard ones,
+	// such as the ones from "exec 3>file" or for Bash coprocesses.
+	fds map[int]fdFile
+
+	// coproc is the last coprocess started via mksh's "|&".
+	coproc *coproc
+
+	// usage holds the CPU time used by child processes, as reported by
+	// the ExecHandler. It's shared with subshells.
+	usage *childUsage
 
 	opts runnerOpts
 
+	// umask is the file mode creation mask, as set by the umask builtin.
+	umask os.FileMode
+
 	origDir    string
 	origParams []string
 	origOpts   runnerOpts
+	origUmask  os.FileMode
 	origStdin  io.Reader
 	origStdout io.Writer
 	origStderr io.Writer
@@ -456,6 +695,9 @@ type Runner struct {
 
 	optState getopts
 
+	// pendingRead is a read from stdin abandoned by "read -t".
+	pendingRead *pendingRead
+
 	// keepRedirs is used so that "exec" can make any redirections
 	// apply to the current shell, and not just the command.
 	keepRedirs bool
@@ -517,16 +759,26 @@ var shellOptsTable = [...]struct {
 	// that have no flag form
 	{"a", "allexport"},
 	{"e", "errexit"},
+	{"E", "errtrace"},
+	{"T", "functrace"},
+	{"C", "noclobber"},
 	{"n", "noexec"},
 	{"f", "noglob"},
 	{"u", "nounset"},
 	{" ", "pipefail"},
+	{"x", "xtrace"},
 }
 
 var bashOptsTable = [...]string{
 	// sorted alphabetically by name
+	"dotglob",
 	"expand_aliases",
+	"extglob",
+	"failglob",
 	"globstar",
+	"nocaseglob",
+	"nocasematch",
+	"nullglob",
 }
 
 // To access the shell options arrays without a linear search when we
@@ -535,13 +787,23 @@ var bashOptsTable = [...]string{
 const (
 	optAllExport = iota
 	optErrExit
+	optErrTrace
+	optFuncTrace
+	optNoClobber
 	optNoExec
 	optNoGlob
 	optNoUnset
 	optPipeFail
+	optXTrace
 
+	optDotGlob
 	optExpandAliases
+	optExtGlob
+	optFailGlob
 	optGlobStar
+	optNoCaseGlob
+	optNoCaseMatch
+	optNullGlob
 )
 
 // Reset returns a runner to its initial state, right before the first call to
@@ -559,6 +821,7 @@ func (r *Runner) Reset() {
 		r.origDir = r.Dir
 		r.origParams = r.Params
 		r.origOpts = r.opts
+		r.origUmask = r.umask
 		r.origStdin = r.stdin
 		r.origStdout = r.stdout
 		r.origStderr = r.stderr
@@ -568,6 +831,18 @@ func (r *Runner) Reset() {
 		Env:         r.Env,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		callHandler: r.callHandler,
+		debugger:    r.debugger,
+		coverage:    r.coverage,
+		profiler:    r.profiler,
+		fs:          r.fs,
+		signals:     r.signals,
+		now:         r.now,
+		randSource:  r.randSource,
+		pid:         r.pid,
+		ppid:        r.ppid,
+		interactive: r.interactive,
+		restricted:  r.restricted,
 
 		// These can be set by functions like Dir or Params, but
 		// builtins can overwrite them; reset the fields to whatever the
@@ -575,6 +850,7 @@ func (r *Runner) Reset() {
 		Dir:    r.origDir,
 		Params: r.origParams,
 		opts:   r.origOpts,
+		umask:  r.origUmask,
 		stdin:  r.origStdin,
 		stdout: r.origStdout,
 		stderr: r.origStderr,
@@ -582,6 +858,7 @@ func (r *Runner) Reset() {
 		origDir:    r.origDir,
 		origParams: r.origParams,
 		origOpts:   r.origOpts,
+		origUmask:  r.origUmask,
 		origStdin:  r.origStdin,
 		origStdout: r.origStdout,
 		origStderr: r.origStderr,
@@ -592,6 +869,8 @@ func (r *Runner) Reset() {
 		dirStack:  r.dirStack[:0],
 		usedNew:   r.usedNew,
 		bufCopier: r.bufCopier,
+
+		usage: new(childUsage),
 	}
 	if r.Vars == nil {
 		r.Vars = make(map[string]expand.Variable)
@@ -616,9 +895,42 @@ func (r *Runner) Reset() {
 		ReadOnly: true,
 		Str:      strconv.Itoa(os.Getuid()),
 	}
+	if u, err := user.Current(); err == nil {
+		r.userName = u.Username
+	} else {
+		r.userName = r.envGet("USER")
+	}
+	r.hostName, _ = os.Hostname()
 	r.Vars["PWD"] = expand.Variable{Kind: expand.String, Str: r.Dir}
 	r.Vars["IFS"] = expand.Variable{Kind: expand.String, Str: " \t\n"}
 	r.Vars["OPTIND"] = expand.Variable{Kind: expand.String, Str: "1"}
+	r.Vars["SHLVL"] = expand.Variable{
+		Kind:     expand.String,
+		Exported: true,
+		Str:      strconv.Itoa(atoi(r.Env.Get("SHLVL").String()) + 1),
+	}
+	r.startTime = r.now()
+	if r.randSource != nil {
+		r.random = rand.New(r.randSource)
+		r.srandom = rand.New(rand.NewSource(r.random.Int63()))
+	} else {
+		r.random = rand.New(rand.NewSource(r.startTime.UnixNano()))
+	}
+	r.bashPid = r.shellPid()
+	if vr := r.Env.Get("PS4"); !vr.IsSet() {
+		r.Vars["PS4"] = expand.Variable{Kind: expand.String, Str: "+ "}
+	}
+	if r.interactive {
+		if vr := r.Env.Get("PS1"); !vr.IsSet() {
+			r.Vars["PS1"] = expand.Variable{Kind: expand.String, Str: "$ "}
+		}
+		if vr := r.Env.Get("PS2"); !vr.IsSet() {
+			r.Vars["PS2"] = expand.Variable{Kind: expand.String, Str: "> "}
+		}
+	}
+	if r.restricted {
+		r.restrictVars()
+	}
 
 	if runtime.GOOS == "windows" {
 		// convert $PATH to a unix path list
@@ -634,10 +946,14 @@ func (r *Runner) Reset() {
 
 func (r *Runner) handlerCtx(ctx context.Context) context.Context {
 	hc := HandlerContext{
-		Dir:    r.Dir,
-		Stdin:  r.stdin,
-		Stdout: r.stdout,
-		Stderr: r.stderr,
+		Dir:        r.Dir,
+		Stdin:      r.stdin,
+		Stdout:     r.stdout,
+		Stderr:     r.stderr,
+		ExtraFiles: r.extraFiles(),
+		Umask:      r.umask,
+		FS:         r.fs,
+		usage:      r.usage,
 	}
 	oenv := overlayEnviron{
 		parent: r.Env,
@@ -675,6 +991,22 @@ func IsExitStatus(err error) (status uint8, ok bool) {
 	return 0, false
 }
 
+// UnsupportedError is returned by Runner.Run when a program uses a shell
+// feature which the interpreter does not implement, such as the "-N" test
+// operator. The program stops running, with exit status 2.
+//
+// It is the same type as expand.UnsupportedError, so that those returned by
+// expansions stop the program too.
+type UnsupportedError = expand.UnsupportedError
+
+// unsupported stops the program with an UnsupportedError.
+func (r *Runner) unsupported(pos syntax.Pos, format string, a ...interface{}) error {
+	err := UnsupportedError{Pos: pos, Feature: fmt.Sprintf(format, a...)}
+	r.exit = 2
+	r.setErr(err)
+	return err
+}
+
 func (r *Runner) setErr(err error) {
 	if r.err == nil {
 		r.err = err
@@ -683,7 +1015,8 @@ func (r *Runner) setErr(err error) {
 
 // Run interprets a node, which can be a *File, *Stmt, or Command. If a non-nil
 // error is returned, it will typically contain commands exit status,
-// which can be retrieved with IsExitStatus.
+// which can be retrieved with IsExitStatus. Programs using unsupported shell
+// features stop early with an UnsupportedError.
 //
 // Run can be called multiple times synchronously to interpret programs
 // incrementally. To reuse a Runner without keeping the internal shell state,
@@ -696,10 +1029,21 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	r.err = nil
 	r.exitShell = false
 	r.filename = ""
+	r.mainCover = nil
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
+		if r.coverage != nil && x.Name != "" {
+			// keep the source for the coverage report, if we can read it
+			var src []byte
+			if f, err := r.open(ctx, x.Name, os.O_RDONLY, 0, false); err == nil {
+				src, _ = ioutil.ReadAll(f)
+				f.Close()
+			}
+			r.mainCover = r.coverage.addFile(x, src)
+		}
 		r.stmts(ctx, x.Stmts)
+		r.exitTrap(ctx)
 	case *syntax.Stmt:
 		r.stmt(ctx, x)
 	case syntax.Command:
@@ -707,6 +1051,9 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 	default:
 		return fmt.Errorf("node can only be File, Stmt, or Command: %T", x)
 	}
+	if r.exitShell {
+		r.exitTrap(ctx)
+	}
 	if r.exit != 0 {
 		r.setErr(NewExitStatus(uint8(r.exit)))
 	}
@@ -722,6 +1069,52 @@ func (r *Runner) Exited() bool {
 	return r.exitShell
 }
 
+// Prompt returns the expansion of a prompt variable such as "PS1" or "PS2",
+// which an interactive shell prints before reading each line. Backslash escapes
+// like "\w" are decoded as described in expand.Prompt.
+//
+// When name is "PS1", the commands in $PROMPT_COMMAND are run first, keeping
+// the exit status of the last command. Any errors are printed to standard
+// error.
+func (r *Runner) Prompt(ctx context.Context, name string) string {
+	if !r.didReset {
+		r.Reset()
+	}
+	r.fillExpandConfig(ctx)
+	if name == "PS1" {
+		r.promptCommand(ctx)
+	}
+	oldOpts := r.opts
+	r.opts[optNoUnset] = false
+	defer func() { r.opts = oldOpts }()
+	ps, err := expand.Prompt(r.ecfg, r.lookupVar(name).String())
+	if err != nil {
+		r.errf("%v\n", err)
+	}
+	return ps
+}
+
+// promptCommand runs the commands in $PROMPT_COMMAND, which can also be an
+// array of commands.
+func (r *Runner) promptCommand(ctx context.Context) {
+	vr := r.lookupVar("PROMPT_COMMAND")
+	cmds := []string{vr.String()}
+	if vr.Kind == expand.Indexed {
+		cmds = vr.List
+	}
+	oldExit, oldErr, oldLastArg := r.exit, r.err, r.lastArg
+	r.err = nil
+	for _, src := range cmds {
+		file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+		if err != nil {
+			r.errf("PROMPT_COMMAND: %v\n", err)
+			continue
+		}
+		r.stmts(ctx, file.Stmts)
+	}
+	r.exit, r.err, r.lastArg = oldExit, oldErr, oldLastArg
+}
+
 func (r *Runner) out(s string) {
 	io.WriteString(r.stdout, s)
 }
@@ -749,73 +1142,185 @@ func (r *Runner) stop(ctx context.Context) bool {
 }
 
 func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
+	r.handleSignals(ctx)
 	if r.stop(ctx) {
 		return
 	}
-	if st.Background {
-		r2 := r.sub()
+	if r.debugger != nil {
+		if r.debugSkip {
+			r.debugSkip = false
+		} else if !r.debugStmt(st) {
+			r.exit = 1
+			r.exitShell = true
+			return
+		}
+	}
+	if r.coverage != nil {
+		r.coverStmt(st)
+	}
+	if r.profiler != nil {
+		defer r.profStmt(st)()
+	}
+	switch {
+	case st.Coprocess:
 		st2 := *st
-		st2.Background = false
-		r.bgShells.Go(func() error {
-			return r2.Run(ctx, &st2)
-		})
-	} else {
+		st2.Coprocess = false
+		r.startCoproc(ctx, "", &st2)
+	case st.Background:
+		r.startJob(ctx, st)
+	default:
 		r.stmtSync(ctx, st)
 	}
 }
 
 func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
-	defer r.wgProcSubsts.Wait()
+	defer func() {
+		r.wgProcSubsts.Wait()
+		// like with command substitutions, errors such as an
+		// UnsupportedError stop the program
+		if err := r.procSubstErr; err != nil {
+			r.procSubstErr = nil
+			r.expandErr(err)
+		}
+	}()
 	oldIn, oldOut, oldErr := r.stdin, r.stdout, r.stderr
+	var saved []savedFd
+	var closers []io.Closer
+	defer func() {
+		if r.keepRedirs {
+			// "exec" without a command; keep the redirections, and
+			// close the files no longer in use
+			r.keepRedirs = false
+			for _, s := range saved {
+				if s.ok {
+					r.closeFile(s.f)
+				}
+			}
+			return
+		}
+		for _, cls := range closers {
+			cls.Close()
+		}
+		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+		for i := len(saved) - 1; i >= 0; i-- {
+			if s := saved[i]; s.ok {
+				r.setFd(s.fd, s.f)
+			} else {
+				r.closeFd(s.fd)
+			}
+		}
+	}()
 	for _, rd := range st.Redirs {
-		cls, err := r.redir(ctx, rd)
+		cls, err := r.redir(ctx, rd, &saved)
+		if cls != nil {
+			closers = append(closers, cls)
+		}
 		if err != nil {
 			r.exit = 1
 			return
 		}
-		if cls != nil {
-			defer cls.Close()
-		}
 	}
 	if st.Cmd == nil {
 		r.exit = 0
 	} else {
+		r.debugTrap(ctx, st.Cmd)
 		r.cmd(ctx, st.Cmd)
 	}
 	if st.Negated {
 		r.exit = oneIf(r.exit == 0)
 	} else if _, ok := st.Cmd.(*syntax.CallExpr); !ok {
-	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] {
-		// If the "errexit" option is set and a simple command failed,
-		// exit the shell. Exceptions:
+	} else if r.exit != 0 && !r.noErrExit {
+		// A simple command failed; run the ERR trap, and if the
+		// "errexit" option is set, exit the shell. Exceptions:
 		//
 		//   conditions (if <cond>, while <cond>, etc)
 		//   part of && or || lists
 		//   preceded by !
-		r.exitShell = true
-	}
-	if !r.keepRedirs {
-		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+		r.trap(ctx, "ERR")
+		if r.opts[optErrExit] {
+			r.exitShell = true
+		}
 	}
 }
 
 func (r *Runner) sub() *Runner {
 	// Keep in sync with the Runner type. Manually copy fields, to not copy
-	// sensitive ones like errgroup.Group, and to do deep copies of slices.
+	// sensitive ones like the job table, and to do deep copies of slices.
 	r2 := &Runner{
 		Env:         r.Env,
 		Dir:         r.Dir,
 		Params:      r.Params,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		callHandler: r.callHandler,
+		debugger:    r.debugger,
+		debugAction: r.debugAction,
+		debugDepth:  r.debugDepth,
+		coverage:    r.coverage,
+		profiler:    r.profiler,
+		fs:          r.fs,
 		stdin:       r.stdin,
 		stdout:      r.stdout,
 		stderr:      r.stderr,
 		filename:    r.filename,
 		opts:        r.opts,
+		umask:       r.umask,
+		restricted:  r.restricted,
+
+		noDebugTraps: r.noDebugTraps,
+		noErrTrap:    r.noErrTrap,
+		debugStopped: r.debugStopped,
+		traceDepth:   r.traceDepth,
+		lastBgPid:    r.lastBgPid,
+
+		now:          r.now,
+		randSource:   r.randSource,
+		pid:          r.pid,
+		ppid:         r.ppid,
+		startTime:    r.startTime,
+		startSeconds: r.startSeconds,
+		userName:     r.userName,
+		hostName:     r.hostName,
+		bashPid:      r.bashPid,
+		lastArg:      r.lastArg,
+
+		profStmts: append([]profStmt(nil), r.profStmts...),
+		profLast:  r.profLast,
+
+		// so that e.g. "$(jobs -p)" works
+		jobs:   append([]*job(nil), r.jobs...),
+		coproc: r.coproc,
+		usage:  r.usage,
 
 		origStdout: r.origStdout, // used for process substitutions
 	}
+	// Subshells only inherit ignored signals, plus the DEBUG, RETURN and
+	// ERR traps if functrace and errtrace are set.
+	for name, t := range r.traps {
+		inherit := len(t.stmts) == 0
+		switch name {
+		case "EXIT":
+			inherit = false
+		case "DEBUG", "RETURN":
+			inherit = r.opts[optFuncTrace]
+		case "ERR":
+			inherit = r.opts[optErrTrace]
+		}
+		if inherit {
+			if r2.traps == nil {
+				r2.traps = make(map[string]*trap, len(r.traps))
+			}
+			r2.traps[name] = t
+		}
+	}
+	if len(r.fds) > 0 {
+		// the files are owned by the parent, so they can't be closed
+		r2.fds = make(map[int]fdFile, len(r.fds))
+		for fd, f := range r.fds {
+			f.c = nil
+			r2.fds[fd] = f
+		}
+	}
 	r2.Vars = make(map[string]expand.Variable, len(r.Vars))
 	for k, v := range r.Vars {
 		r2.Vars[k] = v
@@ -832,6 +1337,31 @@ func (r *Runner) sub() *Runner {
 	for k, v := range r.Funcs {
 		r2.Funcs[k] = v
 	}
+	for k, v := range r.tracedFuncs {
+		if r2.tracedFuncs == nil {
+			r2.tracedFuncs = make(map[string]bool, len(r.tracedFuncs))
+		}
+		r2.tracedFuncs[k] = v
+	}
+	for k, v := range r.funcSources {
+		if r2.funcSources == nil {
+			r2.funcSources = make(map[string]string, len(r.funcSources))
+		}
+		r2.funcSources[k] = v
+	}
+	for k, v := range r.funcCovers {
+		if r2.funcCovers == nil {
+			r2.funcCovers = make(map[string]*coverAST, len(r.funcCovers))
+		}
+		r2.funcCovers[k] = v
+	}
+	r2.callStack = append([]callFrame(nil), r.callStack...)
+	// like in Bash, subshells get new random sequences, but they are
+	// derived from the parent's to keep them reproducible
+	r2.random = rand.New(rand.NewSource(r.random.Int63()))
+	if r.srandom != nil {
+		r2.srandom = rand.New(rand.NewSource(r.srandom.Int63()))
+	}
 	r2.dirStack = append(r2.dirBootstrap[:0], r.dirStack...)
 	r2.fillExpandConfig(r.ectx)
 	r2.didReset = true
@@ -848,6 +1378,8 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	case *syntax.Subshell:
 		r2 := r.sub()
 		r2.stmts(ctx, x.Stmts)
+		r2.exitTrap(ctx)
+		r.profSkip()
 		r.exit = r2.exit
 		r.setErr(r2.err)
 	case *syntax.CallExpr:
@@ -868,18 +1400,34 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		args = append(args, left...)
 		fields := r.fields(args...)
 		if len(fields) == 0 {
+			r.lastArg = ""
 			for _, as := range x.Assigns {
 				vr := r.assignVal(as, "")
+				if r.tracing() {
+					r.trace(traceAssign(as, vr))
+				}
 				r.setVar(as.Name.Value, as.Index, vr)
 			}
 			break
 		}
 		for _, as := range x.Assigns {
 			vr := r.assignVal(as, "")
+			if r.tracing() {
+				r.trace(traceAssign(as, vr))
+			}
+			if r.lookupVar(as.Name.Value).ReadOnly {
+				// like Bash, still run the command
+				r.errf("%s: readonly variable\n", as.Name.Value)
+				continue
+			}
 			// we know that inline vars must be strings
 			r.cmdVars[as.Name.Value] = vr.Str
 		}
+		if r.tracing() {
+			r.traceFields(fields)
+		}
 		r.call(ctx, x.Args[0].Pos(), fields)
+		r.lastArg = fields[len(fields)-1]
 		// cmdVars can be nuked here, as they are never useful
 		// again once we nest into further levels of inline
 		// vars.
@@ -894,7 +1442,10 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.stmt(ctx, x.X)
 			r.noErrExit = oldNoErrExit
 			if (r.exit == 0) == (x.Op == syntax.AndStmt) {
+				r.coverBranch(ctx, x, 0)
 				r.stmt(ctx, x.Y)
+			} else {
+				r.coverBranch(ctx, x, 1)
 			}
 		case syntax.Pipe, syntax.PipeAll:
 			pr, pw := io.Pipe()
@@ -929,9 +1480,11 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		r.noErrExit = oldNoErrExit
 
 		if r.exit == 0 {
+			r.coverBranch(ctx, x, 0)
 			r.stmts(ctx, x.Then)
 			break
 		}
+		r.coverBranch(ctx, x, 1)
 		r.exit = 0
 		if x.Else != nil {
 			r.cmd(ctx, x.Else)
@@ -957,6 +1510,10 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			if y.InPos.IsValid() {
 				items = r.fields(y.Items...) // for i in ...; do ...
 			}
+			if x.Select {
+				r.selectLoop(ctx, name, items, x.Do)
+				break
+			}
 			for _, field := range items {
 				r.setVarString(name, field)
 				if r.loopStmtsBroken(ctx, x.Do) {
@@ -964,35 +1521,58 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				}
 			}
 		case *syntax.CStyleLoop:
-			r.arithm(y.Init)
-			for r.arithm(y.Cond) != 0 {
+			if _, ok := r.arithmStatus("((", y.Init); !ok {
+				break
+			}
+			for {
+				if cond, ok := r.arithmStatus("((", y.Cond); !ok || cond == 0 {
+					break
+				}
 				if r.exit != 0 || r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
-				r.arithm(y.Post)
+				if _, ok := r.arithmStatus("((", y.Post); !ok {
+					break
+				}
 			}
 		}
 	case *syntax.FuncDecl:
 		r.setFunc(x.Name.Value, x.Body)
 	case *syntax.ArithmCmd:
-		r.exit = oneIf(r.arithm(x.X) == 0)
+		if r.tracing() {
+			var buf strings.Builder
+			syntax.NewPrinter().Print(&buf, x)
+			expr := strings.TrimSuffix(strings.TrimPrefix(buf.String(), "(("), "))")
+			r.trace("(( " + expr + " ))")
+		}
+		if val, ok := r.arithmStatus("((", x.X); ok {
+			r.exit = oneIf(val == 0)
+		}
 	case *syntax.LetClause:
+		if r.tracing() {
+			r.traceNode(x)
+		}
 		var val int
 		for _, expr := range x.Exprs {
-			val = r.arithm(expr)
+			var ok bool
+			if val, ok = r.arithmStatus("let", expr); !ok {
+				return
+			}
 		}
 		r.exit = oneIf(val == 0)
 	case *syntax.CaseClause:
 		str := r.literal(x.Word)
-		for _, ci := range x.Items {
+		for i, ci := range x.Items {
 			for _, word := range ci.Patterns {
 				pattern := r.pattern(word)
-				if match(pattern, str) {
+				if r.match(pattern, str) {
+					r.coverBranch(ctx, x, i)
 					r.stmts(ctx, ci.Stmts)
 					return
 				}
 			}
 		}
+		r.coverBranch(ctx, x, len(x.Items))
 	case *syntax.TestClause:
 		r.exit = 0
 		if r.bashTest(ctx, x.X, false) == "" && r.exit == 0 {
@@ -1000,86 +1580,39 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.exit = 1
 		}
 	case *syntax.DeclClause:
-		local, global := false, false
-		var modes []string
-		valType := ""
-		switch x.Variant.Value {
-		case "declare":
-			// When used in a function, "declare" acts as "local"
-			// unless the "-g" option is used.
-			local = r.inFunc
-		case "local":
-			if !r.inFunc {
-				r.errf("local: can only be used in a function\n")
-				r.exit = 1
-				return
-			}
-			local = true
-		case "export":
-			modes = append(modes, "-x")
-		case "readonly":
-			modes = append(modes, "-r")
-		case "nameref":
-			valType = "-n"
-		}
-		for _, as := range x.Args {
-			for _, as := range r.flattenAssign(as) {
-				name := as.Name.Value
-				if strings.HasPrefix(name, "-") {
-					switch name {
-					case "-x", "-r":
-						modes = append(modes, name)
-					case "-a", "-A", "-n":
-						valType = name
-					case "-g":
-						global = true
-					default:
-						r.errf("declare: invalid option %q\n", name)
-						r.exit = 2
-						return
-					}
-					continue
-				}
-				if !syntax.ValidName(name) {
-					r.errf("declare: invalid name %q\n", name)
-					r.exit = 1
-					return
-				}
-				vr := r.assignVal(as, valType)
-				if global {
-					vr.Local = false
-				} else if local {
-					vr.Local = true
-				}
-				for _, mode := range modes {
-					switch mode {
-					case "-x":
-						vr.Exported = true
-					case "-r":
-						vr.ReadOnly = true
-					}
-				}
-				r.setVar(name, as.Index, vr)
-			}
+		r.declClause(x)
+	case *syntax.CoprocClause:
+		name := "COPROC"
+		if x.Name != nil {
+			name = r.literal(x.Name)
 		}
+		r.startCoproc(ctx, name, x.Stmt)
 	case *syntax.TimeClause:
 		start := time.Now()
+		user, sys := r.usage.get()
 		if x.Stmt != nil {
 			r.stmt(ctx, x.Stmt)
 		}
-		format := "%s\t%s\n"
+		real := time.Since(start)
+		user2, sys2 := r.usage.get()
+		user, sys = user2-user, sys2-sys
+
+		format := defaultTimeFormat
 		if x.PosixFormat {
-			format = "%s %s\n"
+			format = posixTimeFormat
+		} else if vr := r.lookupVar("TIMEFORMAT"); vr.IsSet() {
+			format = vr.String()
+		}
+		if format == "" {
+			break
+		}
+		if s, err := formatTime(format, real, user, sys); err != nil {
+			r.errf("TIMEFORMAT: %v\n", err)
 		} else {
-			r.outf("\n")
+			r.errf("%s", s)
 		}
-		real := time.Since(start)
-		r.outf(format, "real", elapsedString(real, x.PosixFormat))
-		// TODO: can we do these?
-		r.outf(format, "user", elapsedString(0, x.PosixFormat))
-		r.outf(format, "sys", elapsedString(0, x.PosixFormat))
 	default:
-		panic(fmt.Sprintf("unhandled command node: %T", x))
+		r.unsupported(x.Pos(), "command node %T", x)
 	}
 }
 
@@ -1107,22 +1640,20 @@ func (r *Runner) flattenAssign(as *syntax.Assign) []*syntax.Assign {
 	return asgns
 }
 
-func match(pat, name string) bool {
-	expr, err := pattern.Regexp(pat, 0)
+// match reports whether name matches a pattern, as done by "case" and "[[".
+func (r *Runner) match(pat, name string) bool {
+	var mode pattern.Mode
+	if r.opts[optExtGlob] {
+		mode |= pattern.ExtendedOperators
+	}
+	if r.opts[optNoCaseMatch] {
+		mode |= pattern.NoGlobCase
+	}
+	m, err := pattern.Compile(pat, mode)
 	if err != nil {
 		return false
 	}
-	rx := regexp.MustCompile("^" + expr + "$")
-	return rx.MatchString(name)
-}
-
-func elapsedString(d time.Duration, posix bool) string {
-	if posix {
-		return fmt.Sprintf("%.2f", d.Seconds())
-	}
-	min := int(d.Minutes())
-	sec := math.Remainder(d.Seconds(), 60.0)
-	return fmt.Sprintf("%dm%.3fs", min, sec)
+	return m.MatchString(name)
 }
 
 func (r *Runner) stmts(ctx context.Context, stmts []*syntax.Stmt) {
@@ -1164,60 +1695,144 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 	return &buf
 }
 
-func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, error) {
-	if rd.Hdoc != nil {
-		r.stdin = r.hdocReader(rd)
-		return nil, nil
+// savedFd is a file descriptor saved before a redirection, to be restored
+// once the statement is done.
+type savedFd struct {
+	fd int
+	f  fdFile
+	ok bool
+}
+
+// redir applies a redirection, returning the opened file to be closed once the
+// statement is done, if any. File descriptors other than the standard ones are
+// added to saved before being replaced or closed.
+func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect, saved *[]savedFd) (io.Closer, error) {
+	fd := 1
+	switch rd.Op {
+	case syntax.RdrIn, syntax.RdrInOut, syntax.DplIn,
+		syntax.Hdoc, syntax.DashHdoc, syntax.WordHdoc:
+		fd = 0
 	}
-	orig := &r.stdout
+	varName := "" // for Bash's {varname}>file
 	if rd.N != nil {
-		switch rd.N.Value {
-		case "1":
-		case "2":
-			orig = &r.stderr
+		if name := strings.TrimSuffix(strings.TrimPrefix(rd.N.Value, "{"), "}"); name != rd.N.Value {
+			varName = name
+		} else {
+			fd = atoi(rd.N.Value)
+		}
+	}
+	save := func(fd int) {
+		if fd > 2 {
+			f, ok := r.fds[fd]
+			*saved = append(*saved, savedFd{fd: fd, f: f, ok: ok})
+		}
+	}
+	set := func(f fdFile) {
+		if varName != "" {
+			// these are kept open after the statement, like in Bash
+			r.setVarString(varName, strconv.Itoa(r.newFd(f)))
+			return
 		}
+		save(fd)
+		r.setFd(fd, f)
+	}
+	badFd := func(arg string) error {
+		r.errf("%s: bad file descriptor\n", arg)
+		return fmt.Errorf("bad file descriptor: %s", arg)
+	}
+	if rd.Hdoc != nil {
+		set(fdFile{r: r.hdocReader(rd)})
+		return nil, nil
 	}
 	arg := r.literal(rd.Word)
-	switch rd.Op {
+	op := rd.Op
+	switch op {
 	case syntax.WordHdoc:
-		r.stdin = strings.NewReader(arg + "\n")
+		set(fdFile{r: strings.NewReader(arg + "\n")})
 		return nil, nil
-	case syntax.DplOut:
-		switch arg {
-		case "1":
-			*orig = r.stdout
-		case "2":
-			*orig = r.stderr
+	case syntax.DplIn, syntax.DplOut:
+		if arg == "-" {
+			if varName != "" {
+				fd = atoi(r.envGet(varName))
+				r.closeFd(fd)
+			} else {
+				// the file is closed once the statement is
+				// done, if the redirection is kept
+				save(fd)
+				r.removeFd(fd)
+			}
+			return nil, nil
+		}
+		if arg == "p" && r.coproc != nil {
+			// mksh's coprocess; only mksh programs can start one
+			// via "|&", and elsewhere "p" is a file name.
+			if op == syntax.DplIn {
+				set(fdFile{r: r.coproc.out})
+			} else {
+				set(fdFile{w: r.coproc.in})
+			}
+			return nil, nil
+		}
+		move := strings.HasSuffix(arg, "-")
+		src, err := strconv.Atoi(strings.TrimSuffix(arg, "-"))
+		if err != nil {
+			if op == syntax.DplOut && rd.N == nil {
+				op = syntax.RdrAll // ">&file" is like "&>file"
+				break
+			}
+			r.errf("%s: ambiguous redirect\n", arg)
+			return nil, fmt.Errorf("ambiguous redirect: %s", arg)
+		}
+		f, ok := r.getFd(src)
+		if !ok || (op == syntax.DplIn && f.r == nil) || (op == syntax.DplOut && f.w == nil) {
+			return nil, badFd(strconv.Itoa(src))
+		}
+		set(f)
+		if move {
+			save(src)
+			r.removeFd(src)
 		}
 		return nil, nil
-	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
-		syntax.RdrAll, syntax.AppAll:
-		// done further below
-	// case syntax.DplIn:
-	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
 	}
 	mode := os.O_RDONLY
-	switch rd.Op {
+	switch op {
+	case syntax.RdrIn:
+	case syntax.RdrInOut:
+		mode = os.O_RDWR | os.O_CREATE
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	case syntax.RdrOut, syntax.RdrAll:
+	case syntax.RdrOut, syntax.ClbOut, syntax.RdrAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	default:
+		return nil, r.unsupported(rd.OpPos, "redirect operator %s", op)
+	}
+	if r.restricted && mode != os.O_RDONLY {
+		r.errf("%s: restricted: cannot redirect output\n", arg)
+		return nil, fmt.Errorf("restricted: cannot redirect output")
+	}
+	var f io.ReadWriteCloser
+	var err error
+	if r.opts[optNoClobber] && (op == syntax.RdrOut || op == syntax.RdrAll) {
+		f, err = r.openNoClobber(ctx, arg)
+	} else {
+		f, err = r.open(ctx, arg, mode, 0666, true)
 	}
-	f, err := r.open(ctx, arg, mode, 0644, true)
 	if err != nil {
 		return nil, err
 	}
-	switch rd.Op {
+	switch op {
 	case syntax.RdrIn:
-		r.stdin = f
-	case syntax.RdrOut, syntax.AppOut:
-		*orig = f
+		set(fdFile{r: f, c: f})
+	case syntax.RdrInOut:
+		set(fdFile{r: f, w: f, c: f})
 	case syntax.RdrAll, syntax.AppAll:
 		r.stdout = f
 		r.stderr = f
 	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
+		set(fdFile{w: f, c: f})
+	}
+	if varName != "" {
+		return nil, nil
 	}
 	return f, nil
 }
@@ -1240,6 +1855,120 @@ func (r *Runner) loopStmtsBroken(ctx context.Context, stmts []*syntax.Stmt) bool
 	return false
 }
 
+// selectLoop runs a select clause, which shows a menu of items on stderr and
+// reads the choice into REPLY until EOF or a break.
+func (r *Runner) selectLoop(ctx context.Context, name string, items []string, stmts []*syntax.Stmt) {
+	menu := true
+	for !r.stop(ctx) {
+		choice, ok := r.selectQuery(ctx, items, menu)
+		if !ok {
+			r.exit = 1
+			break
+		}
+		r.setVarString(name, choice)
+		if r.loopStmtsBroken(ctx, stmts) {
+			break
+		}
+		// like Bash, only show the menu again on an empty line
+		menu = r.envGet("REPLY") == ""
+	}
+}
+
+// selectQuery prints the menu if asked to, and prompts for a choice with $PS3
+// until a non-empty line is read. The chosen item is returned, which is empty
+// if the choice wasn't valid. The boolean is false at EOF.
+func (r *Runner) selectQuery(ctx context.Context, items []string, menu bool) (string, bool) {
+	prompt := "#? "
+	if vr := r.lookupVar("PS3"); vr.IsSet() {
+		prompt = vr.String()
+	}
+	for {
+		if menu {
+			r.printSelectList(items)
+		}
+		r.errf("%s", prompt)
+		line, err := r.readLine(ctx, false)
+		if err != nil {
+			r.out("\n")
+			return "", false
+		}
+		reply := string(line)
+		r.setVarString("REPLY", reply)
+		if reply == "" {
+			menu = true
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(reply))
+		if err != nil || n < 1 || n > len(items) {
+			return "", true
+		}
+		return items[n-1], true
+	}
+}
+
+// printSelectList prints the numbered items of a select menu in columns, like
+// Bash does, fitting them within $COLUMNS.
+func (r *Runner) printSelectList(items []string) {
+	if len(items) == 0 {
+		r.errf("\n")
+		return
+	}
+	numLen := func(n int) int { return len(strconv.Itoa(n)) }
+	maxLen := 0
+	for _, item := range items {
+		if n := utf8.RuneCountInString(item); n > maxLen {
+			maxLen = n
+		}
+	}
+	indexLen := numLen(len(items))
+	maxLen += indexLen + len(") ") + 2
+
+	width := atoi(r.envGet("COLUMNS"))
+	if width <= 0 {
+		width = 80
+	}
+	cols := width / maxLen
+	if cols == 0 {
+		cols = 1
+	}
+	rows := (len(items) + cols - 1) / cols
+	cols = (len(items) + rows - 1) / rows
+	if rows == 1 {
+		rows, cols = cols, 1
+	}
+	firstIndexLen := numLen(rows)
+
+	var buf strings.Builder
+	for row := 0; row < rows; row++ {
+		pos := 0
+		for i := row; ; i += rows {
+			n := indexLen
+			if pos == 0 {
+				n = firstIndexLen
+			}
+			fmt.Fprintf(&buf, "%*d) %s", n, i+1, items[i])
+			if i+rows >= len(items) {
+				break
+			}
+			// pad with tabs and spaces up to the next column
+			from := pos + n + len(") ") + utf8.RuneCountInString(items[i])
+			to := pos + maxLen
+			for from < to {
+				if to/8 > from/8 {
+					buf.WriteByte('\t')
+					from += 8 - from%8
+				} else {
+					buf.WriteByte(' ')
+					from++
+				}
+			}
+			pos += maxLen
+		}
+		buf.WriteByte('\n')
+	}
+	r.errf("%s", buf.String())
+}
+
 type returnStatus uint8
 
 func (s returnStatus) Error() string { return fmt.Sprintf("return status %d", s) }
@@ -1248,6 +1977,10 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 	if r.stop(ctx) {
 		return
 	}
+	args, ok := r.callHook(ctx, pos, args, r.callKind(args[0]))
+	if !ok {
+		return
+	}
 	name := args[0]
 	if body := r.Funcs[name]; body != nil {
 		// stack them to support nested func calls
@@ -1257,16 +1990,31 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		oldFuncVars := r.funcVars
 		r.funcVars = nil
 		r.inFunc = true
+		r.pushFrame(name, r.funcSources[name], pos.Line(), r.funcCovers[name])
+		oldNoDebugTraps, oldNoErrTrap := r.noDebugTraps, r.noErrTrap
+		if !r.opts[optFuncTrace] && !r.tracedFuncs[name] {
+			r.noDebugTraps = true
+		}
+		if !r.opts[optErrTrace] {
+			r.noErrTrap = true
+		}
+		if r.debugger != nil {
+			r.debugger.enterFunc(r, name)
+			r.debugSkip = true
+		}
 
 		r.stmt(ctx, body)
-
-		r.Params = oldParams
-		r.funcVars = oldFuncVars
-		r.inFunc = oldInFunc
 		if code, ok := r.err.(returnStatus); ok {
 			r.err = nil
 			r.exit = int(code)
 		}
+		r.trap(ctx, "RETURN")
+
+		r.popFrame()
+		r.Params = oldParams
+		r.funcVars = oldFuncVars
+		r.inFunc = oldInFunc
+		r.noDebugTraps, r.noErrTrap = oldNoDebugTraps, oldNoErrTrap
 		return
 	}
 	if isBuiltin(name) {
@@ -1276,7 +2024,52 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 	r.exec(ctx, args)
 }
 
+// callHook calls the CallHandler, if any, before running a simple command of
+// the given kind. It returns the arguments to run, and false if the command
+// must be skipped.
+func (r *Runner) callHook(ctx context.Context, pos syntax.Pos, args []string, kind CallKind) ([]string, bool) {
+	if r.callHandler == nil {
+		return args, true
+	}
+	newArgs, err := r.callHandler(r.handlerCtx(ctx), Call{
+		Args:     args,
+		Pos:      pos,
+		Filename: r.curSource(),
+		Kind:     kind,
+	})
+	if status, ok := IsExitStatus(err); ok {
+		r.exit = int(status)
+		return nil, false
+	}
+	if err != nil {
+		r.setErr(err)
+		return nil, false
+	}
+	if len(newArgs) > 0 {
+		args = newArgs
+	}
+	return args, true
+}
+
+// callKind returns what a command name resolves to.
+func (r *Runner) callKind(name string) CallKind {
+	switch {
+	case r.Funcs[name] != nil:
+		return CallFunction
+	case isBuiltin(name):
+		return CallBuiltin
+	}
+	return CallExternal
+}
+
 func (r *Runner) exec(ctx context.Context, args []string) {
+	if r.restrictedCommand(args[0]) {
+		r.exit = 1
+		return
+	}
+	if r.profiler != nil {
+		defer r.profExecStart(args[0])()
+	}
 	err := r.execHandler(r.handlerCtx(ctx), args)
 	if status, ok := IsExitStatus(err); ok {
 		r.exit = int(status)
@@ -1291,7 +2084,7 @@ func (r *Runner) exec(ctx context.Context, args []string) {
 }
 
 func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileMode, print bool) (io.ReadWriteCloser, error) {
-	f, err := r.openHandler(r.handlerCtx(ctx), path, flags, mode)
+	f, err := r.openHandler(r.handlerCtx(ctx), path, flags, mode&^r.umask)
 	// TODO: support wrapped PathError returned from openHandler.
 	switch err.(type) {
 	case nil:
@@ -1305,6 +2098,34 @@ func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileM
 	return f, err
 }
 
-func (r *Runner) stat(name string) (os.FileInfo, error) {
-	return os.Stat(r.absPath(name))
+// openNoClobber opens a file for writing like the ">" redirect does with the
+// noclobber option set. Existing regular files are never truncated; the O_EXCL
+// flag is used so that two shells cannot both create the same file.
+func (r *Runner) openNoClobber(ctx context.Context, path string) (io.ReadWriteCloser, error) {
+	f, err := r.open(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666, false)
+	if !os.IsExist(err) {
+		if _, ok := err.(*os.PathError); ok {
+			r.errf("%v\n", err)
+		}
+		return f, err
+	}
+	// Existing files which aren't regular, like /dev/null, can still be
+	// written to.
+	if f, err = r.open(ctx, path, os.O_WRONLY, 0, true); err != nil {
+		return nil, err
+	}
+	var info os.FileInfo
+	if st, ok := f.(interface{ Stat() (os.FileInfo, error) }); ok {
+		info, err = st.Stat()
+	} else {
+		info, err = r.stat(path)
+	}
+	if err == nil && info.Mode().IsRegular() {
+		f.Close()
+		r.errf("%s: cannot overwrite existing file\n", path)
+		return nil, &os.PathError{Op: "open", Path: path, Err: errNoClobber}
+	}
+	return f, nil
 }
+
+var errNoClobber = fmt.Errorf("cannot overwrite existing file")
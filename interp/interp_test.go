@@ -5,10 +5,12 @@ package interp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -267,6 +269,62 @@ var runTests = []runTest{
 	{"printf 'nofmt' 1 2 3", "nofmt"},
 	{"printf '%d_' 1 2 3", "1_2_3_"},
 	{"printf '%02d %02d\n' 1 2 3", "01 02\n03 00\n"},
+	{"printf '%.2f' 3.14159", "3.14"},
+	{
+		"printf '[%5.2f] [%e] [%E] [%g] [%G] [%f]' 3.14159 1234.5 0.000123 100000 1e-10 2",
+		"[ 3.14] [1.234500e+03] [1.230000E-04] [100000] [1E-10] [2.000000]",
+	},
+	{"printf '%g %g %.3g %#g' 1234567 0.00001 3.14159 1", "1.23457e+06 1e-05 3.14 1.00000"},
+	{"printf '%f %F %e %5.1f|' inf -inf nan inf", "inf -INF nan   inf|"},
+	{"printf '%X %#x %#o' 255 255 8", "FF 0xff 010"},
+	{"printf '%d,' \"'A\" '\"B' '' ' 12' 0x1f", "65,66,0,12,31,"},
+	{
+		"printf '%u %d' 99999999999999999999 -99999999999999999999",
+		"printf: warning: 99999999999999999999: Numerical result out of range\nprintf: warning: -99999999999999999999: Numerical result out of range\n18446744073709551615 -9223372036854775808 #JUSTERR",
+	},
+	{"printf '%u' -99999999999999999999 2>/dev/null", "18446744073709551615"},
+	{"printf '%f' 1e99999 2>/dev/null; echo $?", "inf0\n"},
+	{
+		"printf '%d|' abc 12abc '12 '",
+		"printf: abc: invalid number\nprintf: 12abc: invalid number\nprintf: 12 : invalid number\n0|12|12|exit status 1 #JUSTERR",
+	},
+	{"printf '%f' abc", "printf: abc: invalid number\n0.000000exit status 1 #JUSTERR"},
+	{"printf '%i' 3.5", "printf: 3.5: invalid number\n3exit status 1 #JUSTERR"},
+	{"printf '[%q] [%q] [%q]' 'a b' '' \"it's\"", "[a\\ b] [''] [it\\'s]"},
+	{"printf '%q ' '~a' 'a=~b' 'b~' '#c' 'c#' 'd,e'", "\\~a a=\\~b b~ \\#c c# d\\,e "},
+	{"printf '%q' $'a\\tb'", "$'a\\tb'"},
+	{`printf '%b|%b|%b|%b' 'a\tb' '\0101' '\101' '\x41'`, "a\tb|A|A|A"},
+	{`printf '%b' 'a\cb' c; echo`, "a\n"},
+	{`printf '%s %b' x 'a\cb'; printf '%s' y`, "x ay"},
+	{
+		"printf '[%*d] [%-*d] [%.*f] [%*s] [%.*s]' 5 3 5 3 2 3.14159 -4 ab -1 abc",
+		"[    3] [3    ] [3.14] [ab  ] [abc]",
+	},
+	{"printf '%5c|%-3c|' x y", "    x|y  |"},
+	{"printf '%.3s|%-5s|%5s|' abcdef ab ab", "abc|ab   |   ab|"},
+	{"printf '%+d % d %05d %-5d| %+.2f' 5 5 5 5 2", "+5  5 00005 5    | +2.00"},
+	{"printf '%5%'", "invalid format char: %\nexit status 1 #JUSTERR"},
+	{"printf -v v '%s-%s' a b; echo \"$v\"", "a-b\n"},
+	{"printf -v v '%s' a b c; echo \"$v\"", "abc\n"},
+	{"printf -v 'a[1]' x; printf -v 'a[1-1]' y; echo \"${a[@]}\"", "y x\n"},
+	{"declare -A m; printf -v 'm[k y]' z; echo \"${m[@]}\"", "z\n"},
+	{"printf -v 1a x", "printf: `1a': not a valid identifier\nexit status 2 #JUSTERR"},
+	{"readonly ro; printf -v ro x", "ro: readonly variable\nexit status 1 #JUSTERR"},
+	{"printf -- '%s' -x", "-x"},
+	{
+		"TZ=UTC printf '%(%F %T %a %b %j %Z %z %e %k %l %p %I %D %R %y %C %u %w %U %W %V %G %g %h)T' 86400",
+		"1970-01-02 00:00:00 Fri Jan 002 UTC +0000  2  0 12 AM 12 01/02/70 00:00 70 19 5 5 00 00 01 1970 70 Jan",
+	},
+	{
+		"TZ=UTC printf '%(%s)T|%()T|%10(%Y)T|%-10(%y)T|%.2(%Y)T' 0 0 0 0 0",
+		"0|00:00:00|      1970|70        |19",
+	},
+	{
+		"TZ=UTC printf '%(%c|%x|%X|%r|%-d|%_H|%^a|%%|%Q)T' 1000000000",
+		"Sun Sep  9 01:46:40 2001|09/09/01|01:46:40|01:46:40 AM|9| 1|SUN|%|%Q",
+	},
+	{"[[ $(printf '%(%Y)T') == $(printf '%(%Y)T' -1) ]]", ""},
+	{"printf '%(%Y)T' x", "printf: x: invalid number\n1970exit status 1 #JUSTERR"},
 
 	// words and quotes
 	{"echo  foo ", "foo\n"},
@@ -345,6 +403,14 @@ var runTests = []runTest{
 	{"for i in 1 2; do\necho $LINENO\necho $LINENO\ndone", "2\n3\n2\n3\n"},
 	{"[[ -n $$ && $$ -gt 0 ]]", ""},
 	{"[[ $$ -eq $PPID ]]", "exit status 1"},
+	{"[[ $BASHPID -eq $$ ]]", ""},
+	{"echo a b; echo $_; x=1; echo \"[$_]\"", "a b\nb\n[]\n"},
+	{"f() { echo in; }; f z; echo $_", "in\nz\n"},
+	{"[[ $RANDOM -ge 0 && $RANDOM -lt 32768 && $SRANDOM -ge 0 ]]", ""},
+	{"RANDOM=3; a=$RANDOM; RANDOM=3; [[ $a == $RANDOM ]] && echo same", "same\n"},
+	{"SECONDS=5; echo $SECONDS; declare -p SECONDS", "5\ndeclare -i SECONDS=\"5\"\n"},
+	{"[[ $EPOCHREALTIME =~ ^[0-9]+\\.[0-9]{6}$ && $EPOCHSECONDS -gt 1500000000 ]]", ""},
+	{"$ENV_PROG | grep '^SHLVL=' | wc -l", "1\n"},
 
 	// var manipulation
 	{"echo ${#a} ${#a[@]}", "0 0\n"},
@@ -491,10 +557,47 @@ var runTests = []runTest{
 		`a='b  c'; eval "echo -n ${a} ${a@Q}"`,
 		`b c b  c`,
 	},
+	{
+		`a="it's"; b=$'x\ty'; c=; echo ${a@Q} ${b@Q} ${c@Q} ${d@Q}`,
+		`'it'\''s' $'x\ty' ''` + "\n",
+	},
+	{`a=(1 'b c'); echo ${a[@]@Q}`, "'1' 'b c'\n"},
 	{
 		`a='"\n'; printf "%s %s" "${a}" "${a@E}"`,
 		"\"\\n \"\n",
 	},
+	{
+		`x="it's"; declare -x y=1; echo "${x@A}" "${y@A}"`,
+		"x='it'\\''s' declare -x y='1'\n",
+	},
+	{
+		`a=(1 "b c"); echo "${a[@]@A}"; echo "${a@A}" "${a[1]@A}"`,
+		"declare -a a=([0]=\"1\" [1]=\"b c\")\ndeclare -a a='1' declare -a a='b c'\n",
+	},
+	{
+		`declare -i e; echo "${e@A}|${u@A}|"`,
+		"declare -i e||\n",
+	},
+	{
+		`declare -ir n=3; a=(x y); echo "${n@a}" "${a[@]@a}" "${u@a}|"`,
+		"ir a a |\n",
+	},
+	{
+		`a=(xa y); echo ${a[@]#x}; echo ${a[@]}`,
+		"a y\nxa y\n",
+	},
+	{
+		`declare -A m=([a]=1 [b]=2); echo ${#m[@]}`,
+		"2\n",
+	},
+	{
+		`x=foo; p='\w-\W $x $(echo sub) \\ \101 \q \[\]"'; HOME=/h PWD=/h/a/b; echo "${p@P}"`,
+		"~/a/b-b foo sub \\ A \\q \"\n",
+	},
+	{
+		`p='a\nb'; HOME=/h PWD=/h; q='\w \W'; echo "${p@P}" "${q@P}"`,
+		"a\nb ~ ~\n",
+	},
 
 	// if
 	{
@@ -599,6 +702,30 @@ var runTests = []runTest{
 		"for ((i=0; i<3; i++)); do echo $i; done",
 		"0\n1\n2\n",
 	},
+	{
+		"select x in a 'b c' d; do echo \"x=[$x] R=[$REPLY]\"; done <<EOF\n2\n\nfoo\n1\nEOF\necho end $?",
+		"1) a\n2) b c\n3) d\n#? x=[b c] R=[2]\n#? 1) a\n2) b c\n3) d\n#? x=[] R=[foo]\n#? x=[a] R=[1]\n#? \nend 1\n",
+	},
+	{
+		"echo 1 | { PS3='pick: '; select x in a b; do echo $x; break; done; echo $?; }",
+		"1) a\n2) b\npick: a\n0\n",
+	},
+	{
+		"set -- p q; echo ' 2 ' | { select x; do echo \"[$x][$REPLY]\"; break; done; }",
+		"1) p\n2) q\n#? [q][ 2 ]\n",
+	},
+	{
+		"select x in 1 2 3 4 5 6 7 8 9 10 11 12; do :; done </dev/null",
+		"1) 1\t 3) 3\t 5) 5\t 7) 7\t 9) 9\t11) 11\n2) 2\t 4) 4\t 6) 6\t 8) 8\t10) 10\t12) 12\n#? \nexit status 1",
+	},
+	{
+		"COLUMNS=20; select x in aa bb cc dd ee ff gg; do :; done </dev/null",
+		"1) aa  5) ee\n2) bb  6) ff\n3) cc  7) gg\n4) dd\n#? \nexit status 1",
+	},
+	{
+		"echo 1 | { select x in a b; do echo $x; exit 3; done; }",
+		"1) a\n2) b\n#? a\nexit status 3",
+	},
 	// TODO: uncomment once expandEnv.Set starts returning errors
 	// {
 	// 	"readonly i; for ((i=0; i<3; i++)); do echo $i; done",
@@ -912,6 +1039,36 @@ var runTests = []runTest{
 		"exec >/dev/null; echo foo",
 		"",
 	},
+	{"exec >f; echo foo; echo bar >g; echo baz; exec >&2; cat f g", "foo\nbaz\nbar\n"},
+	{"exec 3>f; echo a >&3; echo b 1>&3; exec 3>&-; cat f", "a\nb\n"},
+	{"echo x 3>f >&3; cat f", "x\n"},
+	{"{ echo y >&3; } 3>f; cat f; echo z >&3", "y\n3: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo foo 2>&3", "3: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo foo 2>&bar", "bar: ambiguous redirect\nexit status 1 #JUSTERR"},
+	{
+		"exec 4>f; echo one >&4; exec 5>&4; exec 4>&-; echo two >&5; exec 5>&-; cat f",
+		"one\ntwo\n",
+	},
+	{
+		"printf 'l1\\nl2\\n' >f; exec 6<f; read -u 6 a; read b <&6; echo $a $b; exec 6<&-; read -u 6 c",
+		"l1 l2\nread: 6: invalid file descriptor: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo hello >f; exec 7<>f; read -u 7 a; echo $a; echo world >&7; exec 7>&-; cat f",
+		"hello\nhello\nworld\n",
+	},
+	{"echo foo <>f; cat f", "foo\n"},
+	{"exec {fd}>f; echo $fd; echo v >&$fd; exec {fd}>&-; cat f; echo w >&$fd", "10\nv\n10: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo w {fd}>f; echo $fd; echo q >&$fd; cat f", "w\n10\nq\n"},
+	{"exec {a}>f {b}>g; echo $a $b", "10 11\n"},
+	{"exec 3>f; { echo m >&4; } 4>&3-; echo n >&3; cat f", "m\nn\n #IGNORE bash doesn't restore a moved fd"},
+	{"exec 3>f; (exec 3>&-; echo gone >&3); echo in >&3; cat f", "3: bad file descriptor\nin\n #JUSTERR"},
+	{"exec 5>f; { echo b >&5; } 5>&-; echo c >&5; cat f", "5: bad file descriptor\nc\n #JUSTERR"},
+	{"exec 5>f; { exec 5>&-; }; echo c >&5; cat f", "5: bad file descriptor\n #JUSTERR"},
+	{"echo foo >&/dev/null", ""},
+	{"exec 3>&1 >/dev/null; echo foo >&3; echo bar", "foo\n"},
+	{"exec 3<<<foo; read -u 3 a; echo $a", "foo\n"},
+	{"exec 3>f; $PATH_PROG -c 'echo ext >&3'; cat f", "ext\n"},
 
 	// return
 	{"return", "return: can only be done from a func or sourced script\nexit status 1 #JUSTERR"},
@@ -1103,6 +1260,194 @@ var runTests = []runTest{
 		"f() { echo 1; }; { sleep 0.01s; f; } & f() { echo 2; }; wait",
 		"1\n",
 	},
+	{`echo "[$!]"`, "[]\n"},
+	{"true & [[ $! -gt $$ ]]", ""},
+	{"true & pid=$!; (echo $!) | grep -q $pid", ""},
+	{"{ exit 3; } & wait $!; echo $?", "3\n"},
+	{"{ exit 3; } & wait %1; echo $?", "3\n"},
+	{"{ exit 3; } & { exit 4; } & wait %1 %2; echo $?", "4\n"},
+	{"{ exit 3; } & wait; echo $?", "0\n"},
+	{"{ exit 3; } & wait $!; wait $!; echo $?", "3\n"},
+	{"wait %1; echo $?", "wait: %1: no such job\n127\n #JUSTERR"},
+	{"wait 1; echo $?", "wait: pid 1 is not a child of this shell\n127\n #JUSTERR"},
+	{"wait foo; echo $?", "wait: `foo': not a pid or valid job spec\n1\n #JUSTERR"},
+	{
+		"{ sleep 0.05s; exit 4; } & { exit 5; } & wait -n; echo $?; wait -n; echo $?; wait -n; echo $?",
+		"5\n4\n127\n",
+	},
+	{"{ exit 2; } & pid=$!; wait -n -p got; [[ $got == $pid ]]", ""},
+	{"sleep 1s & jobs", "[1]+  Running                 sleep 1s &\n"},
+	{
+		"sleep 1s & { sleep 1s; echo a; } & jobs",
+		"[1]-  Running                 sleep 1s &\n[2]+  Running                 {\n\tsleep 1s\n\techo a\n} &\n #IGNORE bash prints the source as written",
+	},
+	{"sleep 1s & jobs -p | grep -q $!", ""},
+	{"sleep 1s & jobs -l >f; grep -q \" $! Running\" <f", ""},
+	{
+		"{ exit 3; } & sleep 1s & wait %1; true & wait %3; jobs",
+		"[2]+  Running                 sleep 1s &\n",
+	},
+	{
+		"true & false & wait -n; wait -n; jobs; sleep 1s & jobs",
+		"[1]+  Running                 sleep 1s &\n",
+	},
+	{
+		"{ exit 3; } & sleep 0.05s; jobs; jobs",
+		"[1]+  Exit 3                  { exit 3; }\n",
+	},
+	{"true & sleep 0.05s; jobs %1; jobs %1", "[1]+  Done                    true\njobs: %1: no such job\nexit status 1 #JUSTERR"},
+	{"sleep 1s & sleep 2s & jobs %-", "[1]-  Running                 sleep 1s &\n"},
+	{"sleep 1s & sleep 2s & jobs %sleep", "jobs: sleep: ambiguous job spec\njobs: %sleep: no such job\nexit status 1 #JUSTERR"},
+	{"sleep 1s & sleep 2s & kill %?sl", "kill: sl: ambiguous job spec\nexit status 1 #JUSTERR"},
+	{"sleep 1s & sleep 2s & jobs %?1", "[1]-  Running                 sleep 1s &\n"},
+	{"sleep 1s & jobs -r; jobs -y", "[1]+  Running                 sleep 1s &\njobs: -y: invalid option\nexit status 2 #JUSTERR"},
+	{"sleep 10s & kill %1; wait %1; echo $?", "143\n"},
+	{"sleep 10s & kill -9 $!; wait $!; echo $?", "137\n #IGNORE bash reports the killed job"},
+	{"true & p=$!; wait $p; kill -9 $p 2>/dev/null; echo $?", "1\n"},
+	{"sleep 10s & kill -s INT %1; wait; jobs", ""},
+	{"sleep 10s & kill -n 2 %1; wait %1; echo $?", "130\n #IGNORE bash background jobs may ignore SIGINT"},
+	{"sleep 10s & kill -KILL %1; kill -SIGKILL %1; wait %1; echo $?", "137\n #IGNORE bash reports the killed job"},
+	{"sleep 10s & kill -TERM %1; sleep 0.05s; jobs", "[1]+  Terminated              sleep 10s\n #IGNORE bash reports the killed job"},
+	{"{ sleep 0.05s; exit 3; } & kill -0 %1; kill -CONT %1; wait %1", "exit status 3"},
+	{"kill %1", "kill: %1: no such job\nexit status 1 #JUSTERR"},
+	{"kill -FOO %1", "kill: FOO: invalid signal specification\nexit status 1 #JUSTERR"},
+	{"kill foo", "kill: foo: arguments must be process or job IDs\nexit status 1 #JUSTERR"},
+	{
+		"kill",
+		"kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\nexit status 2 #JUSTERR",
+	},
+	{"kill -l 9 TERM 130", "KILL\n15\nINT\n"},
+	{"kill -l | grep -q SIGTERM", ""},
+	{"kill -0 $$", ""},
+	{"kill -0 -- $$ $PPID", ""},
+	{"sleep 10s & kill -TERM -- $!; wait $!; echo $?", "143\n"},
+	{"sleep 10s & kill -s 0 -- $!; echo $?; kill -n 15 -- %1; wait %1; echo $?", "0\n143\n"},
+	{"kill $$", "kill: (" + strconv.Itoa(os.Getpid()) + ") - Operation not permitted\nexit status 1 #IGNORE"},
+	{"kill 0", "kill: (0) - Operation not permitted\nexit status 1 #IGNORE"},
+	{"kill -9 -1", "kill: (-1) - Operation not permitted\nexit status 1 #IGNORE"},
+	{"sleep 1s & disown; jobs; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"sleep 1s & sleep 1s & disown %1; jobs", "[2]+  Running                 sleep 1s &\n"},
+	{"sleep 1s & sleep 1s & disown -a; jobs", ""},
+	{"disown %1", "disown: %1: no such job\nexit status 1 #JUSTERR"},
+	// Bash has no job control when it's not interactive, so fg and bg fail.
+	{"{ sleep 0.01s; exit 3; } & fg", "{\n\tsleep 0.01s\n\texit 3\n}\nexit status 3 #IGNORE"},
+	{"sleep 0.01s & fg %1; echo $?; jobs", "sleep 0.01s\n0\n #IGNORE"},
+	{"sleep 0.01s & bg", "bg: job 1 already in background\n #IGNORE"},
+	{"fg", "fg: current: no such job\nexit status 1 #JUSTERR"},
+	{"bg %2", "bg: %2: no such job\nexit status 1 #JUSTERR"},
+
+	// coprocesses
+	{
+		`coproc { read x; echo "got $x"; }; echo foo >&${COPROC[1]}; read y <&${COPROC[0]}; echo $y`,
+		"got foo\n",
+	},
+	{
+		`coproc FOO { read x; echo "$x"; }; echo ${#FOO[@]}; [[ $FOO_PID == $! ]]; echo bar >&${FOO[1]}; read y <&${FOO[0]}; echo $y`,
+		"2\nbar\n",
+	},
+	{
+		`coproc FOO { exit 3; }; wait $FOO_PID; echo $? ${FOO-unset} ${FOO_PID-unset}`,
+		"3 unset unset\n",
+	},
+	{
+		`coproc { echo a; echo b; }; fd=${COPROC[0]}; read x <&$fd; read y <&$fd; echo $x $y`,
+		"a b\n",
+	},
+	{
+		`coproc sleep 1s; jobs`,
+		"[1]+  Running                 coproc COPROC sleep 1s &\n",
+	},
+	{
+		`coproc cat; echo hi >&${COPROC[1]}; fd=${COPROC[1]}; exec {fd}>&-; read x <&${COPROC[0]}; echo $x`,
+		"hi\n",
+	},
+	{"echo foo >&12", "12: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"read x <&12", "12: bad file descriptor\nexit status 1 #JUSTERR"},
+	{"echo foo >&p; cat p", "foo\n"},
+	{"cat <&p", "p: ambiguous redirect\nexit status 1 #JUSTERR"},
+	{"print -p foo", "print: -p: no coprocess\nexit status 1 #JUSTERR"},
+
+	// trap
+	{"trap 'echo bye' EXIT; echo hi", "hi\nbye\n"},
+	{"trap 'echo bye' 0; false", "bye\nexit status 1"},
+	{"trap 'echo bye' EXIT; exit 3", "bye\nexit status 3"},
+	{"trap 'echo bye; exit 4' EXIT; exit 3", "bye\nexit status 4"},
+	{"trap 'echo bye' EXIT; trap - EXIT; echo hi", "hi\n"},
+	{"trap 'echo bye' EXIT; trap EXIT; echo hi", "hi\n"},
+	{"trap 'echo bye' EXIT; (echo in); echo out", "in\nout\nbye\n"},
+	{"(trap 'echo sub' EXIT; echo in); echo out", "in\nsub\nout\n"},
+	{"(trap 'echo sub' EXIT; exit 2); echo $?", "sub\n2\n"},
+	{"echo $(trap 'echo cs' EXIT; echo c)", "c cs\n"},
+	{"trap 'echo err $?' ERR; false; echo after", "err 1\nafter\n"},
+	{"trap 'echo err' ERR; false || true; ! false; if false; then :; fi", ""},
+	{"trap 'echo err' ERR; f() { false; echo in; }; f", "in\n"},
+	{"trap 'echo err' ERR; f() { false; }; f", "err\nexit status 1"},
+	{"set -E; trap 'echo err' ERR; f() { false; echo in; }; f", "err\nin\n"},
+	{"set -e; trap 'echo err' ERR; false; echo unreachable", "err\nexit status 1"},
+	{
+		`trap 'echo "dbg $BASH_COMMAND"' DEBUG; f() { echo x; }; f; a=1`,
+		"dbg f\nx\ndbg a=1\n",
+	},
+	{"trap 'echo ret' RETURN; f() { :; }; f", ""},
+	{"set -T; trap 'echo ret' RETURN; f() { :; }; f", "ret\n"},
+	{"trap 'echo ret' RETURN; echo : >a; . ./a", "ret\n"},
+	{"f() { trap 'echo ret' RETURN; return 3; }; f; echo $?", "ret\n3\n"},
+	{
+		"g() { trap 'echo ret' RETURN; }; f() { :; }; g; f; echo : >a; . ./a",
+		"ret\nret\n",
+	},
+	{
+		"trap 'echo a' EXIT INT; trap -p",
+		"trap -- 'echo a' EXIT\ntrap -- 'echo a' SIGINT\na\n",
+	},
+	{
+		`trap "echo 'a'" TERM; trap -p TERM; trap - TERM; trap`,
+		`trap -- 'echo '\''a'\''' SIGTERM` + "\n",
+	},
+	{"trap '' int; trap -p SIGINT", "trap -- '' SIGINT\n"},
+	{"trap true USR1; trap -p USR1", "trap -- 'true' SIGUSR1\n"},
+	{"trap $'echo \\t' USR1; trap -p USR1", "trap -- 'echo \t' SIGUSR1\n"},
+	{"trap 'echo a' int; trap 2; trap", ""},
+	{"trap 'echo a' EXIT; trap 0; trap", ""},
+	{
+		"trap 'echo a' FOO",
+		"trap: FOO: invalid signal specification\nexit status 1 #JUSTERR",
+	},
+	{
+		"trap -p FOO",
+		"trap: FOO: invalid signal specification\nexit status 1 #JUSTERR",
+	},
+	{"trap -l | grep -q 'SIGINT'", ""},
+
+	// xtrace
+	{"set -x; echo foo", "+ echo foo\nfoo\n"},
+	{
+		`set -x; a=1; b="x y" echo "$a" "it's" ""`,
+		"+ a=1\n+ b='x y'\n+ echo 1 'it'\\''s' ''\n1 it's \n",
+	},
+	{
+		"x=foo; set -x; [[ $x == f* && -n $x ]]",
+		"+ [[ foo == f* ]]\n+ [[ -n foo ]]\n",
+	},
+	{"set -x; [[ a == b && -n c ]]", "+ [[ a == b ]]\nexit status 1"},
+	{"set -x; (( 1 + 2 ))", "+ (( 1 + 2 ))\n #IGNORE bash prints the source as written"},
+	{"set -x; echo $(echo sub)", "++ echo sub\n+ echo sub\nsub\n"},
+	{"PS4='>> '; set -x; echo a", ">> echo a\na\n"},
+	{"PS4='>> '; set -x; echo $(echo a)", ">>> echo a\n>> echo a\na\n"},
+	{`PS4='$x '; x=1; set -x; echo a`, "1 echo a\na\n"},
+	{"PS4=; set -x; echo a", "echo a\na\n"},
+	{"PS4='$(echo x) '; set -x; echo a", "x echo a\na\n"},
+	{"f() { echo in; }; set -x; f", "+ f\n+ echo in\nin\n"},
+	{
+		`set -x; arr=(1 "2 3"); arr[1]=z`,
+		"+ arr=(1 \"2 3\")\n+ arr[1]=z\n",
+	},
+	{"set -x; declare -r c=3", "+ declare -r c=3\n"},
+	{"set -x; let a=2", "+ let a=2\n"},
+	{"set -x; echo a; set +x; echo b", "+ echo a\na\n+ set +x\nb\n"},
+	{"set -o xtrace; [[ -o xtrace ]]", "+ [[ -o xtrace ]]\n"},
+	{"set -x; echo $-", "+ echo x\nx\n #IGNORE bash has more options like h and B"},
+	{"set -e; echo $-", "e\n #IGNORE bash has more options like h and B"},
 
 	// bash test
 	{
@@ -1550,8 +1895,35 @@ var runTests = []runTest{
 	},
 	{
 		"a=b b=a; echo $(($a))",
-		"0\n #IGNORE",
-	},
+		"a: expression recursion level exceeded (error token is \"a\")\nexit status 1 #JUSTERR",
+	},
+	{"echo $((16#ff)) $((0x1F)) $((0X1f)) $((010)) $((0)) $((2#101))", "255 31 31 8 0 5\n"},
+	{"echo $((36#Z)) $((37#z)) $((37#A)) $((64#@_)) $((10#08))", "35 35 36 4031 8\n"},
+	{"echo $((09))", "09: value too great for base (error token is \"09\")\nexit status 1 #JUSTERR"},
+	{"echo $((2#12))", "2#12: value too great for base (error token is \"2#12\")\nexit status 1 #JUSTERR"},
+	{"echo $((12abc))", "12abc: value too great for base (error token is \"12abc\")\nexit status 1 #JUSTERR"},
+	{"echo $((65#1))", "65#1: invalid arithmetic base (error token is \"65#1\")\nexit status 1 #JUSTERR"},
+	{"echo $((16#))", "16#: invalid integer constant (error token is \"16#\")\nexit status 1 #JUSTERR"},
+	{"x=1+2; echo $((x*2)); y=x; echo $((y)) $((y+1))", "6\n3 4\n"},
+	{"x=' 3 '; y=; echo $((x+1)) $((y+1)) $((unset+1))", "4 1 1\n"},
+	{"x=0x10; y='x*2'; ((x++, y++)); echo $x $y", "17 35\n"},
+	{"x=3; ((x += 010)); echo $x", "11\n"},
+	{"echo $((1 << 65)) $((7 / -2)) $((-7 % 3))", "2 -3 -1\n"},
+	{"x=x; echo $((x))", "x: expression recursion level exceeded (error token is \"x\")\nexit status 1 #JUSTERR"},
+	{"x='abc!'; echo $((x))", "abc!: syntax error in expression (error token is \"!\")\nexit status 1 #JUSTERR"},
+	{"x='@'; echo $((x))", "@: syntax error: operand expected (error token is \"@\")\nexit status 1 #JUSTERR"},
+	{"echo $((1/0)); echo after", "1/0: division by 0 (error token is \"0\")\nexit status 1 #JUSTERR"},
+	{"x=$((5%0)); echo after", "5%0: division by 0 (error token is \"0\")\nexit status 1 #JUSTERR"},
+	{"echo $((2**-1))", "2**-1: exponent less than 0 (error token is \"-1\")\nexit status 1 #IGNORE bash prints 1"},
+	{"echo $(( 0 && 1/0 )) $(( 1 || 1/0 )) $(( 2 && 3 )) $(( 0 || 0 ))", "0 1 1 0\n"},
+	{"n=0; (( n > 0 && 10/n > 1 )); echo $?", "1\n"},
+	{"y=0; (( 0 && y++ )); (( 1 || y++ )); echo $y", "0\n"},
+	{"((1/0)); echo after $?", "((: 1/0: division by 0 (error token is \"0\")\nafter 1\n #JUSTERR"},
+	{"x=4; ((x/=0)); echo after $? $x", "((: x/=0: division by 0 (error token is \"0\")\nafter 1 4\n #JUSTERR"},
+	{"let 'x=1' '1/0' 'x=2'; echo after $? $x", "let: 1/0: division by 0 (error token is \"0\")\nafter 1 1\n #JUSTERR"},
+	{"for ((i=0; i<1/0; i++)); do :; done; echo after $?", "((: i<1/0: division by 0 (error token is \"0\")\nafter 1\n #JUSTERR"},
+	{"f() { echo $((1/0)); echo in; }; f; echo after", "1/0: division by 0 (error token is \"0\")\nexit status 1 #JUSTERR"},
+	{"declare -i x; x=1/0; echo after", "1/0: division by 0 (error token is \"0\")\nexit status 1 #JUSTERR"},
 
 	// set/shift
 	{
@@ -1634,6 +2006,18 @@ var runTests = []runTest{
 		"set -f; set +f; >a.x; echo *.x;",
 		"a.x\n",
 	},
+	{
+		"set -C; echo a >f && echo new; echo b >f; echo $?; cat f",
+		"new\nf: cannot overwrite existing file\n1\na\n #IGNORE",
+	},
+	{
+		"set -o noclobber; >f; echo b &>f; echo c >|f; echo d >>f; cat f",
+		"f: cannot overwrite existing file\nc\nd\n #IGNORE",
+	},
+	{
+		"set -C; echo a >/dev/null; [[ -o noclobber ]] && echo on; set +C; >f; echo b >f; cat f",
+		"on\nb\n",
+	},
 	{
 		"set -a; foo=bar; $ENV_PROG | grep ^foo=",
 		"foo=bar\n",
@@ -1669,10 +2053,14 @@ var runTests = []runTest{
 		"set -a; set +o",
 		`set -o allexport
 set +o errexit
+set +o errtrace
+set +o functrace
+set +o noclobber
 set +o noexec
 set +o noglob
 set +o nounset
 set +o pipefail
+set +o xtrace
  #IGNORE`,
 	},
 
@@ -1703,7 +2091,7 @@ set +o pipefail
 	},
 	{
 		"readonly a=1; echo $a; unset a; echo $a",
-		"1\na: readonly variable\n1\n #IGNORE",
+		"1\nunset: a: cannot unset: readonly variable\n1\n #IGNORE",
 	},
 	{
 		"f() { local a=1; echo $a; unset a; echo $a; }; f",
@@ -1733,6 +2121,33 @@ set +o pipefail
 	{"shopt -u -o noexec; echo foo", "foo\n"},
 	{"shopt -u globstar; shopt globstar | grep 'off$' | wc -l", "1\n"},
 	{"shopt -s globstar; shopt globstar | grep 'off$' | wc -l", "0\n"},
+	{"shopt -s nullglob; shopt nullglob dotglob; echo $?", "nullglob       \ton\ndotglob        \toff\n1\n"},
+	{"shopt -s nullglob; shopt -q nullglob && echo on; shopt -q nullglob dotglob || echo off", "on\noff\n"},
+	{"shopt -s failglob extglob; shopt -p failglob nocasematch; shopt -po noglob", "shopt -s failglob\nshopt -u nocasematch\nset +o noglob\nexit status 1"},
+	{"shopt -s dotglob nullglob; shopt -s", "dotglob        \ton\nnullglob       \ton\n #IGNORE bash has more options"},
+	{"set -o nullglob; shopt -p nullglob; set +o nullglob; shopt -p nullglob", "shopt -s nullglob\nshopt -u nullglob\nexit status 1 #IGNORE bash only sets its own options via shopt"},
+	{"shopt -x", "shopt: invalid option \"-x\"\nexit status 2 #JUSTERR"},
+	{
+		"shopt -s extglob\ncase aaab in +(a)b) echo yes;; esac; case foo.go in !(*.go)) echo no;; *) echo other;; esac",
+		"yes\nother\n",
+	},
+	{
+		"shopt -s extglob\n[[ foo == !(bar) ]] && echo a; [[ abc == a!(x)c ]] && echo b; [[ axc == a!(x)c ]] || echo c; [[ ab == @(a|b)+(b) ]] && echo d",
+		"a\nb\nc\nd\n",
+	},
+	{
+		"shopt -s extglob\nx=aaabc; echo ${x##+(a)} ${x%%?(b)c} ${x/@(b|c)/_}",
+		"bc aaa aaa_c\n",
+	},
+	{
+		"shopt -s extglob\nx=abc; echo ${x/!(b)/Z} ${x%!(c)} \"${x%%!(c)}\" ${x#!(a)} ${x^^!(b)} ${x^!(b)}; y=aXbXc; echo ${y//!(X)/-} ${y/a!(X)/-}",
+		"Z abc  abc AbC Abc\n- -\n",
+	},
+	{
+		"shopt -s nocasematch; case ABC in abc) echo a;; esac; [[ aBc == ab* ]] && echo b; x=ABC; echo ${x/b/z}",
+		"a\nb\nAzC\n",
+	},
+	{"case ABC in abc) echo a;; *) echo b;; esac", "b\n"},
 
 	// IFS
 	{`echo -n "$IFS"`, " \t\n"},
@@ -1793,6 +2208,44 @@ set +o pipefail
 		"bar\n",
 	},
 
+	// call stack
+	{
+		"f() { echo ${FUNCNAME[0]} ${FUNCNAME[1]} ${BASH_LINENO[0]}; }\ng() { f; }\ng\necho x${FUNCNAME[0]}",
+		"f g 2\nx\n",
+	},
+	{
+		"f() { echo ${#FUNCNAME[@]} ${FUNCNAME[*]} ${BASH_LINENO[*]}; }\ng() {\n\tf\n}\ng",
+		"3 f g main 3 5 0\n #IGNORE",
+	},
+	{
+		"echo 'echo ${BASH_SOURCE[0]} ${BASH_LINENO[0]}' >s.sh\nsource ./s.sh",
+		"./s.sh 2\n",
+	},
+	{
+		"echo 'echo ${FUNCNAME[0]} ${FUNCNAME[1]} ${BASH_LINENO[*]}' >s.sh\nf() { source ./s.sh; }\nf",
+		"source f 2 3 0\n #IGNORE",
+	},
+	{
+		"echo 'f() { echo ${BASH_SOURCE[0]} ${BASH_SOURCE[1]}; }' >s.sh\nsource ./s.sh\nf",
+		"./s.sh\n #IGNORE",
+	},
+	{
+		"f() { FUNCNAME=x; echo ${FUNCNAME[0]}; }; f",
+		"f\n",
+	},
+	{
+		"f() { caller; caller 0; caller 1; caller 2; echo $?; }\ng() {\n\tf\n}\ng",
+		"3 \n3 g \n5 main \n1\n #IGNORE",
+	},
+	{
+		"caller; echo $?; f() { (caller 0); echo $(caller 0); }; f",
+		"1\n1 main \n1 main\n #IGNORE",
+	},
+	{
+		"f() { caller x; }; f",
+		"caller: x: invalid number\ncaller: usage: caller [expr]\nexit status 2 #JUSTERR",
+	},
+
 	// indexed arrays
 	{
 		"a=foo; echo ${a[0]} ${a[@]} ${a[x]}; echo ${a[1]}",
@@ -1910,6 +2363,41 @@ set +o pipefail
 	{"i=3; declare a=(b); a[i]=x; echo ${!a[@]}", "0 3\n"},
 	{"i=3; declare -A a=(['x']=b); a[i]=x; for e in ${!a[@]}; do echo $e; done | sort", "i\nx\n"},
 
+	// sparse arrays
+	{"a=([2]=x [7]=y); echo ${#a[@]} ${!a[@]} ${a[@]}", "2 2 7 x y\n"},
+	{"a=([2]=x y [0]=z w); echo ${!a[@]} ${a[@]}", "0 1 2 3 z w x y\n"},
+	{"a[1000000]=x; a[5]=y; echo ${#a[@]} ${!a[*]}", "2 5 1000000\n"},
+	{"for i in 5 3 9 10; do a[i]=v$i; done; echo ${!a[@]} ${a[@]}", "3 5 9 10 v3 v5 v9 v10\n"},
+	{`a=([2]=x [7]=y); echo ${a[-1]} "<${a[-2]}>" ${a[-6]}`, "y <> x\n"},
+	{"a=(1 2); a[-1]=x; a[-2]+=y; echo ${a[@]}", "1y x\n"},
+	{"a=(1 2); a[-5]=x; echo ${a[@]}", "a[-5]: bad array subscript\n1 2\n #JUSTERR"},
+	{`a=(1 2); echo "<${a[-3]}>"; echo $?`, "a: bad array subscript\n<>\n0\n #JUSTERR"},
+	{"a=s; echo ${a[-1]}; echo next", "a: bad array subscript\n\nnext\n #JUSTERR"},
+	{"a=(1 2 3); unset 'a[1]'; echo ${#a[@]} ${!a[@]} ${a[@]}", "2 0 2 1 3\n"},
+	{"a=(1 2 3); unset 'a[-1]'; a+=(x); echo ${!a[@]} ${a[@]}", "0 1 2 1 2 x\n"},
+	{"a=(1 2 3); unset 'a[9]' 'a[0]'; echo ${!a[@]} ${a[@]}", "1 2 2 3\n"},
+	{"a=(1 2); unset 'a[-3]'", "unset: [-3]: bad array subscript\nexit status 1 #JUSTERR"},
+	{`a=(1 2); unset 'a[@]'; echo "${a-unset}"`, "unset\n"},
+	{`a=([1]=x); echo "${a-u}" "${a[1]-u}" "${a[2]-u}" "${a[@]-u}"`, "u x u x\n"},
+	{`declare -A m=([k]=v); echo "${m-u}" "${m[z]-u}" "${m[@]-u}"`, "u u v\n"},
+	{"a=(1 2); unset 'a[@]'; declare -p a", "declare -a a=()\n"},
+	{"declare -ai a=([3]=1); unset 'a[*]'; a+=(2); declare -p a", "declare -ai a=([0]=\"2\")\n"},
+	{"declare -A a=([x]=1 [@]=2); unset 'a[@]'; declare -p a", "declare -A a=([x]=\"1\" )\n"},
+	{"a=s; unset 'a[@]'; echo $? $a", "unset: a: not an array variable\n1 s\n #JUSTERR"},
+	{`a=x; unset 'a[0]'; echo "${a-unset}"`, "unset\n"},
+	{"declare -A a=([x]=1 [y]=2); unset 'a[x]'; echo ${!a[@]}", "y\n"},
+	{"a=([3]=x); echo \"<$a>\"; a+=s; echo ${!a[@]} ${a[@]}", "<>\n0 3 s x\n"},
+	{"a=([2]=x [7]=y); a+=(q [20]=r s); echo ${!a[@]} ${a[@]}", "2 7 8 20 21 x y q r s\n"},
+	{"a=(1 2 3); unset 'a[2]'; a+=([-1]=x y); echo ${!a[@]} ${a[@]}", "0 1 2 1 x y\n"},
+	{"a=(1 2); a+=([-5]=x y); echo ${a[@]}", "[-5]=x: bad array subscript\n1 2 y\n #JUSTERR"},
+	{"a=(1 2 3); (a[0]=x; unset 'a[1]'; a+=y); echo ${a[@]}", "1 2 3\n"},
+	{"declare -A a=([x]=1); (a[x]=2; a[y]=3; a+=z; unset 'a[x]'); echo ${!a[@]} ${a[@]}", "x 1\n"},
+	{"a=(1 2); { a[0]=x; unset 'a[1]'; } & a[1]=y; wait; echo ${a[@]}", "1 y\n"},
+	{"declare -A a=([x]=1); { a[x]=2; } & a[y]=3; wait; echo ${a[x]} ${a[y]}", "1 3\n"},
+	{"declare -A a=([x]=1); a+=([y]=2 [x]=3); echo ${!a[@]} ${a[x]}", "x y 3\n #IGNORE bash doesn't sort the keys"},
+	{"declare -A a=([0]=x); a+=y; a[k]+=z; a[k]+=w; echo ${!a[@]} ${a[@]}", "0 k xy zw\n"},
+	{"declare -A a=([x]=1); a+=(k1 v1 k2); echo ${!a[@]}; echo ${a[k1]}", "k1 k2 x\nv1\n #IGNORE bash doesn't sort the keys"},
+
 	// declare
 	{"declare -B foo", "declare: invalid option \"-B\"\nexit status 2 #JUSTERR"},
 	{"a=b; declare a; echo $a; declare a=; echo $a", "b\n\n"},
@@ -1924,6 +2412,48 @@ set +o pipefail
 	{"a='x=b y=c'; declare $a; echo $x $y", "b c\n"},
 	{"declare =bar", "declare: invalid name \"\"\nexit status 1 #JUSTERR"},
 	{"declare $unset=$unset", "declare: invalid name \"\"\nexit status 1 #JUSTERR"},
+	{"declare -i n=1+2; echo $n; n=n*5; echo $n; n+=1; echo $n", "3\n15\n16\n"},
+	{"declare -i n; n=2**3; declare +i n; n=2**3; echo $n", "2**3\n"},
+	{"declare -ai a=(1+1 2*3); a[5]=4-1; echo ${a[@]}", "2 6 3\n"},
+	{"declare -l a=ABC; echo $a; a+=Def; echo $a", "abc\nabcdef\n"},
+	{"declare -u a; a=abc; declare -l a; a=XyZ; echo $a", "xyz\n"},
+	{"a=ABC; declare -l a; echo $a; read a <<< DEF; echo $a", "ABC\ndef\n"},
+	{"f() { local x=1; read x <<< y; echo $x; }; f; echo \"<$x>\"", "y\n<>\n"},
+	{`declare -rxi a=1; declare -ltx b=A; declare -aru c=(x); declare -p a b c`,
+		"declare -irx a=\"1\"\ndeclare -txl b=\"a\"\ndeclare -aru c=([0]=\"X\")\n"},
+	{`a=$'x\ty' b='a"b$c\d'; declare -p a b`,
+		"declare -- a=$'x\\ty'\ndeclare -- b=\"a\\\"b\\$c\\\\d\"\n"},
+	{`declare -a a=([3]=x) b=(); declare -n r=a; declare -t t; declare -p a b r t`,
+		"declare -a a=([3]=\"x\")\ndeclare -a b=()\ndeclare -n r=\"a\"\ndeclare -t t\n"},
+	{`declare -A m=([k]=v ["a b"]=2); declare -p m`, "declare -A m=([\"a b\"]=\"2\" [k]=\"v\" )\n #IGNORE bash's key order is random"},
+	{`a=(1 "b c" [5]=$'x\ny'); declare -A m=(["a b"]='$x'); eval "$(declare -p a m)"; echo "${a[5]}" ${!a[@]} "${m["a b"]}"`,
+		"x\ny 0 1 5 $x\n"},
+	{"declare -p a", "declare: a: not found\nexit status 1 #JUSTERR"},
+	{"declare a; declare -p a; echo ${a-unset}; a=1; unset a; declare -p a", "declare -- a\nunset\ndeclare: a: not found\nexit status 1 #JUSTERR"},
+	{"declare -ix a; declare -p a; a=3; declare -p a", "declare -ix a\ndeclare -ix a=\"3\"\n"},
+	{"declare -A m; m[k]=z; m+=([w]=x); declare -p m", "declare -A m=([k]=\"z\" [w]=\"x\" )\n #IGNORE bash's key order is random"},
+	{"a=(1); declare -A a", "declare: a: cannot convert indexed to associative array\nexit status 1 #JUSTERR"},
+	{"a=x; declare -a a; declare -p a", "declare -a a=([0]=\"x\")\n"},
+	{"readonly a=1; declare +r a", "declare: a: readonly variable\nexit status 1 #JUSTERR"},
+	{"declare +a a=x; declare -p a", "declare -- a=\"x\"\n"},
+	{
+		"a=(1 2); declare +a a; declare -A m=([k]=v); declare +A m=x; declare -p a m",
+		"declare: a: cannot destroy array variables in this way\ndeclare: m: cannot destroy array variables in this way\ndeclare -a a=([0]=\"1\" [1]=\"2\")\ndeclare -A m=([k]=\"v\" )\n #JUSTERR",
+	},
+	{"INTERP_A=1; declare -i INTERP_B=2; declare -p | grep ' INTERP_[AB]='; declare -pi | grep ' INTERP_[AB]='", "declare -- INTERP_A=\"1\"\ndeclare -i INTERP_B=\"2\"\ndeclare -i INTERP_B=\"2\"\n"},
+	{"f() { local -i a=3+3; local b; local -p; }; f", "declare -i a=\"6\"\ndeclare -- b\n #IGNORE bash prints b without a value"},
+	{"typeset a=1; declare -p a", "declare -- a=\"1\"\n"},
+
+	// declare -f and -F
+	{"f() { echo hi; }; declare -f f", "f() { echo hi; }\n #IGNORE bash reformats functions"},
+	{"f() {\n\techo hi\n}; g() { :; }; declare -f", "f() {\n\techo hi\n}\ng() { :; }\n #IGNORE bash reformats functions"},
+	{"f() { :; }; g() { :; }; declare -F; declare -F g", "declare -f f\ndeclare -f g\ng\n"},
+	{"declare -f f", "exit status 1"},
+	{"declare -F f", "exit status 1"},
+	{"f() { echo in; }; declare -ft f; declare -F; trap 'echo dbg' DEBUG; f", "declare -ft f\ndbg\ndbg\nin\n #IGNORE bash also traps the function call"},
+	{"f() { :; }; unset -v f; declare -F; unset -f f; declare -F", "declare -f f\n"},
+	{"f() { :; }; f=1; unset -f f; echo $f; declare -F", "1\n"},
+	{"unset -x f", "unset: invalid option \"-x\"\nexit status 2 #JUSTERR"},
 
 	// export
 	{"declare foo=bar; $ENV_PROG | grep '^foo='", "exit status 1"},
@@ -1935,6 +2465,15 @@ set +o pipefail
 	{"export foo=(1 2); $ENV_PROG | grep '^foo='", "exit status 1"},
 	{"declare -A foo=([a]=b); export foo; $ENV_PROG | grep '^foo='", "exit status 1"},
 	{"export foo=(b c); foo=x; $ENV_PROG | grep '^foo='", "exit status 1"},
+	{"export foo; $ENV_PROG | grep '^foo='", "exit status 1"},
+	{"export foo; foo=bar; $ENV_PROG | grep '^foo='", "foo=bar\n"},
+	{"export foo=bar; read foo <<< baz; $ENV_PROG | grep '^foo='", "foo=baz\n"},
+	{"export foo=bar; export -n foo; $ENV_PROG | grep '^foo='", "exit status 1"},
+	{"export foo=bar; declare +x foo; $ENV_PROG | grep '^foo='", "exit status 1"},
+	{"export -n foo=bar; declare -p foo", "declare -- foo=\"bar\"\n"},
+	{"export INTERP_A=1; INTERP_B=2; export -p | grep ' INTERP_[AB]='; export | grep ' INTERP_[AB]='", "declare -x INTERP_A=\"1\"\ndeclare -x INTERP_A=\"1\"\n"},
+	{"readonly INTERP_A=1; INTERP_B=2; readonly -p | grep ' INTERP_[AB]='", "declare -r INTERP_A=\"1\"\n"},
+	{"export -x foo", "export: invalid option \"-x\"\nexit status 2 #JUSTERR"},
 
 	// local
 	{
@@ -2119,6 +2658,38 @@ set +o pipefail
 		"shopt -s globstar; mkdir -p a/b/c; echo **/c | sed 's@\\\\@/@g'",
 		"a/b/c\n",
 	},
+	{
+		"shopt -s nullglob; >a; echo x *.nope y; echo [ *; echo \"*.nope\"",
+		"x y\n[ a\n*.nope\n",
+	},
+	{
+		"shopt -s failglob; >a; echo *; echo *.nope; echo after",
+		"a\nno match: *.nope\nexit status 1 #JUSTERR",
+	},
+	{
+		"shopt -s dotglob; >.hidden >a; echo *; shopt -u dotglob; echo *",
+		".hidden a\na\n",
+	},
+	{
+		"shopt -s nocaseglob; >Foo >bar; echo f* B*; shopt -u nocaseglob; echo f*",
+		"Foo bar\nf*\n",
+	},
+	{
+		"mkdir d; >a.go >b.txt >.hidden >d/c.go; GLOBIGNORE='*.go:d/*'; echo * d/*; unset GLOBIGNORE; echo *",
+		".hidden b.txt d d/*\na.go b.txt d\n",
+	},
+	{
+		"shopt -s extglob\n>a.txt >b.txt >c.go >ab.txt; echo @(a|c).*; echo !(a).txt; echo +(a|b).txt; echo ?(c).go *(x)",
+		"a.txt c.go\nab.txt b.txt\na.txt ab.txt b.txt\nc.go *(x)\n",
+	},
+	{
+		"shopt -s extglob\nmkdir a; >a/x.go >a/y.sh; echo a/!(*.go) | sed 's@\\\\@/@g'",
+		"a/y.sh\n",
+	},
+	{
+		"shopt -s extglob\n>a.txt; echo '@(a).txt' \"!(a)\"*",
+		"@(a).txt !(a)*\n",
+	},
 	{
 		"cat <<EOF\n{foo,bar}\nEOF",
 		"{foo,bar}\n",
@@ -2195,6 +2766,33 @@ set +o pipefail
 	{"{ time echo -n; } |& wc", "      4       6      42\n"},
 	{"{ time -p; } |& wc", "      3       6      29\n"},
 	{"{ time -p echo -n; } |& wc", "      3       6      29\n"},
+	{"TIMEFORMAT='%0R %%'; { time; } 2>&1", "0 %\n"},
+	{"TIMEFORMAT='[%3lR]'; { time; } 2>&1 | wc -c", "11\n"},
+	{"TIMEFORMAT=; { time; } 2>&1", ""},
+	{"TIMEFORMAT='%0x'; { time; } 2>&1", "TIMEFORMAT: `x': invalid format character\n #JUSTERR"},
+	{"TIMEFORMAT='%l'; { time; } 2>&1", "TIMEFORMAT: `': invalid format character\n #JUSTERR"},
+	{"TIMEFORMAT='%R'; { time -p; } |& wc -l", "3\n"},
+	{"times | wc -l", "2\n"},
+
+	// umask
+	{"umask 027; umask", "0027\n"},
+	{"umask 022; umask -S", "u=rwx,g=rx,o=rx\n"},
+	{"umask u=rwx,g=rx,o=; umask; umask -p", "0027\numask 0027\n"},
+	{"umask 077; umask g+r,o+rx; umask", "0032\n"},
+	{"umask 022; umask -S a-w", "u=rx,g=rx,o=rx\n"},
+	{"umask 022; umask -pS", "umask -S u=rwx,g=rx,o=rx\n"},
+	{"umask 7777; umask; umask 022; umask -- -w; umask", "0777\n0222\n"},
+	{"umask 022; (umask 077); umask", "0022\n"},
+	{"umask 9", "umask: 9: octal number out of range\nexit status 1 #JUSTERR"},
+	{"umask u=q", "umask: `q': invalid symbolic mode character\nexit status 1 #JUSTERR"},
+	{"umask y=r", "umask: `y': invalid symbolic mode operator\nexit status 1 #JUSTERR"},
+	{
+		"umask -x",
+		"umask: -x: invalid option\numask: usage: umask [-p] [-S] [mode]\nexit status 2 #JUSTERR",
+	},
+	{"umask 027; >f; stat -c %a f", "640\n"},
+	{"umask 0; >f; stat -c %a f", "666\n"},
+	{"umask 0; >f; chmod 600 f; >f; >>f; stat -c %a f", "600\n"},
 
 	// exec
 	{"exec", ""},
@@ -2272,6 +2870,169 @@ set +o pipefail
 		"read -r a <<< '\\a\\b\\c'; echo $a",
 		"\\a\\b\\c\n",
 	},
+	{
+		"x=5; read x </dev/null; echo \"[$x] $?\"",
+		"[] 1\n",
+	},
+	{
+		"printf ab | { read x; echo \"[$x] $?\"; }",
+		"[ab] 1\n",
+	},
+	{
+		"printf 'a\\\\\nb\\n' | { read x; echo \"[$x]\"; }",
+		"[ab]\n",
+	},
+	{
+		"read -a arr <<< ' a b  c '; echo ${#arr[@]} ${arr[2]}",
+		"3 c\n",
+	},
+	{
+		"read -ra arr <<< 'a\\b c'; echo ${arr[0]}",
+		"a\\b\n",
+	},
+	{
+		"printf 'a,b;c' | { read -d ';' x; read y; echo \"[$x] [$y] $?\"; }",
+		"[a,b] [c] 1\n",
+	},
+	{
+		"printf 'a b c' | { read -d '' -a arr; echo ${arr[1]}; }",
+		"b\n",
+	},
+	{
+		"printf 'a b\\nc d' | { read -n 5 x y; echo \"[$x][$y]\"; }",
+		"[a][b]\n",
+	},
+	{
+		"printf 'a b\\nc d' | { read -N 5 x y; echo \"[$x][$y]\"; }",
+		"[a b\nc][]\n",
+	},
+	{
+		"printf '  a  b  ' | { read -N8; echo \"[$REPLY]\"; }",
+		"[  a  b  ]\n",
+	},
+	{
+		"printf 'a\\\\bc' | { read -N 2 x; echo \"[$x]\"; }",
+		"[ab]\n",
+	},
+	{
+		"read -n 0 x <<< foo; echo \"[$x] $?\"",
+		"[] 0\n",
+	},
+	{
+		"read -s x <<< foo; echo $x",
+		"foo\n",
+	},
+	{
+		"read -e -i def x <<< foo; echo $x",
+		"foo\n",
+	},
+	{
+		"sleep 0.2s | { read -t 0.05 x; echo $?; }",
+		"142\n",
+	},
+	{
+		"{ printf ab; sleep 0.2s; } | { read -t 0.05 x; echo \"$? [$x]\"; }",
+		"142 [ab]\n",
+	},
+	{
+		"{ printf ab; sleep 0.1s; echo c; } | { read -t 0.05 x; read y; echo \"$x $y\"; }",
+		"ab c\n",
+	},
+	{
+		"read -t 0 <<< foo",
+		"",
+	},
+	{
+		"read -n",
+		"read: -n: option requires an argument\nexit status 2 #JUSTERR",
+	},
+	{
+		"read -n x",
+		"read: x: invalid number\nexit status 1 #JUSTERR",
+	},
+	{
+		"read -t x",
+		"read: x: invalid timeout specification\nexit status 1 #JUSTERR",
+	},
+	{
+		"read -a 0ab",
+		"read: invalid identifier \"0ab\"\nexit status 2 #JUSTERR",
+	},
+	{
+		"read -d, -r x <<< 'a\\b,c'; echo $x",
+		"a\\b\n",
+	},
+	{
+		"read -d',' -- x <<< 'a,b'; echo $x",
+		"a\n",
+	},
+
+	// mapfile
+	{
+		"printf 'a\\nb\\n' | { mapfile; echo ${#MAPFILE[@]}; printf '[%s]' \"${MAPFILE[@]}\"; }",
+		"2\n[a\n][b\n]",
+	},
+	{
+		"printf 'a\\nb\\nc\\nd\\n' | { mapfile -s 1 -n 2 -t arr; echo ${arr[@]}; }",
+		"b c\n",
+	},
+	{
+		"printf 'a\\nb\\nc\\n' | { arr=(x y z w); mapfile -t -O 1 arr; echo ${arr[@]}; }",
+		"x a b c\n",
+	},
+	{
+		"printf 'a\\nb\\nc\\n' | { arr=(x y z w); mapfile -t arr; echo ${arr[@]}; }",
+		"a b c\n",
+	},
+	{
+		"printf 'a\\nb\\nc\\n' | { mapfile -t -O 2 arr; echo ${#arr[@]} ${arr[2]}; }",
+		"3 a\n",
+	},
+	{
+		"printf 'a;b;c' | { readarray -d ';' -t; echo ${MAPFILE[@]}; }",
+		"a b c\n",
+	},
+	{
+		"printf 'a\\nb\\nc\\nd\\n' | { mapfile -t -C 'echo cb' -c 2 arr; echo ${arr[@]}; }",
+		"cb 1 b\ncb 3 d\na b c d\n",
+	},
+	{
+		"printf 'a\\nb\\n' | { mapfile -t -C 'cb() { echo ${#arr[@]} $2; }; cb' -c1 arr; }",
+		"0 a\n1 b\n",
+	},
+	{
+		"exec 3<<<'x'; mapfile -u 3 -t; echo $MAPFILE",
+		"x\n",
+	},
+	{"mapfile </dev/null; echo ${#MAPFILE[@]}", "0\n"},
+	{
+		"mapfile -x",
+		"mapfile: invalid option \"-x\"\nexit status 2 #JUSTERR",
+	},
+	{
+		"mapfile -n x",
+		"mapfile: x: invalid line count\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -O -1",
+		"mapfile: -1: invalid array origin\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -c 0",
+		"mapfile: 0: invalid callback quantum\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile -u 9",
+		"mapfile: 9: invalid file descriptor: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+	{
+		"mapfile 1a",
+		"mapfile: invalid identifier \"1a\"\nexit status 1 #JUSTERR",
+	},
+	{
+		"readonly ro; mapfile ro </dev/null",
+		"ro: readonly variable\nexit status 1 #JUSTERR",
+	},
 	{
 		"IFS=: read a b c <<< '1:2:3'; echo $a; echo $b; echo $c",
 		"1\n2\n3\n",
@@ -2334,6 +3095,10 @@ set +o pipefail
 		"while getopts ab:c opt -c -b arg -a foo; do echo $opt $OPTARG $OPTIND; done",
 		"c 2\nb arg 4\na 5\n",
 	},
+	{
+		"while getopts ab:c opt -cbarg -a foo; do echo $opt $OPTARG $OPTIND; done",
+		"c 1\nb arg 2\na 3\n",
+	},
 	{
 		"while getopts abc opt -ba -c foo; do echo $opt $OPTARG $OPTIND; done",
 		"b 1\na 2\nc 3\n",
@@ -2501,7 +3266,7 @@ func init() {
 }
 
 // ln -s: wine doesn't implement symlinks; see https://bugs.winehq.org/show_bug.cgi?id=44948
-var skipOnWindows = regexp.MustCompile(`ln -s`)
+var skipOnWindows = regexp.MustCompile(`ln -s|PATH_PROG -c|stat -c`)
 
 func skipIfUnsupported(tb testing.TB, src string) {
 	switch {
@@ -2736,21 +3501,26 @@ var testBuiltinsMap = map[string]func(HandlerContext, []string) error{
 		}
 		return nil
 	},
-	"sleep": func(hc HandlerContext, args []string) error {
+}
+
+func testExecHandler(ctx context.Context, args []string) error {
+	if args[0] == "sleep" {
 		// Note that, unlike GNU sleep, we don't assume a default unit
-		// of seconds.
-		for _, arg := range args {
+		// of seconds. Like a real process, stop if the context is
+		// cancelled, such as when a job is killed.
+		for _, arg := range args[1:] {
 			d, err := time.ParseDuration(arg)
 			if err != nil {
 				return err
 			}
-			time.Sleep(d)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 		return nil
-	},
-}
-
-func testExecHandler(ctx context.Context, args []string) error {
+	}
 	if fn := testBuiltinsMap[args[0]]; fn != nil {
 		return fn(HandlerCtx(ctx), args[1:])
 	}
@@ -2817,6 +3587,7 @@ func TestRunnerRunConfirm(t *testing.T) {
 
 func TestRunnerOpts(t *testing.T) {
 	t.Parallel()
+	fixedNow := func() time.Time { return time.Unix(1600000000, 123456789) }
 	withPath := func(strs ...string) func(*Runner) error {
 		prefix := []string{
 			"PATH=" + os.Getenv("PATH"),
@@ -2901,6 +3672,67 @@ func TestRunnerOpts(t *testing.T) {
 			"set bar; echo $@",
 			"bar\n",
 		},
+		{
+			opts(Umask(0077)),
+			"umask; umask 0; umask",
+			"0077\n0000\n",
+		},
+		{
+			opts(Hermetic(fixedNow, rand.NewSource(1), 100, 99)),
+			"echo $RANDOM $RANDOM $SRANDOM; (echo $RANDOM)",
+			"6671 19911 4123679659\n15403\n",
+		},
+		{
+			opts(Hermetic(fixedNow, nil, 100, 99)),
+			"echo $$ $PPID $BASHPID; { echo $BASHPID; } & wait; echo $!",
+			"100 99 100\n101\n101\n",
+		},
+		{
+			// made up process IDs are never signalled, as they may
+			// belong to real processes, like this one
+			opts(Hermetic(fixedNow, nil, os.Getpid(), os.Getppid())),
+			"true & wait; kill -9 $! $$ $PPID 2>/dev/null; echo $?",
+			"1\n",
+		},
+		{
+			opts(Hermetic(fixedNow, nil, 0, 0)),
+			"echo $EPOCHSECONDS $EPOCHREALTIME $SECONDS; SECONDS=7; echo $SECONDS",
+			"1600000000 1600000000.123456 0\n7\n",
+		},
+		{
+			opts(Hermetic(fixedNow, nil, 0, 0)),
+			`p='\D{%s}'; echo "${p@P}"`,
+			"1600000000\n",
+		},
+		{
+			opts(Restricted(true)),
+			"cd /; pushd /; echo $?; PATH=/; unset SHELL; declare -p ENV; echo $(cd ..)",
+			"cd: restricted\npushd: restricted\n1\nPATH: readonly variable\n" +
+				"unset: SHELL: cannot unset: readonly variable\ndeclare -r ENV\ncd: restricted\n\n",
+		},
+		{
+			opts(Restricted(true)),
+			"/bin/true; command ./foo; exec true; source /dev/null; echo $?",
+			"/bin/true: restricted: cannot specify `/' in command names\n" +
+				"./foo: restricted: cannot specify `/' in command names\n" +
+				"exec: restricted\nsource: /dev/null: restricted\n1\n",
+		},
+		{
+			opts(Restricted(true)),
+			"f() { [[ $PATH != . ]] || echo unsafe; }; PATH=. f; declare -n ref=PATH; ref=.; echo $?; f",
+			"PATH: readonly variable\nPATH: readonly variable\n1\n",
+		},
+		{
+			opts(Restricted(true)),
+			"echo foo >f; echo bar >>f; echo baz &>f; echo $?; echo stderr >&2; echo ok 2>&1 </dev/null",
+			"f: restricted: cannot redirect output\nf: restricted: cannot redirect output\n" +
+				"f: restricted: cannot redirect output\n1\nstderr\nok\n",
+		},
+		{
+			opts(Restricted(false)),
+			"echo $(cd / && pwd)",
+			"/\n",
+		},
 	}
 	p := syntax.NewParser()
 	for i, c := range cases {
@@ -2965,6 +3797,127 @@ func TestRunnerContext(t *testing.T) {
 	}
 }
 
+func TestRunnerSignals(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		in, want string
+	}{
+		{"trap 'echo caught' INT; sendint; echo after", "caught\nafter\n"},
+		{"trap '' INT; sendint; echo after", "after\n"},
+		{"sendint; echo after", "exit status 130"},
+		{"trap 'echo bye' EXIT; sendint; echo after", "bye\nexit status 130"},
+		{"trap 'echo caught; exit 3' INT; sendint; echo after", "caught\nexit status 3"},
+		{"trap 'echo caught' INT; (sendint; echo after); echo out", "after\ncaught\nout\n"},
+	}
+	p := syntax.NewParser()
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file := parse(t, p, c.in)
+			signals := make(chan os.Signal, 1)
+			var cb concBuffer
+			r, _ := New(
+				StdIO(nil, &cb, &cb),
+				Signals(signals),
+				ExecHandler(func(ctx context.Context, args []string) error {
+					if args[0] == "sendint" {
+						signals <- os.Interrupt
+						return nil
+					}
+					return testExecHandler(ctx, args)
+				}),
+			)
+			ctx := context.Background()
+			if err := r.Run(ctx, file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != c.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					c.in, c.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerMksh(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		in, want string
+	}{
+		{"print foo bar", "foo bar\n"},
+		{`print 'a\tb'; print -r 'a\tb'`, "a\tb\na\\tb\n"},
+		{"print -n foo; print -- -n", "foo-n\n"},
+		{"print -R -n foo", "foo"},
+		{"print -u2 foo 2>/dev/null", ""},
+		{"print -x foo", "print: -x: unknown option\nexit status 1"},
+		{
+			`{ read x; echo "got $x"; } |& print -p foo; read -p y; echo $y`,
+			"got foo\n",
+		},
+		{
+			"{ read x; read y; echo $x$y; } |& echo a >&p; print -p b; read y <&p; echo $y",
+			"ab\n",
+		},
+		{"{ exit 3; } |& wait $!", "exit status 3"},
+		{"read -p", "read: -p: option requires an argument\nexit status 2"},
+	}
+	p := syntax.NewParser(syntax.Variant(syntax.LangMirBSDKorn))
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file := parse(t, p, c.in)
+			var cb concBuffer
+			r, _ := New(StdIO(nil, &cb, &cb),
+				OpenHandler(testOpenHandler),
+				ExecHandler(testExecHandler),
+			)
+			ctx := context.Background()
+			if err := r.Run(ctx, file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != c.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					c.in, c.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerReportUsage(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		in, want string
+	}{
+		{"TIMEFORMAT='%0U %0S'; time usage", "2 1\n"},
+		{"TIMEFORMAT='%1lU %1lS'; time (usage; usage)", "0m4.0s 0m2.0s\n"},
+		{"TIMEFORMAT='%0U'; time { usage | usage; }", "4\n"},
+		{"usage; times", "0m0.000s 0m0.000s\n0m2.000s 0m1.000s\n"},
+	}
+	p := syntax.NewParser()
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file := parse(t, p, c.in)
+			var cb concBuffer
+			r, _ := New(
+				StdIO(nil, &cb, &cb),
+				ExecHandler(func(ctx context.Context, args []string) error {
+					if args[0] == "usage" {
+						HandlerCtx(ctx).ReportUsage(2*time.Second, time.Second)
+						return nil
+					}
+					return testExecHandler(ctx, args)
+				}),
+			)
+			ctx := context.Background()
+			if err := r.Run(ctx, file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != c.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					c.in, c.want, got)
+			}
+		})
+	}
+}
+
 func TestRunnerAltNodes(t *testing.T) {
 	t.Parallel()
 	in := "echo foo"
@@ -2989,6 +3942,369 @@ func TestRunnerAltNodes(t *testing.T) {
 	}
 }
 
+func TestRunnerUnsupported(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in      string
+		pos     string
+		feature string
+	}{
+		{"[[ -N foo ]]; echo after", "1:4", "test operator -N"},
+		{"echo $([[ -G foo ]]); echo after", "1:11", "test operator -G"},
+		{"(true; [[ -O foo ]]); echo after", "1:11", "test operator -O"},
+		{"cat <([[ -N foo ]]); echo after", "1:10", "test operator -N"},
+	}
+	for _, tc := range tests {
+		file := parse(t, nil, tc.in)
+		var cb concBuffer
+		r, _ := New(StdIO(nil, &cb, &cb))
+		err := r.Run(context.Background(), file)
+		uerr, ok := err.(UnsupportedError)
+		if !ok {
+			t.Fatalf("want UnsupportedError in %q, got: %v", tc.in, err)
+		}
+		if got := uerr.Pos.String(); got != tc.pos {
+			t.Fatalf("wrong position in %q: want %s, got %s", tc.in, tc.pos, got)
+		}
+		if uerr.Feature != tc.feature {
+			t.Fatalf("wrong feature in %q: want %q, got %q", tc.in, tc.feature, uerr.Feature)
+		}
+		if got := cb.String(); got != "" {
+			t.Fatalf("program in %q should have stopped, got output: %q", tc.in, got)
+		}
+		if _, ok := IsExitStatus(err); ok {
+			t.Fatalf("unexpected exit status error in %q", tc.in)
+		}
+	}
+}
+
+func TestRunnerDebugger(t *testing.T) {
+	t.Parallel()
+	src := `f() {
+	echo in f
+	g
+}
+g() { echo in g; }
+x=1
+f
+x=2
+echo $x`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "script.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []DebugAction{
+		DebugNext,     // 1: f() {
+		DebugNext,     // 5: g() {
+		DebugStep,     // 6: x=1
+		DebugStep,     // 7: f
+		DebugNext,     // 2: echo in f
+		DebugFinish,   // 3: g
+		DebugContinue, // 8: x=2
+		DebugQuit,     // 9: echo $x, a breakpoint
+	}
+	var stops []string
+	var d *Debugger
+	d = NewDebugger(func(stop *DebugStop) DebugAction {
+		var funcs []string
+		for _, frame := range stop.Stack() {
+			funcs = append(funcs, fmt.Sprintf("%s:%d", frame.Func, frame.Line))
+		}
+		x, _ := stop.Expand("$x")
+		stops = append(stops, fmt.Sprintf("%s %s %q x=%s %s",
+			stop.Reason, stop.Filename, stop.Source(), x, strings.Join(funcs, ",")))
+		if len(stops) == 1 {
+			d.AddBreakpoint(Breakpoint{Filename: "script.sh", Line: 9})
+		}
+		action := actions[0]
+		actions = actions[1:]
+		return action
+	})
+	var cb concBuffer
+	r, _ := New(StdIO(nil, &cb, &cb), Debug(d))
+	err = r.Run(context.Background(), file)
+	if status, ok := IsExitStatus(err); !ok || status != 1 {
+		t.Fatalf("want exit status 1 after quitting, got: %v", err)
+	}
+	if got, want := cb.String(), "in f\nin g\n"; got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+	want := []string{
+		`step script.sh "f() {\n\techo in f\n\tg\n}" x= main:1`,
+		`step script.sh "g() { echo in g; }" x= main:5`,
+		`step script.sh "x=1" x= main:6`,
+		`step script.sh "f" x=1 main:7`,
+		`step script.sh "echo in f" x=1 f:2,main:7`,
+		`step script.sh "g" x=1 f:3,main:7`,
+		`step script.sh "x=2" x=1 main:8`,
+		`breakpoint script.sh "echo $x" x=2 main:9`,
+	}
+	if got, want := strings.Join(stops, "\n"), strings.Join(want, "\n"); got != want {
+		t.Fatalf("wrong stops:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	// function breakpoints stop at the first statement in the body
+	stops = nil
+	actions = []DebugAction{DebugContinue, DebugContinue}
+	d = NewDebugger(func(stop *DebugStop) DebugAction {
+		stops = append(stops, stop.Reason+" "+stop.Source())
+		action := actions[0]
+		actions = actions[1:]
+		return action
+	})
+	d.AddBreakpoint(Breakpoint{Func: "g"})
+	r, _ = New(StdIO(nil, &cb, &cb), Debug(d))
+	r.Run(context.Background(), file)
+	want = []string{"step f() {", "function g echo in g"}
+	for i, stop := range stops {
+		stops[i] = strings.SplitN(stop, "\n", 2)[0]
+	}
+	if got, want := strings.Join(stops, "\n"), strings.Join(want, "\n"); got != want {
+		t.Fatalf("wrong stops:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	// a Runner still stops while another one sharing the debugger is
+	// stopped
+	stops = nil
+	var r2 *Runner
+	d = NewDebugger(func(stop *DebugStop) DebugAction {
+		stops = append(stops, stop.Source())
+		if len(stops) == 1 {
+			r2.Run(context.Background(), parse(t, nil, "echo b"))
+		}
+		return DebugContinue
+	})
+	r, _ = New(StdIO(nil, &cb, &cb), Debug(d))
+	r2, _ = New(StdIO(nil, &cb, &cb), Debug(d))
+	r.Run(context.Background(), parse(t, nil, "echo a"))
+	if got, want := strings.Join(stops, " "), "echo a echo b"; got != want {
+		t.Fatalf("wrong stops: want %q, got %q", want, got)
+	}
+}
+
+func TestRunnerCoverage(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "interp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := "greet() {\n\techo hi $1\n}\nunused() { echo never; }\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.sh"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `. ./lib.sh
+if true; then
+	greet a
+else
+	echo no
+fi
+for x in a b; do
+	case $x in
+	a) echo A ;;
+	esac
+done
+false || echo or`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "script.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCoverage()
+	var cb concBuffer
+	r, _ := New(StdIO(nil, &cb, &cb), Dir(dir), Cover(c))
+	r.Run(context.Background(), file)
+	if got, want := cb.String(), "hi a\nA\nor\n"; got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	var buf bytes.Buffer
+	if err := c.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:script.sh
+BRDA:2,0,0,1
+BRDA:2,0,1,0
+BRDA:8,1,0,1
+BRDA:8,1,1,1
+BRDA:12,2,0,1
+BRDA:12,2,1,0
+BRF:6
+BRH:4
+DA:1,1
+DA:2,1
+DA:3,1
+DA:5,0
+DA:7,1
+DA:8,2
+DA:9,1
+DA:12,1
+LF:8
+LH:7
+end_of_record
+TN:
+SF:./lib.sh
+BRF:0
+BRH:0
+DA:1,1
+DA:2,1
+DA:4,1
+LF:3
+LH:3
+end_of_record
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong LCOV report:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	buf.Reset()
+	if err := c.WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	wantPrefix := "mode: count\nscript.sh:1.1,1.11 1 1\nscript.sh:2.1,6.3 1 1\n"
+	if got := buf.String(); !strings.HasPrefix(got, wantPrefix) {
+		t.Fatalf("wrong profile:\nwant prefix:\n%s\ngot:\n%s", wantPrefix, got)
+	}
+	if got, want := strings.Count(buf.String(), "\n"), 1+11+6; got != want {
+		t.Fatalf("wrong number of profile lines: want %d, got %d", want, got)
+	}
+
+	buf.Reset()
+	if err := c.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// script.sh isn't on disk, so it's omitted
+		`<option value="file0">./lib.sh (66.7%)</option>`,
+		// the function was declared, even if it never ran
+		`<span class="cov"><span class="num">4</span><span class="count">1</span>unused() { echo never; }</span>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("HTML report does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunnerCoverageFS(t *testing.T) {
+	t.Parallel()
+	src := "trap true EXIT\n. lib.sh\neval greet\n"
+	fs := memFS{
+		"/":        new(bytes.Buffer),
+		"/main.sh": bytes.NewBufferString(src),
+		"/lib.sh":  bytes.NewBufferString("greet() {\n\techo hi\n}\n"),
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "main.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCoverage()
+	var cb concBuffer
+	r, _ := New(StdIO(nil, &cb, &cb), Dir("/"), FS(fs), Cover(c))
+	r.Run(context.Background(), file)
+	// programs without a name aren't covered
+	file, err = syntax.NewParser().Parse(strings.NewReader("echo unnamed"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Run(context.Background(), file)
+	if got, want := cb.String(), "hi\nunnamed\n"; got != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	var buf bytes.Buffer
+	if err := c.WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// the statements run via trap and eval are not counted
+	want := `mode: count
+main.sh:1.1,1.15 1 1
+main.sh:2.1,2.9 1 1
+main.sh:3.1,3.11 1 1
+lib.sh:1.1,3.2 1 1
+lib.sh:1.9,3.2 1 1
+lib.sh:2.2,2.9 1 1
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong profile:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	buf.Reset()
+	if err := c.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<option value="file0">main.sh (100.0%)</option>`,
+		`<option value="file1">lib.sh (100.0%)</option>`,
+		`<span class="cov"><span class="num">3</span><span class="count">1</span>eval greet</span>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("HTML report does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunnerProfiler(t *testing.T) {
+	t.Parallel()
+	src := `work() {
+	sleep 1
+	true
+}
+work
+for i in 1 2; do work; done`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "prof.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a clock which advances by a millisecond each time it's read
+	var now time.Time
+	clock := func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	p := NewProfiler()
+	r, _ := New(
+		Hermetic(clock, nil, 0, 0),
+		ExecHandler(func(ctx context.Context, args []string) error { return nil }),
+		Profile(p),
+	)
+	r.Run(context.Background(), file)
+
+	var buf bytes.Buffer
+	if err := p.WriteReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `   flat  flat%    cum   cum% calls
+ 0.009s 29.03% 0.009s 29.03%     3 work prof.sh:1
+ 0.007s 22.58% 0.021s 67.74%     3 main prof.sh:6
+ 0.006s 19.35% 0.009s 29.03%     3 work prof.sh:2
+ 0.003s  9.68% 0.003s  9.68%     3 exec sleep
+ 0.003s  9.68% 0.003s  9.68%     3 work prof.sh:3
+ 0.002s  6.45% 0.009s 29.03%     1 main prof.sh:5
+ 0.001s  3.23% 0.001s  3.23%     1 main prof.sh:1
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("wrong report:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	buf.Reset()
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"exec sleep", "work", "prof.sh", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Fatalf("pprof profile does not contain %q", want)
+		}
+	}
+}
+
 func TestElapsedString(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -3099,6 +4415,7 @@ func TestRunnerResetFields(t *testing.T) {
 	r, _ := New(
 		Params("-f", "--", "first", dir, logPath),
 		Dir(dir),
+		Umask(0027),
 		OpenHandler(testOpenHandler),
 		ExecHandler(testExecHandler),
 	)
@@ -3126,9 +4443,13 @@ echo line2
 # $GLOBAL was set directly via the Env field
 [[ "$GLOBAL" == "foo" ]] || exit 15
 
+# The umask was set via Umask
+[[ "$(umask)" == "0027" ]] || exit 16
+
 # Change all of the above within the script. Reset should undo this.
 set +f -- newargs
 cd
+umask 0
 exec >/dev/null 2>/dev/null
 GLOBAL=
 export GLOBAL=
@@ -0,0 +1,473 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// job is a statement started in the background, such as "sleep 1 &".
+//
+// Jobs run in a separate goroutine with a copy of the Runner, so they do not
+// have an operating system process of their own. They are given a unique
+// process ID nonetheless, so that they can be used with "$!" and builtins like
+// wait and kill. These IDs are above maxProcessID, so they can't be confused
+// with real processes.
+type job struct {
+	id  int    // as used in job specs like "%1"
+	pid int    // as shown by "$!" and "jobs -l"
+	src string // the statement, without the trailing "&"
+
+	owner  *Runner // only the owner may wait for the job
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the fields below are set
+
+	// closers are closed when the job finishes, such as the coprocess
+	// ends of its pipes.
+	closers []io.Closer
+
+	// coproc is the Bash coprocess started with the job, if any.
+	coproc *coproc
+
+	exit int
+	err  error // fatal errors, such as a failed ExecHandler
+
+	// signal is the signal sent to the job via the kill builtin, if any.
+	// Unlike the fields above, it's only used from the parent Runner.
+	signal syscall.Signal
+}
+
+// maxProcessID is the highest process ID an operating system may use. It is
+// PID_MAX_LIMIT on Linux; other systems have lower limits.
+const maxProcessID = 1 << 22
+
+// lastJobPid is used to give each job a unique process ID.
+var lastJobPid = int64(maxProcessID)
+
+func (j *job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// status returns the exit status of a finished job.
+func (j *job) status() int {
+	if j.signal != 0 {
+		return 128 + int(j.signal)
+	}
+	return j.exit
+}
+
+// state returns the job's state as shown by the jobs builtin, such as
+// "Running" or "Exit 3".
+func (j *job) state() string {
+	switch {
+	case !j.finished():
+		return "Running"
+	case j.signal != 0:
+		desc := j.signal.String()
+		return strings.ToUpper(desc[:1]) + desc[1:]
+	case j.status() != 0:
+		return "Exit " + strconv.Itoa(j.status())
+	}
+	return "Done"
+}
+
+// startJob runs a statement in the background, adding it to the job table.
+func (r *Runner) startJob(ctx context.Context, st *syntax.Stmt) {
+	st2 := *st
+	st2.Background = false
+	r.runJob(ctx, r.sub(), &st2, "")
+}
+
+// runJob runs a statement in the background with the given sub-runner,
+// adding it to the job table. The statement is printed if src is empty.
+func (r *Runner) runJob(ctx context.Context, r2 *Runner, st *syntax.Stmt, src string, closers ...io.Closer) *job {
+	if src == "" {
+		var buf strings.Builder
+		syntax.NewPrinter().Print(&buf, st)
+		src = buf.String()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{
+		id:      1,
+		src:     src,
+		owner:   r,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		closers: closers,
+	}
+	if n := len(r.jobs); n > 0 {
+		j.id = r.jobs[n-1].id + 1
+	}
+	if r.pid > 0 {
+		// fixed process IDs via the Hermetic option
+		j.pid = r.pid + j.id
+	} else {
+		j.pid = int(atomic.AddInt64(&lastJobPid, 1))
+	}
+	r2.bashPid = j.pid
+	r.jobs = append(r.jobs, j)
+	r.lastBgPid = j.pid
+	go func() {
+		err := r2.Run(ctx, st)
+		if status, ok := IsExitStatus(err); ok {
+			j.exit = int(status)
+		} else if err != nil {
+			j.exit = 1
+			j.err = err
+		}
+		for _, c := range j.closers {
+			c.Close()
+		}
+		cancel()
+		close(j.done)
+	}()
+	return j
+}
+
+// removeJob removes a job from the job table, once it has been waited for or
+// reported as finished. Like in Bash, the exit status of a finished job is
+// kept for "wait $pid", and the variables and file descriptors of a finished
+// coprocess are removed.
+func (r *Runner) removeJob(j *job) {
+	for i, j2 := range r.jobs {
+		if j2 == j {
+			r.jobs = append(r.jobs[:i], r.jobs[i+1:]...)
+			break
+		}
+	}
+	if j.owner != r || !j.finished() {
+		return
+	}
+	if r.doneJobs == nil {
+		r.doneJobs = make(map[int]int)
+	}
+	r.doneJobs[j.pid] = j.status()
+	if j.coproc != nil {
+		r.closeCoproc(j.coproc)
+		j.coproc = nil
+	}
+}
+
+// madeUpPid reports whether a process ID was made up by the Runner, such as
+// for a job which was removed from the job table. Signals must never be sent
+// to those, as they may belong to unrelated processes.
+func (r *Runner) madeUpPid(pid int) bool {
+	if pid > maxProcessID {
+		return true
+	}
+	if _, ok := r.doneJobs[pid]; ok {
+		return true
+	}
+	// fixed process IDs via the Hermetic option
+	return r.pid > 0 && (pid == r.pid || pid == r.ppid)
+}
+
+// currentJobs returns the current and previous jobs, used by job specs like
+// "%+" and "%-", and marked as such by the jobs builtin.
+func (r *Runner) currentJobs() (cur, prev *job) {
+	if n := len(r.jobs); n > 0 {
+		cur = r.jobs[n-1]
+		if n > 1 {
+			prev = r.jobs[n-2]
+		}
+	}
+	return cur, prev
+}
+
+// findJob finds a job from a job spec such as "%2", "%%", "%-", "%sleep" or
+// "%?sleep". If the spec does not start with "%", it is a process ID. A nil
+// job is returned if none is found, along with an error if the spec matches
+// more than one job.
+func (r *Runner) findJob(spec string) (*job, error) {
+	if !strings.HasPrefix(spec, "%") {
+		pid, err := strconv.Atoi(spec)
+		if err != nil {
+			return nil, nil
+		}
+		for _, j := range r.jobs {
+			if j.pid == pid {
+				return j, nil
+			}
+		}
+		return nil, nil
+	}
+	cur, prev := r.currentJobs()
+	switch spec = spec[1:]; spec {
+	case "", "%", "+":
+		return cur, nil
+	case "-":
+		return prev, nil
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		for _, j := range r.jobs {
+			if j.id == n {
+				return j, nil
+			}
+		}
+		return nil, nil
+	}
+	var found *job
+	for _, j := range r.jobs {
+		var match bool
+		if strings.HasPrefix(spec, "?") {
+			match = strings.Contains(j.src, spec[1:])
+		} else {
+			match = strings.HasPrefix(j.src, spec)
+		}
+		if !match {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s: ambiguous job spec", strings.TrimPrefix(spec, "?"))
+		}
+		found = j
+	}
+	return found, nil
+}
+
+// waitableJob reports whether a job can be waited for, since subshells can
+// only see the jobs started by their parents.
+func (r *Runner) waitableJob(j *job) bool {
+	return j != nil && j.owner == r
+}
+
+// waitJob waits for a job to finish and removes it from the job table,
+// returning its exit status. Fatal errors from the job are set on the Runner.
+func (r *Runner) waitJob(ctx context.Context, j *job) int {
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		r.setErr(ctx.Err())
+		return 1
+	}
+	r.removeJob(j)
+	if j.err != nil && j.signal == 0 {
+		r.setErr(j.err)
+	}
+	return j.status()
+}
+
+// waitAnyJob waits for any of the given jobs to finish, returning the first
+// one to do so. Jobs which have already finished are returned first.
+func (r *Runner) waitAnyJob(ctx context.Context, jobs []*job) *job {
+	for _, j := range jobs {
+		if j.finished() {
+			return j
+		}
+	}
+	cases := make([]reflect.SelectCase, len(jobs)+1)
+	for i, j := range jobs {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(j.done),
+		}
+	}
+	cases[len(jobs)] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(ctx.Done()),
+	}
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == len(jobs) {
+		return nil
+	}
+	return jobs[chosen]
+}
+
+// printJobs implements the jobs builtin. Finished jobs are removed from the
+// job table once they have been reported.
+func (r *Runner) printJobs(jobs []*job, pidsOnly, withPids bool) {
+	cur, prev := r.currentJobs()
+	for _, j := range jobs {
+		if pidsOnly {
+			r.outf("%d\n", j.pid)
+			continue
+		}
+		mark := ' '
+		switch j {
+		case cur:
+			mark = '+'
+		case prev:
+			mark = '-'
+		}
+		src := j.src
+		state := j.state()
+		if state == "Running" {
+			src += " &"
+		}
+		if withPids {
+			r.outf("[%d]%c %5d %-24s%s\n", j.id, mark, j.pid, state, src)
+		} else {
+			r.outf("[%d]%c  %-24s%s\n", j.id, mark, state, src)
+		}
+	}
+	for _, j := range jobs {
+		if j.finished() {
+			r.removeJob(j)
+		}
+	}
+}
+
+// signalByName returns the signal for a kill builtin specification such as
+// "9", "KILL" or "SIGKILL". The boolean is false if the specification isn't
+// valid. Unlike with the trap builtin, the signal 0 is valid.
+func signalByName(spec string) (syscall.Signal, bool) {
+	if spec == "0" {
+		return 0, true
+	}
+	name := trapName(spec)
+	for _, s := range signalTable {
+		if s.name == name {
+			return s.sig, true
+		}
+	}
+	return 0, false
+}
+
+// killJob sends a signal to a job. Since jobs are not real processes, signals
+// which would terminate a process stop the job via its context, and the rest
+// of signals are ignored.
+func killJob(j *job, sig syscall.Signal) {
+	if sig == 0 || j.finished() {
+		return
+	}
+	for _, s := range signalTable {
+		if s.sig == sig && signalIgnoredByDefault(s.name) {
+			return
+		}
+	}
+	j.signal = sig
+	j.cancel()
+}
+
+// kill implements the kill builtin.
+//
+// Only the jobs started by the Runner are signalled directly. Signals to other
+// processes are sent by running the kill program via the ExecHandler. The
+// shell's own process, process groups, and all processes at once are never
+// signalled; a CallHandler may rewrite such calls to run a kill program if they
+// should be allowed.
+func (r *Runner) kill(ctx context.Context, args []string) int {
+	sig := syscall.SIGTERM
+	usage := func() int {
+		r.errf("kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	switch arg := args[0]; {
+	case arg == "-l" || arg == "-L":
+		if len(args) == 1 {
+			r.printSignals()
+			return 0
+		}
+		exit := 0
+		for _, spec := range args[1:] {
+			if n, err := strconv.Atoi(spec); err == nil && n > 128 {
+				spec = strconv.Itoa(n - 128) // exit statuses like 143
+			}
+			sig, ok := signalByName(spec)
+			switch {
+			case !ok || sig == 0:
+				r.errf("kill: %s: invalid signal specification\n", spec)
+				exit = 1
+			case spec == strconv.Itoa(int(sig)):
+				r.outf("%s\n", trapName(spec))
+			default:
+				r.outf("%d\n", sig)
+			}
+		}
+		return exit
+	case arg == "-s" || arg == "-n":
+		if len(args) < 2 {
+			return usage()
+		}
+		var ok bool
+		if sig, ok = signalByName(args[1]); !ok {
+			r.errf("kill: %s: invalid signal specification\n", args[1])
+			return 1
+		}
+		args = args[2:]
+	case arg == "--":
+	case strings.HasPrefix(arg, "-") && len(arg) > 1:
+		var ok bool
+		if sig, ok = signalByName(arg[1:]); !ok {
+			r.errf("kill: %s: invalid signal specification\n", arg[1:])
+			return 1
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	exit := 0
+	var pids []string
+	for _, arg := range args {
+		j, err := r.findJob(arg)
+		if j != nil {
+			killJob(j, sig)
+			continue
+		}
+		if err != nil {
+			r.errf("kill: %v\n", err)
+			exit = 1
+			continue
+		}
+		if strings.HasPrefix(arg, "%") {
+			r.errf("kill: %s: no such job\n", arg)
+			exit = 1
+			continue
+		}
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			r.errf("kill: %s: arguments must be process or job IDs\n", arg)
+			exit = 1
+			continue
+		}
+		switch {
+		case r.madeUpPid(pid):
+			r.errf("kill: (%d) - No such process\n", pid)
+			exit = 1
+		case pid == r.shellPid() || pid == os.Getpid():
+			// the shell itself exists, but it's the host process
+			if sig != 0 {
+				r.errf("kill: (%d) - Operation not permitted\n", pid)
+				exit = 1
+			}
+		case pid <= 0:
+			// process groups, or all processes
+			r.errf("kill: (%d) - Operation not permitted\n", pid)
+			exit = 1
+		default:
+			pids = append(pids, arg)
+		}
+	}
+	if len(pids) > 0 {
+		// Signal other processes via the ExecHandler, like any other
+		// program would, so that it can decide what to allow.
+		r.exec(ctx, append([]string{"kill", "-" + strconv.Itoa(int(sig)), "--"}, pids...))
+		if r.exit != 0 {
+			exit = 1
+		}
+	}
+	return exit
+}
@@ -8,6 +8,7 @@ package interp
 import (
 	"os"
 	"os/user"
+	"sort"
 	"strconv"
 	"syscall"
 )
@@ -16,6 +17,18 @@ func mkfifo(path string, mode uint32) error {
 	return syscall.Mkfifo(path, mode)
 }
 
+// processUmaskVal is the umask of the process when the package is initialized.
+// Reading it requires setting it, so it's done once here, before other
+// goroutines may be creating files.
+var processUmaskVal = func() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask) & 0777
+}()
+
+// processUmask returns the umask of the process.
+func processUmask() os.FileMode { return processUmaskVal }
+
 // hasPermissionToDir returns if the OS current user has execute permission
 // to the given directory
 func hasPermissionToDir(info os.FileInfo) bool {
@@ -51,3 +64,46 @@ func hasPermissionToDir(info os.FileInfo) bool {
 
 	return false
 }
+
+// signalTable lists the signals known to builtins such as trap, without the
+// "SIG" prefix. It is sorted by signal number in init.
+var signalTable = []struct {
+	name string
+	sig  syscall.Signal
+}{
+	{"HUP", syscall.SIGHUP},
+	{"INT", syscall.SIGINT},
+	{"QUIT", syscall.SIGQUIT},
+	{"ILL", syscall.SIGILL},
+	{"TRAP", syscall.SIGTRAP},
+	{"ABRT", syscall.SIGABRT},
+	{"BUS", syscall.SIGBUS},
+	{"FPE", syscall.SIGFPE},
+	{"KILL", syscall.SIGKILL},
+	{"USR1", syscall.SIGUSR1},
+	{"SEGV", syscall.SIGSEGV},
+	{"USR2", syscall.SIGUSR2},
+	{"PIPE", syscall.SIGPIPE},
+	{"ALRM", syscall.SIGALRM},
+	{"TERM", syscall.SIGTERM},
+	{"CHLD", syscall.SIGCHLD},
+	{"CONT", syscall.SIGCONT},
+	{"STOP", syscall.SIGSTOP},
+	{"TSTP", syscall.SIGTSTP},
+	{"TTIN", syscall.SIGTTIN},
+	{"TTOU", syscall.SIGTTOU},
+	{"URG", syscall.SIGURG},
+	{"XCPU", syscall.SIGXCPU},
+	{"XFSZ", syscall.SIGXFSZ},
+	{"VTALRM", syscall.SIGVTALRM},
+	{"PROF", syscall.SIGPROF},
+	{"WINCH", syscall.SIGWINCH},
+	{"IO", syscall.SIGIO},
+	{"SYS", syscall.SIGSYS},
+}
+
+func init() {
+	sort.Slice(signalTable, func(i, j int) bool {
+		return signalTable[i].sig < signalTable[j].sig
+	})
+}
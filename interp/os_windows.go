@@ -6,13 +6,38 @@ package interp
 import (
 	"fmt"
 	"os"
+	"syscall"
 )
 
 func mkfifo(path string, mode uint32) error {
 	return fmt.Errorf("unsupported")
 }
 
+// processUmask always returns 022 on Windows, as there is no umask.
+func processUmask() os.FileMode { return 0022 }
+
 // hasPermissionToDir is a no-op on Windows.
 func hasPermissionToDir(info os.FileInfo) bool {
 	return true
 }
+
+// signalTable lists the signals known to builtins such as trap, without the
+// "SIG" prefix. It is sorted by signal number.
+var signalTable = []struct {
+	name string
+	sig  syscall.Signal
+}{
+	{"HUP", syscall.SIGHUP},
+	{"INT", syscall.SIGINT},
+	{"QUIT", syscall.SIGQUIT},
+	{"ILL", syscall.SIGILL},
+	{"TRAP", syscall.SIGTRAP},
+	{"ABRT", syscall.SIGABRT},
+	{"BUS", syscall.SIGBUS},
+	{"FPE", syscall.SIGFPE},
+	{"KILL", syscall.SIGKILL},
+	{"SEGV", syscall.SIGSEGV},
+	{"PIPE", syscall.SIGPIPE},
+	{"ALRM", syscall.SIGALRM},
+	{"TERM", syscall.SIGTERM},
+}
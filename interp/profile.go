@@ -0,0 +1,393 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Profiler measures the wall time a Runner spends running each statement and
+// external command, to find where a slow program spends its time. It is set up
+// via the Profile option, and can then write a pprof profile or a flat text
+// report.
+//
+// Time is measured rather than sampled; each moment is attributed to the
+// statement being run, or to the external command it waits for. Call stacks
+// follow the nesting of function calls and sourced files, so that tools like
+// "go tool pprof" can show the cumulative time spent in each function.
+//
+// Subshells such as command substitutions count their own time, not the
+// statement waiting for them. Statements which run concurrently, such as the
+// parts of a pipeline or background jobs, are each counted separately, so the
+// total time may add up to more than the time the program took.
+//
+// A Profiler is safe for concurrent use, and may be shared by many Runners to
+// merge their results.
+type Profiler struct {
+	mu         sync.Mutex
+	samples    map[string]*profSample
+	order      []*profSample // in the order they were first seen
+	start, end time.Time
+}
+
+// profLoc is a frame in a call stack.
+type profLoc struct {
+	name string // a function name, "source", "main", or "exec cmd"
+	file string
+	line uint
+}
+
+func (l profLoc) String() string {
+	if l.file == "" && l.line == 0 {
+		return l.name
+	}
+	return fmt.Sprintf("%s %s:%d", l.name, l.file, l.line)
+}
+
+// profStmt is a statement being run, at a depth in the call stack.
+type profStmt struct {
+	line  uint
+	depth int
+}
+
+type profSample struct {
+	stack []profLoc // from the innermost frame
+	calls int64
+	wall  time.Duration
+}
+
+// NewProfiler creates an empty Profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{samples: make(map[string]*profSample)}
+}
+
+// Profile sets the profiler used by a Runner. See Profiler for more info.
+//
+// The clock is the one set via Hermetic, if any.
+func Profile(p *Profiler) RunnerOption {
+	return func(r *Runner) error {
+		r.profiler = p
+		return nil
+	}
+}
+
+// add records wall time and calls for a call stack, up to the time now.
+func (p *Profiler) add(stack []profLoc, now time.Time, wall time.Duration, calls int64) {
+	var b strings.Builder
+	for _, loc := range stack {
+		fmt.Fprintf(&b, "%s\x00%s\x00%d\x00", loc.name, loc.file, loc.line)
+	}
+	key := b.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if start := now.Add(-wall); p.start.IsZero() || start.Before(p.start) {
+		p.start = start
+	}
+	if now.After(p.end) {
+		p.end = now
+	}
+	s := p.samples[key]
+	if s == nil {
+		s = &profSample{stack: stack}
+		p.samples[key] = s
+		p.order = append(p.order, s)
+	}
+	s.calls += calls
+	s.wall += wall
+}
+
+// profStack returns the current call stack, from the innermost frame.
+func (r *Runner) profStack() []profLoc {
+	var stack []profLoc
+	if r.profExec != "" {
+		stack = append(stack, profLoc{name: "exec " + r.profExec})
+	}
+	// Use the call stack as of the current statement; a function call may
+	// not have run its first statement yet.
+	line, depth := uint(0), 0
+	if n := len(r.profStmts); n > 0 {
+		line, depth = r.profStmts[n-1].line, r.profStmts[n-1].depth
+	}
+	for i := depth - 1; i >= 0; i-- {
+		frame := r.callStack[i]
+		stack = append(stack, profLoc{name: frame.funcName, file: frame.source, line: line})
+		line = frame.line
+	}
+	return append(stack, profLoc{name: "main", file: r.filename, line: line})
+}
+
+// profTick attributes the time since the last tick to the current call stack.
+func (r *Runner) profTick() {
+	now := r.now()
+	if !r.profLast.IsZero() && len(r.profStmts) > 0 {
+		r.profiler.add(r.profStack(), now, now.Sub(r.profLast), 0)
+	}
+	r.profLast = now
+}
+
+// profStmt is called before running a statement, and returns a func to call
+// once it's done.
+func (r *Runner) profStmt(st *syntax.Stmt) func() {
+	r.profTick()
+	r.profStmts = append(r.profStmts, profStmt{st.Pos().Line(), len(r.callStack)})
+	r.profiler.add(r.profStack(), r.profLast, 0, 1)
+	return func() {
+		r.profTick()
+		r.profStmts = r.profStmts[:len(r.profStmts)-1]
+	}
+}
+
+// profExecStart is called before running an external command, and returns a
+// func to call once it's done.
+func (r *Runner) profExecStart(name string) func() {
+	r.profTick()
+	r.profExec = name
+	r.profiler.add(r.profStack(), r.profLast, 0, 1)
+	return func() {
+		r.profTick()
+		r.profExec = ""
+	}
+}
+
+// profSkip drops the time since the last tick, such as when it was spent
+// waiting for a subshell which counted it already.
+func (r *Runner) profSkip() {
+	if r.profiler != nil {
+		r.profLast = r.now()
+	}
+}
+
+// profRow is a line in the flat report.
+type profRow struct {
+	loc       profLoc
+	flat, cum time.Duration
+	calls     int64
+}
+
+// rows aggregates the samples per frame. The mutex must be held.
+func (p *Profiler) rows() (rows []*profRow, total time.Duration) {
+	byLoc := make(map[profLoc]*profRow)
+	row := func(loc profLoc) *profRow {
+		pr := byLoc[loc]
+		if pr == nil {
+			pr = &profRow{loc: loc}
+			byLoc[loc] = pr
+			rows = append(rows, pr)
+		}
+		return pr
+	}
+	for _, s := range p.order {
+		total += s.wall
+		leaf := row(s.stack[0])
+		leaf.flat += s.wall
+		leaf.calls += s.calls
+		seen := make(map[profLoc]bool)
+		for _, loc := range s.stack {
+			// don't count recursive calls twice
+			if !seen[loc] {
+				seen[loc] = true
+				row(loc).cum += s.wall
+			}
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].flat != rows[j].flat {
+			return rows[i].flat > rows[j].flat
+		}
+		return rows[i].cum > rows[j].cum
+	})
+	return rows, total
+}
+
+// WriteReport writes a flat text report with a line per statement and external
+// command, sorted by the time spent in them, much like "go tool pprof -top".
+// Each line shows the time spent in the statement itself, the time including
+// the functions it called, and how many times it ran.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rows, total := p.rows()
+	percent := func(d time.Duration) string {
+		if total == 0 {
+			return "0.00%"
+		}
+		return fmt.Sprintf("%.2f%%", 100*float64(d)/float64(total))
+	}
+	seconds := func(d time.Duration) string {
+		return fmt.Sprintf("%.3fs", d.Seconds())
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat\tflat%%\tcum\tcum%%\tcalls\t\n")
+	for _, pr := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t %s\n",
+			seconds(pr.flat), percent(pr.flat),
+			seconds(pr.cum), percent(pr.cum), pr.calls, pr.loc)
+	}
+	return tw.Flush()
+}
+
+// WritePprof writes a profile in the gzipped protocol buffer format read by
+// pprof. Its sample values are the number of calls and the wall time.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b protoBuffer
+	strs := []string{""}
+	strIndex := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		i, ok := strIndex[s]
+		if !ok {
+			i = uint64(len(strs))
+			strIndex[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+	valueType := func(field int, typ, unit string) {
+		b.message(field, func(b *protoBuffer) {
+			b.uint64(1, str(typ))
+			b.uint64(2, str(unit))
+		})
+	}
+	valueType(1, "calls", "count")
+	valueType(1, "wall", "nanoseconds")
+
+	type funcKey struct{ name, file string }
+	funcIDs := make(map[funcKey]uint64)
+	locIDs := make(map[profLoc]uint64)
+	var locs []profLoc
+	var funcs []funcKey
+	for _, s := range p.order {
+		ids := make([]uint64, len(s.stack))
+		for i, loc := range s.stack {
+			id, ok := locIDs[loc]
+			if !ok {
+				id = uint64(len(locs) + 1)
+				locIDs[loc] = id
+				locs = append(locs, loc)
+			}
+			ids[i] = id
+		}
+		b.message(2, func(b *protoBuffer) {
+			b.packed(1, ids)
+			b.packed(2, []uint64{uint64(s.calls), uint64(s.wall)})
+		})
+	}
+	// A single mapping for all locations, named after the first main file,
+	// so that pprof knows not to look for a binary to symbolize.
+	b.message(3, func(b *protoBuffer) {
+		b.uint64(1, 1)
+		if len(p.order) > 0 {
+			stack := p.order[0].stack
+			b.uint64(5, str(stack[len(stack)-1].file))
+		}
+		b.uint64(7, 1) // has_functions
+		b.uint64(8, 1) // has_filenames
+		b.uint64(9, 1) // has_line_numbers
+	})
+	for i, loc := range locs {
+		key := funcKey{loc.name, loc.file}
+		funcID, ok := funcIDs[key]
+		if !ok {
+			funcID = uint64(len(funcs) + 1)
+			funcIDs[key] = funcID
+			funcs = append(funcs, key)
+		}
+		b.message(4, func(b *protoBuffer) {
+			b.uint64(1, uint64(i+1))
+			b.uint64(2, 1) // mapping_id
+			b.message(4, func(b *protoBuffer) {
+				b.uint64(1, funcID)
+				b.uint64(2, uint64(loc.line))
+			})
+		})
+	}
+	for i, fn := range funcs {
+		b.message(5, func(b *protoBuffer) {
+			b.uint64(1, uint64(i+1))
+			b.uint64(2, str(fn.name))
+			b.uint64(3, str(fn.name))
+			b.uint64(4, str(fn.file))
+		})
+	}
+	if !p.start.IsZero() {
+		b.uint64(9, uint64(p.start.UnixNano()))
+		b.uint64(10, uint64(p.end.Sub(p.start)))
+	}
+	valueType(11, "wall", "nanoseconds")
+	b.uint64(12, 1)
+	// The string table goes last, as the fields above add to it.
+	for _, s := range strs {
+		b.string(6, s)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuffer encodes protocol buffer messages, with just what WritePprof
+// needs. See https://developers.google.com/protocol-buffers/docs/encoding.
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint64 encodes a varint field, omitting zero values like proto3 does.
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.tag(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+// string encodes a string field, even if empty, so that it may be used for
+// repeated fields like pprof's string table.
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var inner protoBuffer
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	b.bytes(field, inner.data)
+}
+
+func (b *protoBuffer) message(field int, encode func(*protoBuffer)) {
+	var inner protoBuffer
+	encode(&inner)
+	b.bytes(field, inner.data)
+}
@@ -0,0 +1,460 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// errReadTimeout is returned when "read -t" times out.
+var errReadTimeout = fmt.Errorf("read timed out")
+
+// readResult is the result of reading a single byte.
+type readResult struct {
+	b   byte
+	err error
+}
+
+// pendingRead is a read from the standard input which was abandoned, such as
+// when "read -t" times out. The next read from the same reader gets its result,
+// so that no input is lost.
+type pendingRead struct {
+	rd io.Reader
+	ch chan readResult
+}
+
+// readByte reads a single byte from the standard input, as the read builtin
+// must not consume any input past the delimiter. The read is abandoned if the
+// context is cancelled or the timeout channel fires.
+func (r *Runner) readByte(ctx context.Context, timeout <-chan time.Time) (byte, error) {
+	if r.stdin == nil {
+		return 0, io.EOF
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var ch chan readResult
+	if p := r.pendingRead; p != nil && p.rd == r.stdin {
+		r.pendingRead = nil
+		ch = p.ch
+	} else if timeout == nil {
+		var buf [1]byte
+		for {
+			n, err := r.stdin.Read(buf[:])
+			if n > 0 {
+				return buf[0], nil
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		ch = make(chan readResult, 1)
+		go func(rd io.Reader) {
+			var buf [1]byte
+			for {
+				n, err := rd.Read(buf[:])
+				if n > 0 {
+					ch <- readResult{b: buf[0]}
+					return
+				}
+				if err != nil {
+					ch <- readResult{err: err}
+					return
+				}
+			}
+		}(r.stdin)
+	}
+	select {
+	case res := <-ch:
+		return res.b, res.err
+	case <-ctx.Done():
+		r.pendingRead = &pendingRead{rd: r.stdin, ch: ch}
+		return 0, ctx.Err()
+	case <-timeout:
+		r.pendingRead = &pendingRead{rd: r.stdin, ch: ch}
+		return 0, errReadTimeout
+	}
+}
+
+// readOpts configures readInput.
+type readOpts struct {
+	raw   bool // don't handle backslash escapes, like "read -r"
+	delim byte // the byte ending the input, like "read -d"
+
+	// count is the maximum number of characters to read, not counting
+	// escaping backslashes, like "read -n". It is ignored if negative.
+	count int
+
+	// exact means that the delimiter isn't special, like "read -N".
+	exact bool
+
+	timeout <-chan time.Time
+}
+
+// readInput reads from the standard input until the delimiter is found, which
+// is not included in the result. Unless the input is raw, backslashes are kept
+// so that expand.ReadFields can handle them, and line continuations are
+// removed.
+//
+// The input read so far is returned along with any error, including io.EOF if
+// the input ended before the delimiter.
+func (r *Runner) readInput(ctx context.Context, opts readOpts) ([]byte, error) {
+	var line []byte
+	esc := false
+	for n := 0; opts.count < 0 || n < opts.count; {
+		b, err := r.readByte(ctx, opts.timeout)
+		if err != nil {
+			return line, err
+		}
+		switch {
+		case esc && b == '\n':
+			// line continuation
+			line = line[:len(line)-1]
+			esc = false
+		case !esc && !opts.exact && b == opts.delim:
+			return line, nil
+		case !esc && !opts.raw && b == '\\':
+			line = append(line, b)
+			esc = true
+		default:
+			line = append(line, b)
+			esc = false
+			n++
+		}
+	}
+	return line, nil
+}
+
+// readLine reads a line of input, like the read builtin without options. A
+// final line without a newline is still returned without an error.
+func (r *Runner) readLine(ctx context.Context, raw bool) ([]byte, error) {
+	line, err := r.readInput(ctx, readOpts{raw: raw, delim: '\n', count: -1})
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
+
+// unescape removes the escaping backslashes kept by readInput.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// optionArgs parses the options of a builtin, like the getopts builtin does,
+// calling fn for each of them. The remaining arguments are returned. A non-zero
+// exit status is returned if the options are invalid or fn returns one, in
+// which case an error has already been printed.
+func (r *Runner) optionArgs(name, optstr string, args []string, fn func(opt rune, optarg string) int) ([]string, int) {
+	var g getopts
+	for {
+		opt, optarg, done := g.Next(optstr, args)
+		if done {
+			break
+		}
+		switch opt {
+		case '?':
+			r.errf("%s: invalid option %q\n", name, "-"+optarg)
+			return nil, 2
+		case ':':
+			r.errf("%s: -%s: option requires an argument\n", name, optarg)
+			return nil, 2
+		}
+		if exit := fn(opt, optarg); exit != 0 {
+			return nil, exit
+		}
+	}
+	args = args[g.argidx:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return args, 0
+}
+
+// readCmd implements the read builtin.
+func (r *Runner) readCmd(ctx context.Context, args []string) int {
+	oldStdin := r.stdin
+	defer func() { r.stdin = oldStdin }()
+
+	opts := readOpts{delim: '\n', count: -1}
+	array := ""
+	silent := false
+	var timeout time.Duration
+	hasTimeout := false
+	optstr := "ersa:d:i:n:N:p:t:u:"
+	if r.coproc != nil {
+		// mksh's "read -p" reads from the coprocess
+		optstr = strings.Replace(optstr, "p:", "p", 1)
+	}
+	args, exit := r.optionArgs("read", optstr, args, func(opt rune, optarg string) int {
+		switch opt {
+		case 'r':
+			opts.raw = true
+		case 's':
+			silent = true
+		case 'e', 'i':
+			// we don't use readline
+		case 'a':
+			array = optarg
+		case 'd':
+			opts.delim = 0
+			if optarg != "" {
+				opts.delim = optarg[0]
+			}
+		case 'n', 'N':
+			n, err := strconv.Atoi(optarg)
+			if err != nil || n < 0 {
+				r.errf("read: %s: invalid number\n", optarg)
+				return 1
+			}
+			opts.count = n
+			opts.exact = opt == 'N'
+		case 'p':
+			if r.coproc != nil {
+				r.stdin = r.coproc.out
+				break
+			}
+			if f, ok := r.stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+				r.errf("%s", optarg)
+			}
+		case 't':
+			secs, err := strconv.ParseFloat(optarg, 64)
+			if err != nil || secs < 0 {
+				r.errf("read: %s: invalid timeout specification\n", optarg)
+				return 1
+			}
+			timeout = time.Duration(secs * float64(time.Second))
+			hasTimeout = true
+		case 'u':
+			fd, err := strconv.Atoi(optarg)
+			if err != nil || r.fdReader(fd) == nil {
+				r.errf("read: %s: invalid file descriptor: bad file descriptor\n", optarg)
+				return 1
+			}
+			r.stdin = r.fdReader(fd)
+		}
+		return 0
+	})
+	if exit != 0 {
+		return exit
+	}
+
+	for _, name := range args {
+		if !syntax.ValidName(name) {
+			r.errf("read: invalid identifier %q\n", name)
+			return 2
+		}
+	}
+	if array != "" && !syntax.ValidName(array) {
+		r.errf("read: invalid identifier %q\n", array)
+		return 2
+	}
+
+	if hasTimeout && timeout == 0 {
+		// only check whether there is any input available
+		return oneIf(r.stdin == nil || r.stdin == closedFd{})
+	}
+	if hasTimeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		opts.timeout = timer.C
+	}
+
+	var line []byte
+	var err error
+	if f, ok := r.stdin.(*os.File); ok && silent && opts.count < 0 && opts.delim == '\n' &&
+		terminal.IsTerminal(int(f.Fd())) {
+		// don't echo what's being typed
+		line, err = terminal.ReadPassword(int(f.Fd()))
+		opts.raw = true
+	} else {
+		line, err = r.readInput(ctx, opts)
+	}
+	switch err {
+	case nil:
+	case errReadTimeout:
+		exit = 128 + 14 // SIGALRM, like Bash
+	default:
+		exit = 1
+		if len(line) == 0 && err != io.EOF {
+			return exit
+		}
+	}
+
+	switch {
+	case array != "":
+		values := expand.ReadFields(r.ecfg, string(line), -1, opts.raw)
+		r.setVar(array, nil, expand.Variable{Kind: expand.Indexed, List: values})
+	case opts.exact:
+		// "read -N" doesn't split fields
+		val := string(line)
+		if !opts.raw {
+			val = unescape(val)
+		}
+		if len(args) == 0 {
+			args = append(args, "REPLY")
+		}
+		r.setVarString(args[0], val)
+		for _, name := range args[1:] {
+			r.setVarString(name, "")
+		}
+	case len(args) == 0:
+		// $REPLY keeps the leading and trailing whitespace
+		val := string(line)
+		if !opts.raw {
+			val = unescape(val)
+		}
+		r.setVarString("REPLY", val)
+	default:
+		values := expand.ReadFields(r.ecfg, string(line), len(args), opts.raw)
+		for i, name := range args {
+			val := ""
+			if i < len(values) {
+				val = values[i]
+			}
+			r.setVar(name, nil, expand.Variable{Kind: expand.String, Str: val})
+		}
+	}
+	return exit
+}
+
+// mapfile implements the mapfile and readarray builtins.
+func (r *Runner) mapfile(ctx context.Context, name string, args []string) int {
+	oldStdin := r.stdin
+	defer func() { r.stdin = oldStdin }()
+
+	opts := readOpts{raw: true, delim: '\n', count: -1}
+	trim := false
+	max, skip, origin := 0, 0, -1
+	callback, quantum := "", 5000
+	args, exit := r.optionArgs(name, "d:n:O:s:tu:C:c:", args, func(opt rune, optarg string) int {
+		var n int
+		var err error
+		switch opt {
+		case 'n', 's', 'O', 'c':
+			if n, err = strconv.Atoi(optarg); err != nil || n < 0 {
+				n = -1
+			}
+		}
+		switch opt {
+		case 'd':
+			opts.delim = 0
+			if optarg != "" {
+				opts.delim = optarg[0]
+			}
+		case 't':
+			trim = true
+		case 'n', 's':
+			if n < 0 {
+				r.errf("%s: %s: invalid line count\n", name, optarg)
+				return 1
+			}
+			if opt == 'n' {
+				max = n
+			} else {
+				skip = n
+			}
+		case 'O':
+			if n < 0 {
+				r.errf("%s: %s: invalid array origin\n", name, optarg)
+				return 1
+			}
+			origin = n
+		case 'c':
+			if n < 1 {
+				r.errf("%s: %s: invalid callback quantum\n", name, optarg)
+				return 1
+			}
+			quantum = n
+		case 'C':
+			callback = optarg
+		case 'u':
+			fd, err := strconv.Atoi(optarg)
+			if err != nil || r.fdReader(fd) == nil {
+				r.errf("%s: %s: invalid file descriptor: bad file descriptor\n", name, optarg)
+				return 1
+			}
+			r.stdin = r.fdReader(fd)
+		}
+		return 0
+	})
+	if exit != 0 {
+		return exit
+	}
+	array := "MAPFILE"
+	if len(args) > 0 {
+		array = args[0]
+	}
+	if !syntax.ValidName(array) {
+		r.errf("%s: invalid identifier %q\n", name, array)
+		return 1
+	}
+	cur := r.lookupVar(array)
+	if cur.ReadOnly {
+		r.errf("%s: readonly variable\n", array)
+		return 1
+	}
+
+	arr := expand.Variable{Kind: expand.Indexed, List: []string{}}
+	if origin < 0 {
+		origin = 0
+	} else if cur.Kind == expand.Indexed {
+		// -O doesn't clear the array
+		arr = copyArray(cur)
+	}
+	index := origin
+	for n := 0; max == 0 || n < max; {
+		line, err := r.readInput(ctx, opts)
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			break
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		val := string(line)
+		if err == nil && !trim {
+			val += string(opts.delim)
+		}
+		n++
+		if callback != "" && n%quantum == 0 {
+			r.setVar(array, nil, copyArray(arr))
+			src := callback + " " + strconv.Itoa(index) + " " + syntax.Quote(val)
+			file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+			if err != nil {
+				r.errf("%s: %v\n", name, err)
+				return 1
+			}
+			r.stmts(ctx, file.Stmts)
+		}
+		arr = setElem(arr, index, val)
+		index++
+		if err != nil {
+			break // io.EOF
+		}
+	}
+	r.setVar(array, nil, arr)
+	return 0
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"strings"
+)
+
+// restrictedVars are the variables which cannot be changed in restricted mode,
+// as they would allow escaping the restrictions.
+var restrictedVars = [...]string{"PATH", "SHELL", "ENV", "BASH_ENV"}
+
+// Restricted enables or disables restricted mode, like Bash's "rbash". It
+// limits what a program can do, for example to run untrusted scripts:
+//
+//   - cd, pushd and popd are refused
+//   - PATH, SHELL, ENV and BASH_ENV are read-only
+//   - command names containing slashes cannot be run
+//   - output redirections are refused
+//   - exec cannot replace the shell with a command
+//   - source only accepts file names without slashes
+//
+// Violations print an error and fail with exit status 1, like in Bash. Note
+// that restricted mode does not limit what the commands found in $PATH can
+// do.
+func Restricted(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.restricted = enabled
+		return nil
+	}
+}
+
+// restrictVars marks the restricted variables as read-only.
+func (r *Runner) restrictVars() {
+	for _, name := range restrictedVars {
+		vr := r.lookupVar(name)
+		vr.ReadOnly = true
+		r.Vars[name] = vr
+	}
+}
+
+// restrictedBuiltin reports whether a builtin call is refused in restricted
+// mode, printing an error if so.
+func (r *Runner) restrictedBuiltin(name string, args []string) bool {
+	if !r.restricted {
+		return false
+	}
+	switch name {
+	case "cd", "pushd", "popd":
+		r.errf("%s: restricted\n", name)
+		return true
+	case "exec":
+		if len(args) > 0 {
+			r.errf("exec: restricted\n")
+			return true
+		}
+	case "source", ".":
+		if len(args) > 0 && strings.Contains(args[0], "/") {
+			r.errf("%s: %s: restricted\n", name, args[0])
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedCommand reports whether running a command is refused in restricted
+// mode, printing an error if so.
+func (r *Runner) restrictedCommand(name string) bool {
+	if !r.restricted || !strings.Contains(name, "/") {
+		return false
+	}
+	r.errf("%s: restricted: cannot specify `/' in command names\n", name)
+	return true
+}
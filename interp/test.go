@@ -5,9 +5,7 @@ package interp
 
 import (
 	"context"
-	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -35,18 +33,36 @@ func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic boo
 				}
 			} else { // [[
 				pattern := r.pattern(yw)
-				if match(pattern, str) == (x.Op != syntax.TsNoMatch) {
+				if r.tracing() {
+					r.trace("[[ " + syntax.Quote(str) + " " + x.Op.String() + " " + pattern + " ]]")
+				}
+				if r.match(pattern, str) == (x.Op != syntax.TsNoMatch) {
 					return "1"
 				}
 			}
 			return ""
+		case syntax.AndTest, syntax.OrTest:
+			// only evaluate the right side if needed, like the shell
+			left := r.bashTest(ctx, x.X, classic)
+			if (left != "") == (x.Op == syntax.OrTest) {
+				return left
+			}
+			return r.bashTest(ctx, x.Y, classic)
+		}
+		left, right := r.bashTest(ctx, x.X, classic), r.bashTest(ctx, x.Y, classic)
+		if !classic && r.tracing() {
+			r.trace("[[ " + syntax.Quote(left) + " " + x.Op.String() + " " + syntax.Quote(right) + " ]]")
 		}
-		if r.binTest(x.Op, r.bashTest(ctx, x.X, classic), r.bashTest(ctx, x.Y, classic)) {
+		if r.binTest(x.Op, left, right) {
 			return "1"
 		}
 		return ""
 	case *syntax.UnaryTest:
-		if r.unTest(ctx, x.Op, r.bashTest(ctx, x.X, classic)) {
+		operand := r.bashTest(ctx, x.X, classic)
+		if !classic && x.Op != syntax.TsNot && r.tracing() {
+			r.trace("[[ " + x.Op.String() + " " + syntax.Quote(operand) + " ]]")
+		}
+		if r.unTest(ctx, x.OpPos, x.Op, operand) {
 			return "1"
 		}
 		return ""
@@ -112,7 +128,7 @@ func (r *Runner) statMode(name string, mode os.FileMode) bool {
 	return err == nil && info.Mode()&mode != 0
 }
 
-func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string) bool {
+func (r *Runner) unTest(ctx context.Context, pos syntax.Pos, op syntax.UnTestOperator, x string) bool {
 	switch op {
 	case syntax.TsExists:
 		_, err := r.stat(x)
@@ -133,7 +149,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 	case syntax.TsSocket:
 		return r.statMode(x, os.ModeSocket)
 	case syntax.TsSmbLink:
-		info, err := os.Lstat(r.absPath(x))
+		info, err := r.lstat(x)
 		return err == nil && info.Mode()&os.ModeSymlink != 0
 	case syntax.TsSticky:
 		return r.statMode(x, os.ModeSticky)
@@ -157,7 +173,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 		}
 		return err == nil
 	case syntax.TsExec:
-		_, err := exec.LookPath(r.absPath(x))
+		_, err := checkStat(r.fs, r.Dir, r.absPath(x))
 		return err == nil
 	case syntax.TsNoEmpty:
 		info, err := r.stat(x)
@@ -180,6 +196,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 	case syntax.TsNot:
 		return x == ""
 	default:
-		panic(fmt.Sprintf("unhandled unary test op: %v", op))
+		r.unsupported(pos, "test operator %s", op)
+		return false
 	}
 }
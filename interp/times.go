@@ -0,0 +1,125 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// childUsage accumulates the CPU time used by child processes. It is shared
+// by a Runner and all of its subshells, so it must be safe for concurrent use.
+type childUsage struct {
+	user, sys int64 // time.Duration
+}
+
+func (u *childUsage) add(user, sys time.Duration) {
+	atomic.AddInt64(&u.user, int64(user))
+	atomic.AddInt64(&u.sys, int64(sys))
+}
+
+func (u *childUsage) get() (user, sys time.Duration) {
+	return time.Duration(atomic.LoadInt64(&u.user)), time.Duration(atomic.LoadInt64(&u.sys))
+}
+
+// ReportUsage adds the CPU time used by a child process to the interpreter's
+// totals, as shown by the time and times builtins. It is meant to be used by
+// ExecHandlerFunc implementations which run processes. DefaultExecHandler
+// already reports the usage of the processes it runs.
+//
+// Only the CPU time used by child processes is counted. The time used by the
+// shell itself can't be told apart from other Runners and goroutines in the
+// same Go process, so the times builtin always reports it as zero.
+func (hc HandlerContext) ReportUsage(user, sys time.Duration) {
+	if hc.usage != nil {
+		hc.usage.add(user, sys)
+	}
+}
+
+const (
+	defaultTimeFormat = "\nreal\t%3lR\nuser\t%3lU\nsys\t%3lS"
+	posixTimeFormat   = "real %2R\nuser %2U\nsys %2S"
+)
+
+// formatTime formats the times reported by the time keyword following
+// $TIMEFORMAT, like Bash. The optional digit after % is the precision, and the
+// optional l uses the long format with minutes.
+func formatTime(format string, real, user, sys time.Duration) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		prec, long := 3, false
+		if d := format[i]; d >= '0' && d <= '9' {
+			if prec = int(d - '0'); prec > 3 {
+				prec = 3
+			}
+			i++
+		}
+		if i < len(format) && format[i] == 'l' {
+			long = true
+			i++
+		}
+		if i == len(format) {
+			return "", fmt.Errorf("`': invalid format character")
+		}
+		switch format[i] {
+		case 'R':
+			b.WriteString(timeString(real, prec, long))
+		case 'U':
+			b.WriteString(timeString(user, prec, long))
+		case 'S':
+			b.WriteString(timeString(sys, prec, long))
+		case 'P':
+			cpu := int64(0)
+			if real > 0 {
+				cpu = int64(float64(user+sys) / float64(real) * 10000)
+			}
+			fmt.Fprintf(&b, "%d.%02d", cpu/100, cpu%100)
+		default:
+			return "", fmt.Errorf("`%c': invalid format character", format[i])
+		}
+	}
+	b.WriteByte('\n')
+	return b.String(), nil
+}
+
+// timeString formats a duration in seconds with up to three decimal digits,
+// and optionally with minutes too, like "1m2.345s".
+func timeString(d time.Duration, prec int, long bool) string {
+	ms := int64(d / time.Millisecond)
+	sec, frac := ms/1000, ms%1000
+	var s string
+	if long {
+		s = fmt.Sprintf("%dm", sec/60)
+		sec %= 60
+	}
+	s += fmt.Sprint(sec)
+	if prec > 0 {
+		s += fmt.Sprintf(".%03d", frac)[:prec+1]
+	}
+	if long {
+		s += "s"
+	}
+	return s
+}
+
+// elapsedString formats a duration like the time keyword's default format, or
+// like its POSIX format via "time -p".
+func elapsedString(d time.Duration, posix bool) string {
+	if posix {
+		return timeString(d, 2, false)
+	}
+	return timeString(d, 3, true)
+}
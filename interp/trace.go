@@ -0,0 +1,79 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// tracing reports whether commands should be printed, via the xtrace option.
+func (r *Runner) tracing() bool {
+	return r.opts[optXTrace]
+}
+
+// tracePrefix expands $PS4. Its first character is repeated once per level of
+// nested command substitutions, like in Bash.
+func (r *Runner) tracePrefix() string {
+	// Command substitutions in $PS4 must not be traced, as that would
+	// expand $PS4 again. Subshells copy the options, so they don't either.
+	oldOpts := r.opts
+	r.opts[optXTrace] = false
+	r.opts[optNoUnset] = false
+	ps4, _ := expand.Prompt(r.ecfg, r.lookupVar("PS4").String())
+	r.opts = oldOpts
+	if ps4 == "" {
+		return ""
+	}
+	first, _ := utf8.DecodeRuneInString(ps4)
+	return strings.Repeat(string(first), r.traceDepth) + ps4
+}
+
+// trace prints a line to stderr, prefixed by $PS4.
+func (r *Runner) trace(line string) {
+	r.errf("%s%s\n", r.tracePrefix(), line)
+}
+
+func (r *Runner) traceFields(fields []string) {
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = syntax.Quote(field)
+	}
+	r.trace(strings.Join(quoted, " "))
+}
+
+func (r *Runner) traceNode(node syntax.Node) {
+	var buf strings.Builder
+	syntax.NewPrinter().Print(&buf, node)
+	r.trace(buf.String())
+}
+
+// traceAssign formats an assignment after it has been expanded into a
+// variable. String values are quoted, and arrays are shown as written.
+func traceAssign(as *syntax.Assign, vr expand.Variable) string {
+	if as.Naked {
+		return as.Name.Value
+	}
+	as2 := *as
+	if as.Array == nil {
+		if vr.Kind == expand.Indexed && as.Index == nil {
+			// "arr+=x" appends to the first element
+			as2.Index = &syntax.Word{Parts: []syntax.WordPart{
+				&syntax.Lit{Value: "0"},
+			}}
+		}
+		as2.Append = false
+		as2.Value = &syntax.Word{Parts: []syntax.WordPart{
+			&syntax.Lit{Value: syntax.Quote(vr.String())},
+		}}
+	}
+	var buf strings.Builder
+	syntax.NewPrinter().Print(&buf, &syntax.CallExpr{
+		Assigns: []*syntax.Assign{&as2},
+	})
+	return buf.String()
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// trap is a handler set up via the trap builtin.
+type trap struct {
+	src   string // as given to the trap builtin, for "trap -p"
+	stmts []*syntax.Stmt
+}
+
+// trapName returns the canonical name of a trap builtin signal specification,
+// such as "INT" for "2", "int" or "SIGINT", and "EXIT" for "0". An empty
+// string is returned if the specification isn't valid.
+func trapName(spec string) string {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n == 0 {
+			return "EXIT"
+		}
+		for _, s := range signalTable {
+			if int(s.sig) == n {
+				return s.name
+			}
+		}
+		return ""
+	}
+	spec = strings.ToUpper(spec)
+	switch spec {
+	case "EXIT", "DEBUG", "ERR", "RETURN":
+		return spec
+	}
+	spec = strings.TrimPrefix(spec, "SIG")
+	for _, s := range signalTable {
+		if s.name == spec {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// trapOrder sorts trap names like bash does; EXIT goes first, then the
+// signals by number, and then the rest of the pseudo-signals.
+func trapOrder(name string) int {
+	switch name {
+	case "EXIT":
+		return 0
+	case "DEBUG":
+		return 1000
+	case "ERR":
+		return 1001
+	case "RETURN":
+		return 1002
+	}
+	for _, s := range signalTable {
+		if s.name == name {
+			return int(s.sig)
+		}
+	}
+	return 999
+}
+
+// trapDisplayName returns the name used to print a trap, adding the "SIG"
+// prefix for signals.
+func trapDisplayName(name string) string {
+	switch name {
+	case "EXIT", "DEBUG", "ERR", "RETURN":
+		return name
+	}
+	return "SIG" + name
+}
+
+// signalIgnoredByDefault reports whether a signal is ignored by the shell when
+// no trap is set for it, as opposed to terminating it.
+func signalIgnoredByDefault(name string) bool {
+	switch name {
+	case "CHLD", "CONT", "STOP", "TSTP", "TTIN", "TTOU", "URG", "WINCH":
+		return true
+	}
+	return false
+}
+
+func (r *Runner) printTraps(names []string) {
+	if len(names) == 0 {
+		for name := range r.traps {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return trapOrder(names[i]) < trapOrder(names[j])
+		})
+	}
+	for _, name := range names {
+		if t := r.traps[name]; t != nil {
+			r.outf("trap -- %s %s\n", singleQuote(t.src), trapDisplayName(name))
+		}
+	}
+}
+
+func (r *Runner) printSignals() {
+	for i, s := range signalTable {
+		if i > 0 {
+			if i%5 == 0 {
+				r.out("\n")
+			} else {
+				r.out("\t")
+			}
+		}
+		r.outf("%2d) SIG%s", s.sig, s.name)
+	}
+	r.out("\n")
+}
+
+func (r *Runner) setTrap(name string, t *trap) {
+	if t == nil {
+		delete(r.traps, name)
+		return
+	}
+	if r.traps == nil {
+		r.traps = make(map[string]*trap, 4)
+	}
+	r.traps[name] = t
+	switch name {
+	case "DEBUG", "RETURN":
+		r.noDebugTraps = false
+	case "ERR":
+		r.noErrTrap = false
+	}
+}
+
+// trap runs the handler for a pseudo-signal like "ERR", if there is one and
+// if the current function inherited it.
+func (r *Runner) trap(ctx context.Context, name string) {
+	switch name {
+	case "DEBUG", "RETURN":
+		if r.noDebugTraps {
+			return
+		}
+	case "ERR":
+		if r.noErrTrap {
+			return
+		}
+	}
+	if r.exitShell {
+		return
+	}
+	r.runTrap(ctx, r.traps[name])
+}
+
+// exitTrap runs the EXIT trap handler, if there is one. It is only run once.
+func (r *Runner) exitTrap(ctx context.Context) {
+	t := r.traps["EXIT"]
+	if t == nil {
+		return
+	}
+	delete(r.traps, "EXIT")
+	r.runTrap(ctx, t)
+}
+
+// debugTrap runs the DEBUG trap handler before a command, setting
+// $BASH_COMMAND to it.
+func (r *Runner) debugTrap(ctx context.Context, cm syntax.Command) {
+	if r.traps["DEBUG"] == nil || r.inTrap {
+		return
+	}
+	switch cm.(type) {
+	case *syntax.CallExpr, *syntax.DeclClause, *syntax.TestClause,
+		*syntax.ArithmCmd, *syntax.LetClause, *syntax.ForClause,
+		*syntax.CaseClause:
+	default:
+		return
+	}
+	var buf strings.Builder
+	syntax.NewPrinter().Print(&buf, cm)
+	r.setVarString("BASH_COMMAND", buf.String())
+	r.trap(ctx, "DEBUG")
+}
+
+func (r *Runner) runTrap(ctx context.Context, t *trap) {
+	if t == nil || len(t.stmts) == 0 || r.inTrap {
+		return
+	}
+	oldExit, oldExitShell := r.exit, r.exitShell
+	r.exitShell = false
+	r.inTrap = true
+	r.stmts(ctx, t.stmts)
+	r.inTrap = false
+	if r.exitShell {
+		return // the handler used "exit"
+	}
+	r.exit, r.exitShell = oldExit, oldExitShell
+}
+
+// handleSignals runs the traps for any signals received via the Signals
+// option. Signals without a trap stop the shell, unless they are ignored by
+// default.
+func (r *Runner) handleSignals(ctx context.Context) {
+	if r.signals == nil || r.inTrap {
+		return
+	}
+	for !r.exitShell {
+		var sig os.Signal
+		select {
+		case sig = <-r.signals:
+		default:
+			return
+		}
+		num, ok := sig.(syscall.Signal)
+		if !ok {
+			continue
+		}
+		name := trapName(strconv.Itoa(int(num)))
+		if t, ok := r.traps[name]; ok && name != "" {
+			r.runTrap(ctx, t)
+			continue
+		}
+		if signalIgnoredByDefault(name) {
+			continue
+		}
+		r.exit = 128 + int(num)
+		r.exitShell = true
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// umaskCmd implements the umask builtin.
+func (r *Runner) umaskCmd(args []string) int {
+	symbolic, reusable := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'S':
+				symbolic = true
+			case 'p':
+				reusable = true
+			default:
+				r.errf("umask: %s: invalid option\n", arg)
+				r.errf("umask: usage: umask [-p] [-S] [mode]\n")
+				return 2
+			}
+		}
+	}
+	if len(args) > 0 {
+		mask, err := parseUmask(args[0], r.umask)
+		if err != nil {
+			r.errf("umask: %v\n", err)
+			return 1
+		}
+		r.umask = mask
+		if !symbolic {
+			return 0
+		}
+	}
+	prefix := ""
+	if reusable {
+		prefix = "umask "
+		if symbolic {
+			prefix += "-S "
+		}
+	}
+	if symbolic {
+		r.outf("%s%s\n", prefix, symbolicUmask(r.umask))
+	} else {
+		r.outf("%s%04o\n", prefix, r.umask)
+	}
+	return 0
+}
+
+// symbolicUmask formats a umask as the permissions it allows, such as
+// "u=rwx,g=rx,o=rx" for 022.
+func symbolicUmask(mask os.FileMode) string {
+	allowed := ^mask & 0777
+	var b strings.Builder
+	for i, who := range "ugo" {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(who)
+		b.WriteByte('=')
+		bits := allowed >> uint(3*(2-i))
+		for j, perm := range "rwx" {
+			if bits&(4>>uint(j)) != 0 {
+				b.WriteRune(perm)
+			}
+		}
+	}
+	return b.String()
+}
+
+// parseUmask parses a umask in octal form such as "027", or in symbolic form
+// such as "u=rwx,g=rx,o=". Symbolic modes describe the permissions to allow,
+// and are applied on top of the current umask.
+func parseUmask(s string, cur os.FileMode) (os.FileMode, error) {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		n, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || n > 07777 {
+			return 0, fmt.Errorf("%s: octal number out of range", s)
+		}
+		return os.FileMode(n) & 0777, nil
+	}
+	allowed := ^cur & 0777
+	for _, clause := range strings.Split(s, ",") {
+		var who os.FileMode
+		i := 0
+	whoLoop:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				break whoLoop
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		if i == len(clause) {
+			return 0, fmt.Errorf("`': invalid symbolic mode operator")
+		}
+		op := clause[i]
+		if op != '+' && op != '-' && op != '=' {
+			return 0, fmt.Errorf("`%c': invalid symbolic mode operator", op)
+		}
+		var perm os.FileMode
+		for _, c := range clause[i+1:] {
+			switch c {
+			case 'r':
+				perm |= 0444
+			case 'w':
+				perm |= 0222
+			case 'x':
+				perm |= 0111
+			default:
+				return 0, fmt.Errorf("`%c': invalid symbolic mode character", c)
+			}
+		}
+		perm &= who
+		switch op {
+		case '+':
+			allowed |= perm
+		case '-':
+			allowed &^= perm
+		case '=':
+			allowed = allowed&^who | perm
+		}
+	}
+	return ^allowed & 0777, nil
+}
@@ -4,10 +4,15 @@
 package interp
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -41,7 +46,7 @@ func (o overlayEnviron) Each(f func(name string, vr expand.Variable) bool) {
 func execEnv(env expand.Environ) []string {
 	list := make([]string, 0, 64)
 	env.Each(func(name string, vr expand.Variable) bool {
-		if vr.Exported {
+		if vr.Exported && vr.IsSet() {
 			list = append(list, name+"="+vr.String())
 		}
 		return true
@@ -61,12 +66,43 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 		vr.Kind, vr.List = expand.Indexed, r.Params
 	case "?":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.exit)
+	case "-":
+		vr.Kind = expand.String
+		for i, opt := range &shellOptsTable {
+			if r.opts[i] && opt.flag != " " {
+				vr.Str += opt.flag
+			}
+		}
 	case "$":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getpid())
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.shellPid())
+	case "BASHPID":
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.bashPid)
+	case "_":
+		vr.Kind, vr.Str = expand.String, r.lastArg
+	case "RANDOM":
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.random.Intn(32768))
+	case "SRANDOM":
+		vr.Kind, vr.Str = expand.String, strconv.FormatUint(uint64(r.srandomUint32()), 10)
+	case "SECONDS":
+		secs := r.startSeconds + int(r.now().Sub(r.startTime)/time.Second)
+		vr.Kind, vr.Integer, vr.Str = expand.String, true, strconv.Itoa(secs)
+	case "EPOCHSECONDS":
+		vr.Kind, vr.Str = expand.String, strconv.FormatInt(r.now().Unix(), 10)
+	case "EPOCHREALTIME":
+		now := r.now()
+		vr.Kind, vr.Str = expand.String, fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000)
+	case "!":
+		if r.lastBgPid > 0 {
+			vr.Kind, vr.Str = expand.String, strconv.Itoa(r.lastBgPid)
+		}
 	case "PPID":
-		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getppid())
+		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.parentPid())
 	case "DIRSTACK":
 		vr.Kind, vr.List = expand.Indexed, r.dirStack
+	case "FUNCNAME", "BASH_SOURCE", "BASH_LINENO":
+		if list := r.stackVar(name); list != nil {
+			vr.Kind, vr.List = expand.Indexed, list
+		}
 	case "0":
 		vr.Kind = expand.String
 		if r.filename != "" {
@@ -113,6 +149,52 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 	return expand.Variable{}
 }
 
+// setDynamicVar handles assignments to the variables whose value is computed
+// each time they are used, like $RANDOM. It reports whether name is one of them.
+func (r *Runner) setDynamicVar(name string, vr expand.Variable) bool {
+	switch name {
+	case "RANDOM":
+		r.random.Seed(int64(atoi(vr.String())))
+	case "SECONDS":
+		r.startTime = r.now()
+		r.startSeconds = atoi(vr.String())
+	case "SRANDOM", "EPOCHSECONDS", "EPOCHREALTIME", "BASHPID", "_":
+		// like in Bash, assignments have no effect
+	default:
+		return false
+	}
+	return true
+}
+
+// shellPid returns the process ID for $$.
+func (r *Runner) shellPid() int {
+	if r.pid > 0 {
+		return r.pid
+	}
+	return os.Getpid()
+}
+
+// parentPid returns the process ID for $PPID.
+func (r *Runner) parentPid() int {
+	if r.pid > 0 {
+		return r.ppid
+	}
+	return os.Getppid()
+}
+
+// srandomUint32 returns a number for $SRANDOM, which is read from
+// crypto/rand unless the Hermetic option is used.
+func (r *Runner) srandomUint32() uint32 {
+	if r.srandom != nil {
+		return r.srandom.Uint32()
+	}
+	var b [4]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return r.random.Uint32()
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
 func (r *Runner) envGet(name string) string {
 	return r.lookupVar(name).String()
 }
@@ -132,6 +214,52 @@ func (r *Runner) delVar(name string) {
 	}
 }
 
+// delElem unsets a single element of an array, as in "unset 'arr[i]'".
+// Unsetting the element of a string variable at index 0 unsets the variable,
+// as does using "@" or "*" as the index.
+func (r *Runner) delElem(name string, index syntax.ArithmExpr) int {
+	vr := r.lookupVar(name)
+	if name2, var2 := vr.Resolve(expandEnv{r}); name2 != "" {
+		name = name2
+		vr = var2
+	}
+	if vr.ReadOnly {
+		r.errf("unset: %s: cannot unset: readonly variable\n", name)
+		return 1
+	}
+	switch lit, _ := index.(*syntax.Word); {
+	case vr.Kind == expand.Indexed && lit != nil && (lit.Lit() == "@" || lit.Lit() == "*"):
+		// like Bash, keep the array and its attributes
+		vr.List, vr.Indices = nil, nil
+	case vr.Kind == expand.String && lit != nil && (lit.Lit() == "@" || lit.Lit() == "*"):
+		r.errf("unset: %s: not an array variable\n", name)
+		return 1
+	case vr.Kind == expand.Associative:
+		if lit == nil {
+			return 0
+		}
+		vr = copyArray(vr)
+		delete(vr.Map, r.literal(lit))
+	case vr.Kind == expand.Indexed:
+		n := r.arithm(index)
+		k, ok := vr.ArrayIndex(n)
+		if !ok {
+			r.errf("unset: [%d]: bad array subscript\n", n)
+			return 1
+		}
+		vr = unsetElem(copyArray(vr), k)
+	case vr.Kind == expand.String:
+		if r.arithm(index) == 0 {
+			r.delVar(name)
+		}
+		return 0
+	default:
+		return 0
+	}
+	r.setVarInternal(name, vr)
+	return 0
+}
+
 func (r *Runner) setVarString(name, value string) {
 	r.setVar(name, nil, expand.Variable{Kind: expand.String, Str: value})
 }
@@ -141,7 +269,7 @@ func (r *Runner) setVarInternal(name string, vr expand.Variable) {
 		if r.opts[optAllExport] {
 			vr.Exported = true
 		}
-	} else {
+	} else if vr.IsSet() {
 		vr.Exported = false
 	}
 	if vr.Local {
@@ -161,40 +289,48 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable
 		r.exit = 1
 		return
 	}
-	if name2, var2 := cur.Resolve(r.Env); name2 != "" {
+	if name2, var2 := cur.Resolve(expandEnv{r}); name2 != "" {
 		name = name2
 		cur = var2
+		if cur.ReadOnly {
+			r.errf("%s: readonly variable\n", name)
+			r.exit = 1
+			return
+		}
 	}
 
 	if vr.Kind == expand.String && index == nil {
 		// When assigning a string to an array, fall back to the
 		// zero value for the index.
 		switch cur.Kind {
-		case expand.Indexed:
+		case expand.Indexed, expand.Associative:
 			index = &syntax.Word{Parts: []syntax.WordPart{
 				&syntax.Lit{Value: "0"},
 			}}
-		case expand.Associative:
-			index = &syntax.Word{Parts: []syntax.WordPart{
-				&syntax.DblQuoted{},
-			}}
 		}
 	}
 	if index == nil {
+		if !hasAttrs(vr) {
+			// plain assignments keep the variable's attributes
+			vr.Local, vr.Exported, vr.ReadOnly = cur.Local, cur.Exported, cur.ReadOnly
+			vr.Integer, vr.Lower, vr.Upper, vr.Trace = cur.Integer, cur.Lower, cur.Upper, cur.Trace
+		}
+		vr = r.attrVar(vr)
+		if r.setDynamicVar(name, vr) {
+			return
+		}
 		r.setVarInternal(name, vr)
 		return
 	}
 
 	// from the syntax package, we know that value must be a string if index
 	// is non-nil; nested arrays are forbidden.
-	valStr := vr.Str
+	valStr := r.attrValue(cur, vr.Str)
 
-	var list []string
 	switch cur.Kind {
 	case expand.String:
-		list = append(list, cur.Str)
+		cur.List, cur.Str = []string{cur.Str}, ""
 	case expand.Indexed:
-		list = cur.List
 	case expand.Associative:
 		// if the existing variable is already an AssocArray, try our
 		// best to convert the key to a string
@@ -203,18 +339,182 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable
 			return
 		}
 		k := r.literal(w)
+		cur = copyArray(cur)
 		cur.Map[k] = valStr
 		r.setVarInternal(name, cur)
 		return
+	default:
+		cur.List, cur.Indices = nil, nil
 	}
-	k := r.arithm(index)
-	for len(list) < k+1 {
-		list = append(list, "")
-	}
-	list[k] = valStr
 	cur.Kind = expand.Indexed
-	cur.List = list
-	r.setVarInternal(name, cur)
+	n := r.arithm(index)
+	k, ok := cur.ArrayIndex(n)
+	if !ok {
+		r.errf("%s[%d]: bad array subscript\n", name, n)
+		r.exit = 1
+		return
+	}
+	r.setVarInternal(name, setElem(copyArray(cur), k, valStr))
+}
+
+// attrVar applies a variable's integer and case attributes to its value or
+// elements.
+func (r *Runner) attrVar(vr expand.Variable) expand.Variable {
+	if !vr.Integer && !vr.Lower && !vr.Upper {
+		return vr
+	}
+	switch vr.Kind {
+	case expand.String:
+		vr.Str = r.attrValue(vr, vr.Str)
+	case expand.Indexed:
+		list := make([]string, len(vr.List))
+		for i, s := range vr.List {
+			list[i] = r.attrValue(vr, s)
+		}
+		vr.List = list
+	case expand.Associative:
+		m := make(map[string]string, len(vr.Map))
+		for k, s := range vr.Map {
+			m[k] = r.attrValue(vr, s)
+		}
+		vr.Map = m
+	}
+	return vr
+}
+
+// attrValue transforms a value being assigned to a variable, following its
+// integer and case attributes.
+func (r *Runner) attrValue(vr expand.Variable, s string) string {
+	switch {
+	case vr.Integer:
+		return strconv.Itoa(r.arithmString(s))
+	case vr.Lower:
+		return strings.ToLower(s)
+	case vr.Upper:
+		return strings.ToUpper(s)
+	}
+	return s
+}
+
+// arithmString evaluates a string as an arithmetic expression, such as the
+// values assigned to variables with the integer attribute.
+func (r *Runner) arithmString(s string) int {
+	expr, err := syntax.NewParser().Arithmetic(strings.NewReader(s))
+	if err != nil {
+		r.errf("%s: %v\n", s, err)
+		r.exit = 1
+		return 0
+	}
+	if expr == nil {
+		return 0
+	}
+	return r.arithm(expr)
+}
+
+// setElem sets the element at index i of an indexed array, which must not be
+// negative. The array's slices are modified in place when possible, so they
+// must not be shared with other variables; see copyArray.
+func setElem(vr expand.Variable, i int, s string) expand.Variable {
+	if vr.Indices == nil {
+		switch {
+		case i < len(vr.List):
+			vr.List[i] = s
+			return vr
+		case i == len(vr.List):
+			vr.List = append(vr.List, s)
+			return vr
+		}
+		vr.Indices = vr.ArrayIndices()
+	}
+	j := sort.SearchInts(vr.Indices, i)
+	if j < len(vr.Indices) && vr.Indices[j] == i {
+		vr.List[j] = s
+		return vr
+	}
+	vr.Indices = append(vr.Indices, 0)
+	copy(vr.Indices[j+1:], vr.Indices[j:])
+	vr.Indices[j] = i
+	vr.List = append(vr.List, "")
+	copy(vr.List[j+1:], vr.List[j:])
+	vr.List[j] = s
+	return compactElems(vr)
+}
+
+// unsetElem unsets the element at index i of an indexed array, if it is set.
+// Like setElem, it modifies the array's slices in place.
+func unsetElem(vr expand.Variable, i int) expand.Variable {
+	if vr.Indices == nil {
+		switch {
+		case i >= len(vr.List):
+			return vr
+		case i == len(vr.List)-1:
+			vr.List = vr.List[:i]
+			return vr
+		}
+		vr.Indices = vr.ArrayIndices()
+	}
+	j := sort.SearchInts(vr.Indices, i)
+	if j == len(vr.Indices) || vr.Indices[j] != i {
+		return vr
+	}
+	vr.Indices = append(vr.Indices[:j], vr.Indices[j+1:]...)
+	vr.List = append(vr.List[:j], vr.List[j+1:]...)
+	return compactElems(vr)
+}
+
+// compactElems drops the indices of an indexed array if it is no longer
+// sparse.
+func compactElems(vr expand.Variable) expand.Variable {
+	if n := len(vr.Indices); n == 0 || vr.Indices[n-1] == n-1 {
+		vr.Indices = nil
+	}
+	return vr
+}
+
+// copyArray returns a copy of a variable which doesn't share its array
+// elements with the original, so that either can be modified in place.
+// Variables may share their arrays with subshells and saved variables, so
+// arrays are copied before each change.
+func copyArray(vr expand.Variable) expand.Variable {
+	switch vr.Kind {
+	case expand.Indexed:
+		vr.List = append([]string(nil), vr.List...)
+		if vr.Indices != nil {
+			vr.Indices = append([]int(nil), vr.Indices...)
+		}
+	case expand.Associative:
+		m := make(map[string]string, len(vr.Map))
+		for k, v := range vr.Map {
+			m[k] = v
+		}
+		vr.Map = m
+	}
+	return vr
+}
+
+// splitIndex splits a variable reference like "foo" or "foo[i+1]", as used by
+// builtins like "printf -v", into the name and the index, if any. For indexed
+// arrays, the index is parsed as an arithmetic expression. The boolean is false
+// if the reference isn't valid.
+func (r *Runner) splitIndex(ref string) (string, syntax.ArithmExpr, bool) {
+	i := strings.IndexByte(ref, '[')
+	if i < 0 {
+		return ref, nil, syntax.ValidName(ref)
+	}
+	name, idx := ref[:i], ref[i+1:]
+	if !syntax.ValidName(name) || !strings.HasSuffix(idx, "]") {
+		return "", nil, false
+	}
+	idx = idx[:len(idx)-1]
+	word := &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: idx}}}
+	if r.lookupVar(name).Kind == expand.Associative {
+		return name, word, true
+	}
+	expr, err := syntax.NewParser().Arithmetic(strings.NewReader(idx))
+	if err != nil || expr == nil {
+		return name, word, idx != ""
+	}
+	return name, expr, true
 }
 
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
@@ -222,6 +522,16 @@ func (r *Runner) setFunc(name string, body *syntax.Stmt) {
 		r.Funcs = make(map[string]*syntax.Stmt, 4)
 	}
 	r.Funcs[name] = body
+	if r.funcSources == nil {
+		r.funcSources = make(map[string]string, 4)
+	}
+	r.funcSources[name] = r.curSource()
+	if r.coverage != nil {
+		if r.funcCovers == nil {
+			r.funcCovers = make(map[string]*coverAST, 4)
+		}
+		r.funcCovers[name] = r.curCover()
+	}
 }
 
 func stringIndex(index syntax.ArithmExpr) bool {
@@ -251,16 +561,26 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 			prev.Str = s
 			return prev
 		}
+		if as.Index != nil {
+			// "arr[i]+=x" appends to a single element
+			return expand.Variable{Kind: expand.String, Str: r.elem(prev, as.Index) + s}
+		}
 		switch prev.Kind {
 		case expand.String:
+			if prev.Integer {
+				// "num+=x" adds to an integer
+				prev.Str = strconv.Itoa(atoi(prev.Str) + r.arithmString(s))
+				break
+			}
 			prev.Str += s
 		case expand.Indexed:
-			if len(prev.List) == 0 {
-				prev.List = append(prev.List, "")
-			}
-			prev.List[0] += s
+			// "arr+=x" appends to the first element
+			first, _ := prev.Elem(0)
+			prev = setElem(copyArray(prev), 0, first+s)
 		case expand.Associative:
-			// TODO
+			// "assoc+=x" appends to the element with key "0"
+			prev = copyArray(prev)
+			prev.Map["0"] += s
 		}
 		return prev
 	}
@@ -276,54 +596,88 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 	elems := as.Array.Elems
 	if valType == "" {
 		valType = "-a" // indexed
-		if len(elems) > 0 && stringIndex(elems[0].Index) {
+		if prev.Kind == expand.Associative {
+			valType = "-A"
+		} else if len(elems) > 0 && stringIndex(elems[0].Index) {
 			valType = "-A" // associative
 		}
 	}
 	if valType == "-A" {
 		amap := make(map[string]string, len(elems))
-		for _, elem := range elems {
-			k := r.literal(elem.Index.(*syntax.Word))
-			amap[k] = r.literal(elem.Value)
+		if as.Append && prev.Kind == expand.Associative {
+			for k, v := range prev.Map {
+				amap[k] = v
+			}
 		}
-		if !as.Append {
-			prev.Kind = expand.Associative
-			prev.Map = amap
-			return prev
+		for i := 0; i < len(elems); i++ {
+			elem := elems[i]
+			if elem.Index == nil {
+				// like Bash, "(k1 v1 k2 v2)" lists keys and values
+				k, v := r.literal(elem.Value), ""
+				if i++; i < len(elems) {
+					v = r.literal(elems[i].Value)
+				}
+				amap[k] = v
+				continue
+			}
+			w, ok := elem.Index.(*syntax.Word)
+			if !ok {
+				continue
+			}
+			amap[r.literal(w)] = r.literal(elem.Value)
 		}
-		// TODO
+		prev.Kind = expand.Associative
+		prev.Map = amap
 		return prev
 	}
-	maxIndex := len(elems) - 1
-	indexes := make([]int, len(elems))
-	for i, elem := range elems {
-		if elem.Index == nil {
-			indexes[i] = i
-			continue
+	arr := expand.Variable{Kind: expand.Indexed, List: []string{}}
+	next := 0
+	if as.Append {
+		switch prev.Kind {
+		case expand.String:
+			arr.List = []string{prev.Str}
+		case expand.Indexed:
+			arr = copyArray(prev)
 		}
-		k := r.arithm(elem.Index)
-		indexes[i] = k
-		if k > maxIndex {
-			maxIndex = k
+		if indices := arr.ArrayIndices(); len(indices) > 0 {
+			next = indices[len(indices)-1] + 1
 		}
 	}
-	strs := make([]string, maxIndex+1)
-	for i, elem := range elems {
-		strs[indexes[i]] = r.literal(elem.Value)
-	}
-	if !as.Append {
-		prev.Kind = expand.Indexed
-		prev.List = strs
-		return prev
+	for _, elem := range elems {
+		if elem.Index != nil {
+			n := r.arithm(elem.Index)
+			k, ok := arr.ArrayIndex(n)
+			if !ok {
+				r.errf("[%d]=%s: bad array subscript\n", n, r.literal(elem.Value))
+				continue
+			}
+			next = k
+		}
+		arr = setElem(arr, next, r.literal(elem.Value))
+		next++
 	}
-	switch prev.Kind {
+	prev.Kind = expand.Indexed
+	prev.List, prev.Indices = arr.List, arr.Indices
+	return prev
+}
+
+// elem returns the current value of an array element, such as when appending
+// to it via "arr[i]+=x".
+func (r *Runner) elem(vr expand.Variable, index syntax.ArithmExpr) string {
+	switch vr.Kind {
 	case expand.String:
-		prev.Kind = expand.Indexed
-		prev.List = append([]string{prev.Str}, strs...)
+		if r.arithm(index) == 0 {
+			return vr.Str
+		}
 	case expand.Indexed:
-		prev.List = append(prev.List, strs...)
+		if k, ok := vr.ArrayIndex(r.arithm(index)); ok {
+			s, _ := vr.Elem(k)
+			return s
+		}
 	case expand.Associative:
-		// TODO
+		if w, ok := index.(*syntax.Word); ok {
+			return vr.Map[r.literal(w)]
+		}
 	}
-	return prev
+	return ""
 }
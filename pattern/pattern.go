@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Mode can be used to supply a number of options to the package's functions.
@@ -24,6 +25,9 @@ const (
 	Shortest  Mode = 1 << iota // prefer the shortest match.
 	Filenames                  // "*" and "?" don't match slashes; only "**" does
 	Braces                     // support "{a,b}" and "{1..4}"
+
+	ExtendedOperators // support Bash's "?(a|b)", "*(a)", "+(a)", "@(a)" and "!(a)"
+	NoGlobCase        // match letters regardless of their case
 )
 
 var numRange = regexp.MustCompile(`^([+-]?\d+)\.\.([+-]?\d+)}`)
@@ -34,10 +38,21 @@ var numRange = regexp.MustCompile(`^([+-]?\d+)\.\.([+-]?\d+)}`)
 //
 // For example, Regexp(`foo*bar?`, true) returns `foo.*bar.`.
 //
+// With ExtendedOperators, the "!(pattern-list)" operator cannot be expressed as
+// a regular expression, so an error is returned. Use Compile to match entire
+// strings against such patterns.
+//
 // Note that this function (and QuoteMeta) should not be directly used with file
 // paths if Windows is supported, as the path separator on that platform is the
 // same character as the escaping character for shell patterns.
 func Regexp(pat string, mode Mode) (string, error) {
+	if mode&NoGlobCase != 0 {
+		expr, err := Regexp(pat, mode&^NoGlobCase)
+		if err != nil {
+			return "", err
+		}
+		return "(?i)" + expr, nil
+	}
 	any := false
 noopLoop:
 	for _, r := range pat {
@@ -57,7 +72,42 @@ noopLoop:
 	var buf bytes.Buffer
 writeLoop:
 	for i := 0; i < len(pat); i++ {
-		switch c := pat[i]; c {
+		c := pat[i]
+		if mode&ExtendedOperators != 0 && isExtOp(pat, i) {
+			end, err := extGroupEnd(pat, i+1)
+			if err != nil {
+				return "", err
+			}
+			if c == '!' {
+				return "", fmt.Errorf("!( cannot be expressed as a regular expression")
+			}
+			buf.WriteString("(?:")
+			for j, alt := range splitAlternatives(pat[i+2 : end]) {
+				if j > 0 {
+					buf.WriteByte('|')
+				}
+				expr, err := Regexp(alt, mode)
+				if err != nil {
+					return "", err
+				}
+				buf.WriteString(expr)
+			}
+			buf.WriteByte(')')
+			switch c {
+			case '?':
+				buf.WriteByte('?')
+			case '*':
+				buf.WriteByte('*')
+			case '+':
+				buf.WriteByte('+')
+			}
+			if c != '@' && mode&Shortest != 0 {
+				buf.WriteByte('?')
+			}
+			i = end
+			continue
+		}
+		switch c {
 		case '*':
 			if mode&Filenames != 0 {
 				if i++; i < len(pat) && pat[i] == '*' {
@@ -222,6 +272,224 @@ writeLoop:
 	return buf.String(), nil
 }
 
+// Matcher reports whether entire strings match a shell pattern. Unlike the
+// expressions returned by Regexp, it supports the "!(pattern-list)" operator
+// when using ExtendedOperators.
+type Matcher struct {
+	// rx matches the pattern up to the first "!(" operator, if any.
+	rx *regexp.Regexp
+
+	// If literal is set, the part of the pattern matched by rx is simply
+	// prefix, which is quicker to compare against.
+	prefix  string
+	literal bool
+
+	// neg matches the patterns inside the "!(" operator, and rest matches
+	// the pattern following it.
+	neg, rest *Matcher
+
+	filenames bool
+}
+
+// Compile parses a shell pattern into a Matcher. It will return an error if the
+// input pattern was incorrect.
+//
+// Patterns with the "!(pattern-list)" operator are matched by trying each way
+// to split the input string, so they can be considerably slower.
+func Compile(pat string, mode Mode) (*Matcher, error) {
+	mode &^= Shortest
+	m := &Matcher{filenames: mode&Filenames != 0}
+	negStart, negEnd := -1, -1
+	if mode&ExtendedOperators != 0 {
+	scanLoop:
+		for i := 0; i < len(pat); i++ {
+			switch c := pat[i]; {
+			case c == '\\':
+				i++
+			case c == '[':
+				if end := bracketEnd(pat, i); end > 0 {
+					i = end
+				}
+			case isExtOp(pat, i):
+				end, err := extGroupEnd(pat, i+1)
+				if err != nil {
+					return nil, err
+				}
+				if c == '!' {
+					negStart, negEnd = i, end
+					break scanLoop
+				}
+				i = end
+			}
+		}
+	}
+	prefix := pat
+	if negStart >= 0 {
+		prefix = pat[:negStart]
+	}
+	expr, err := Regexp(prefix, mode)
+	if err != nil {
+		return nil, err
+	}
+	if m.rx, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+		return nil, err
+	}
+	if mode&NoGlobCase == 0 && !HasMeta(prefix, mode) && !strings.Contains(prefix, `\`) {
+		m.prefix, m.literal = prefix, true
+	}
+	if negStart >= 0 {
+		if m.neg, err = Compile("@"+pat[negStart+1:negEnd+1], mode); err != nil {
+			return nil, err
+		}
+		if m.rest, err = Compile(pat[negEnd+1:], mode); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// MatchString reports whether the entire string s matches the pattern.
+func (m *Matcher) MatchString(s string) bool {
+	if m.neg == nil {
+		return m.rx.MatchString(s)
+	}
+	return m.matchSuffix(s, 0, make(map[*Matcher][]int8))
+}
+
+// matchSuffix reports whether s[start:] matches the pattern. The results are
+// memoized by Matcher and start offset, with 1 for a match and -1 otherwise,
+// as each "!(" operator matches the rest of the pattern against the same
+// suffixes many times over.
+func (m *Matcher) matchSuffix(s string, start int, memo map[*Matcher][]int8) bool {
+	results := memo[m]
+	if results == nil {
+		results = make([]int8, len(s)+1)
+		memo[m] = results
+	}
+	if res := results[start]; res != 0 {
+		return res > 0
+	}
+	matched := false
+	if m.neg == nil {
+		matched = m.rx.MatchString(s[start:])
+	} else {
+	splitLoop:
+		for i := start; i <= len(s); i++ {
+			if !m.prefixMatches(s, start, i) {
+				continue
+			}
+			for j := i; j <= len(s); j++ {
+				if m.filenames && j > i && s[j-1] == '/' {
+					break
+				}
+				if !runeBoundary(s, j) {
+					continue
+				}
+				// the rest is memoized, so check it first
+				if m.rest.matchSuffix(s, j, memo) && !m.neg.MatchString(s[i:j]) {
+					matched = true
+					break splitLoop
+				}
+			}
+		}
+	}
+	results[start] = -1
+	if matched {
+		results[start] = 1
+	}
+	return matched
+}
+
+// prefixMatches reports whether s[start:i] matches the pattern up to the first
+// "!(" operator.
+func (m *Matcher) prefixMatches(s string, start, i int) bool {
+	if m.literal {
+		return i-start == len(m.prefix) && strings.HasPrefix(s[start:], m.prefix)
+	}
+	return runeBoundary(s, i) && m.rx.MatchString(s[start:i])
+}
+
+// runeBoundary reports whether s can be split at index i without splitting a
+// character.
+func runeBoundary(s string, i int) bool {
+	return i == len(s) || utf8.RuneStart(s[i])
+}
+
+// bracketEnd returns the index of the bracket closing the expression at pat[i],
+// or -1 if there isn't one.
+func bracketEnd(pat string, i int) int {
+	i++
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		i++
+	}
+	if i < len(pat) && pat[i] == ']' {
+		i++
+	}
+	for ; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// isExtOp reports whether pat[i] starts an extended globbing operator, such as
+// "@(".
+func isExtOp(pat string, i int) bool {
+	if i+1 >= len(pat) || pat[i+1] != '(' {
+		return false
+	}
+	switch pat[i] {
+	case '?', '*', '+', '@', '!':
+		return true
+	}
+	return false
+}
+
+// extGroupEnd returns the index of the parenthesis closing the one at pat[i].
+func extGroupEnd(pat string, i int) (int, error) {
+	level := 0
+	for ; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+		case '(':
+			level++
+		case ')':
+			if level--; level == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("( was not matched with a closing )")
+}
+
+// splitAlternatives splits an extended globbing pattern list like "a|b*" into
+// its patterns.
+func splitAlternatives(list string) []string {
+	var alts []string
+	level, last := 0, 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '\\':
+			i++
+		case '(':
+			level++
+		case ')':
+			level--
+		case '|':
+			if level == 0 {
+				alts = append(alts, list[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(alts, list[last:])
+}
+
 func charClass(s string) (string, error) {
 	if strings.HasPrefix(s, "[[.") || strings.HasPrefix(s, "[[=") {
 		return "", fmt.Errorf("collating features not available")
@@ -245,7 +513,8 @@ func charClass(s string) (string, error) {
 }
 
 // HasMeta returns whether a string contains any unescaped pattern
-// metacharacters: '*', '?', or '['. When the function returns false, the given
+// metacharacters: '*', '?', or '['. With ExtendedOperators, the "+(", "@(" and
+// "!(" operators are also included. When the function returns false, the given
 // pattern can only match at most one string.
 //
 // For example, HasMeta(`foo\*bar`) returns false, but HasMeta(`foo*bar`)
@@ -265,6 +534,10 @@ func HasMeta(pat string, mode Mode) bool {
 			if mode&Braces != 0 {
 				return true
 			}
+		case '+', '@', '!':
+			if mode&ExtendedOperators != 0 && isExtOp(pat, i) {
+				return true
+			}
 		}
 	}
 	return false
@@ -283,7 +556,14 @@ loop:
 			if mode&Braces == 0 {
 				continue
 			}
-			fallthrough
+			any = true
+			break loop
+		case '(', ')', '|':
+			if mode&ExtendedOperators == 0 {
+				continue
+			}
+			any = true
+			break loop
 		case '*', '?', '[', '\\':
 			any = true
 			break loop
@@ -301,6 +581,10 @@ loop:
 			if mode&Braces != 0 {
 				buf.WriteByte('\\')
 			}
+		case '(', ')', '|':
+			if mode&ExtendedOperators != 0 {
+				buf.WriteByte('\\')
+			}
 		}
 		buf.WriteRune(r)
 	}
@@ -6,6 +6,7 @@ package pattern
 import (
 	"fmt"
 	"regexp/syntax"
+	"strings"
 	"testing"
 )
 
@@ -82,6 +83,17 @@ var translateTests = []struct {
 	{pat: `[[:wrong:]]`, wantErr: true},
 	{pat: `[[=x=]]`, wantErr: true},
 	{pat: `[[.x.]]`, wantErr: true},
+	{pat: `foo`, mode: NoGlobCase, want: `(?i)foo`},
+	{pat: `f*`, mode: NoGlobCase, want: `(?i)f.*`},
+	{pat: `@(a|b)`, want: `@\(a\|b\)`},
+	{pat: `@(a|b)`, mode: ExtendedOperators, want: `(?:a|b)`},
+	{pat: `?(a)`, mode: ExtendedOperators, want: `(?:a)?`},
+	{pat: `*(a|b*)`, mode: ExtendedOperators, want: `(?:a|b.*)*`},
+	{pat: `*(a)`, mode: ExtendedOperators | Shortest, want: `(?:a)*?`},
+	{pat: `+(a|@(b|c))x`, mode: ExtendedOperators, want: `(?:a|(?:b|c))+x`},
+	{pat: `@(\))`, mode: ExtendedOperators, want: `(?:\))`},
+	{pat: `@(a`, mode: ExtendedOperators, wantErr: true},
+	{pat: `!(a)`, mode: ExtendedOperators, wantErr: true},
 }
 
 func TestRegexp(t *testing.T) {
@@ -121,6 +133,10 @@ var metaTests = []struct {
 	{`\[`, 0, false, `\\\[`},
 	{`{`, 0, false, `{`},
 	{`{`, Braces, true, `\{`},
+	{`@(a)`, 0, false, `@(a)`},
+	{`@(a)`, ExtendedOperators, true, `@\(a\)`},
+	{`!(a|b)`, ExtendedOperators, true, `!\(a\|b\)`},
+	{`a!b`, ExtendedOperators, false, `a!b`},
 }
 
 func TestMeta(t *testing.T) {
@@ -136,3 +152,62 @@ func TestMeta(t *testing.T) {
 		}
 	}
 }
+
+var matchTests = []struct {
+	pat  string
+	mode Mode
+	name string
+	want bool
+}{
+	{`foo*`, 0, "foobar", true},
+	{`foo*`, 0, "barfoo", false},
+	{`FOO`, NoGlobCase, "foo", true},
+	{`[a-c]x`, NoGlobCase, "BX", true},
+	{`@(a|b).txt`, ExtendedOperators, "b.txt", true},
+	{`@(a|b).txt`, ExtendedOperators, "c.txt", false},
+	{`+(ab)`, ExtendedOperators, "ababab", true},
+	{`!(a).txt`, ExtendedOperators, "a.txt", false},
+	{`!(a).txt`, ExtendedOperators, "b.txt", true},
+	{`!(a).txt`, ExtendedOperators, "ab.txt", true},
+	{`!(foo|bar)`, ExtendedOperators, "bar", false},
+	{`!(foo|bar)`, ExtendedOperators, "baz", true},
+	{`a!(x)c`, ExtendedOperators, "abc", true},
+	{`a!(x)c`, ExtendedOperators, "axc", false},
+	{`!(*.go)`, ExtendedOperators | Filenames, "dir/a.txt", false},
+	{`[!(]!(x)`, ExtendedOperators, "ay", true},
+	{`!(a)`, ExtendedOperators | NoGlobCase, "A", false},
+	{`x!(é)`, ExtendedOperators, "xé", false},
+	{`!(a)-!(b)`, ExtendedOperators, "a-b", false},
+	{`!(a)-!(b)`, ExtendedOperators, "a-b-c", true},
+	{`!(*x)!(*y)z`, ExtendedOperators, "xyz", true},
+}
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+	for _, tc := range matchTests {
+		m, err := Compile(tc.pat, tc.mode)
+		if err != nil {
+			t.Errorf("Compile(%q, %b) errored with %q", tc.pat, tc.mode, err)
+			continue
+		}
+		if got := m.MatchString(tc.name); got != tc.want {
+			t.Errorf("Compile(%q, %b).MatchString(%q) got %t, wanted %t",
+				tc.pat, tc.mode, tc.name, got, tc.want)
+		}
+	}
+}
+
+func BenchmarkMatchNegated(b *testing.B) {
+	m, err := Compile(`!(*a)!(*b)c`, ExtendedOperators)
+	if err != nil {
+		b.Fatal(err)
+	}
+	name := strings.Repeat("ab", 1500)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if m.MatchString(name) {
+			b.Fatal("unexpected match")
+		}
+	}
+}
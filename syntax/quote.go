@@ -0,0 +1,113 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Quote returns a quoted version of the input string, so that the quoted
+// version is always expanded or interpreted as the original string. For
+// example, the input and output pairs may look like:
+//
+//	foo bar  ->  'foo bar'
+//	it's     ->  'it'\''s'
+//	a\tb     ->  $'a\tb'
+//
+// Strings which don't need quoting are returned as-is, and the empty string is
+// quoted as a pair of single quotes. Strings containing non-printable
+// characters use the $'...' form, which is supported by Bash and mksh but not
+// by POSIX Shell.
+//
+// This is the quoting that Bash uses when printing commands, such as in xtrace
+// mode.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	shellMetas := false
+	nonPrint := false
+	for i, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\'', '"', '\\', '|', '&', ';', '(', ')',
+			'<', '>', '!', '{', '}', '*', '[', '?', ']', '^', '$', '`':
+			shellMetas = true
+		case '~':
+			// tilde expansion only happens at the start of a
+			// word, or after = and : in assignments
+			if i == 0 || s[i-1] == '=' || s[i-1] == ':' {
+				shellMetas = true
+			}
+		case '#':
+			// comments start at the beginning of a word
+			if i == 0 {
+				shellMetas = true
+			}
+		case utf8.RuneError:
+			nonPrint = true
+		default:
+			if !unicode.IsPrint(r) {
+				nonPrint = true
+			}
+		}
+	}
+	switch {
+	case nonPrint:
+		return QuoteANSI(s)
+	case shellMetas:
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+	return s
+}
+
+// QuoteANSI quotes a string with the $'...' form, escaping non-printable
+// characters and invalid UTF-8 bytes, like Quote does for such strings. It is
+// supported by Bash and mksh, but not by POSIX Shell.
+//
+// Unlike Quote, it escapes tabs and newlines too, which is what Bash does in
+// contexts like ${var@Q} and "printf %q".
+func QuoteANSI(s string) string {
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			fmt.Fprintf(&b, "\\%03o", s[i])
+		case r == '\a':
+			b.WriteString(`\a`)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\x1b':
+			b.WriteString(`\E`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\v':
+			b.WriteString(`\v`)
+		case r == '\\', r == '\'':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case !unicode.IsPrint(r) && r < utf8.RuneSelf:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case !unicode.IsPrint(r) && r <= 0xffff:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, "\\U%08x", r)
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "testing"
+
+func TestQuote(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"foo", "foo"},
+		{"foo bar", "'foo bar'"},
+		{"it's", `'it'\''s'`},
+		{`a"b`, `'a"b'`},
+		{"$x", "'$x'"},
+		{"a=b", "a=b"},
+		{"x:y", "x:y"},
+		{"a%,b", "a%,b"},
+		{"~", "'~'"},
+		{"a~", "a~"},
+		{"a=~", "'a=~'"},
+		{"#", "'#'"},
+		{"a#", "a#"},
+		{"a\nb", "'a\nb'"},
+		{"\t", "'\t'"},
+		{"é", "é"},
+		{"a\x01b", `$'a\001b'`},
+		{"\x1b[0m'", `$'\E[0m\''`},
+		{"\xff", `$'\377'`},
+		{"\u200b", `$'\u200b'`},
+	}
+	for _, tc := range tests {
+		if got := Quote(tc.in); got != tc.want {
+			t.Errorf("Quote(%q): want %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestQuoteANSI(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"", "$''"},
+		{"foo bar", "$'foo bar'"},
+		{"it's", `$'it\'s'`},
+		{"a\tb\nc", `$'a\tb\nc'`},
+		{`a\b`, `$'a\\b'`},
+		{"\xff\u200b", `$'\377\u200b'`},
+	}
+	for _, tc := range tests {
+		if got := QuoteANSI(tc.in); got != tc.want {
+			t.Errorf("QuoteANSI(%q): want %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}